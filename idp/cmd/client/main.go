@@ -31,6 +31,8 @@ type providerMetadata struct {
 	AuthorizationEndpoint string `json:"authorization_endpoint"`
 	TokenEndpoint         string `json:"token_endpoint"`
 	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
 }
 
 type tokenResponse struct {
@@ -146,14 +148,25 @@ func discoverProvider(ctx context.Context, issuer string) (providerMetadata, err
 func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	session := s.sessionFromRequest(r)
 
+	var introspection map[string]any
+	if session != nil && session.AccessToken != "" && s.provider.IntrospectionEndpoint != "" {
+		if result, err := s.introspect(r.Context(), session.AccessToken); err == nil {
+			introspection = result
+		} else {
+			log.Printf("introspection failed: %v", err)
+		}
+	}
+
 	data := struct {
-		Config   config
-		Provider providerMetadata
-		Session  *sessionData
+		Config        config
+		Provider      providerMetadata
+		Session       *sessionData
+		Introspection map[string]any
 	}{
-		Config:   s.cfg,
-		Provider: s.provider,
-		Session:  session,
+		Config:        s.cfg,
+		Provider:      s.provider,
+		Session:       session,
+		Introspection: introspection,
 	}
 
 	if err := s.templates.ExecuteTemplate(w, "index", data); err != nil {
@@ -181,11 +194,18 @@ func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, s.provider.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
 }
 
+// handleLogout revokes the session's tokens at the provider before
+// forgetting them. Revoking the refresh token also revokes the access
+// tokens issued with it.
 func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if c, err := r.Cookie("oidc_client_session"); err == nil {
 		s.mu.Lock()
+		session := s.sessions[c.Value]
 		delete(s.sessions, c.Value)
 		s.mu.Unlock()
+		if session != nil {
+			s.revokeTokens(r.Context(), session)
+		}
 		http.SetCookie(w, &http.Cookie{
 			Name:   "oidc_client_session",
 			Value:  "",
@@ -280,6 +300,71 @@ func (s *server) exchangeCode(ctx context.Context, code string) (tokenResponse,
 	return token, nil
 }
 
+func (s *server) revokeTokens(ctx context.Context, session *sessionData) {
+	if s.provider.RevocationEndpoint == "" {
+		return
+	}
+	if session.RefreshToken != "" {
+		if err := s.revoke(ctx, session.RefreshToken, "refresh_token"); err != nil {
+			log.Printf("failed to revoke refresh token: %v", err)
+		}
+	}
+	if session.AccessToken != "" {
+		if err := s.revoke(ctx, session.AccessToken, "access_token"); err != nil {
+			log.Printf("failed to revoke access token: %v", err)
+		}
+	}
+}
+
+func (s *server) revoke(ctx context.Context, token, hint string) error {
+	values := url.Values{}
+	values.Set("token", token)
+	values.Set("token_type_hint", hint)
+
+	resp, err := s.postClientForm(ctx, s.provider.RevocationEndpoint, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("revocation endpoint error: %s %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+func (s *server) introspect(ctx context.Context, token string) (map[string]any, error) {
+	values := url.Values{}
+	values.Set("token", token)
+
+	resp, err := s.postClientForm(ctx, s.provider.IntrospectionEndpoint, values)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint error: %s", resp.Status)
+	}
+
+	result := make(map[string]any)
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// postClientForm posts values to a provider endpoint, authenticating with
+// the client's credentials over HTTP Basic.
+func (s *server) postClientForm(ctx context.Context, endpoint string, values url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+	return s.client.Do(req)
+}
+
 func (s *server) fetchUserInfo(ctx context.Context, accessToken string) (userInfo, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.provider.UserinfoEndpoint, nil)
 	if err != nil {
@@ -382,6 +467,8 @@ const indexTemplate = `{{ define "index" }}
             <li>Authorization Endpoint: {{ .Provider.AuthorizationEndpoint }}</li>
             <li>Token Endpoint: {{ .Provider.TokenEndpoint }}</li>
             <li>Userinfo Endpoint: {{ .Provider.UserinfoEndpoint }}</li>
+            <li>Introspection Endpoint: {{ .Provider.IntrospectionEndpoint }}</li>
+            <li>Revocation Endpoint: {{ .Provider.RevocationEndpoint }}</li>
         </ul>
     </section>
     <section>
@@ -393,6 +480,10 @@ const indexTemplate = `{{ define "index" }}
             <p><strong>Token Type:</strong> {{ .Session.TokenType }}</p>
             <p><strong>Scope:</strong> {{ .Session.Scope }}</p>
             <p><strong>Expires At:</strong> {{ .Session.ExpiresAt }}</p>
+            {{ if .Introspection }}
+                <h3>Introspection</h3>
+                <pre>{{ printf "%+v" .Introspection }}</pre>
+            {{ end }}
             {{ if .Session.User.Raw }}
                 <h3>User Info</h3>
                 <pre>{{ printf "%+v" .Session.User.Raw }}</pre>
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/keys"
+	"idp/internal/password"
+)
+
+const configUsage = "usage: idp config validate [-config <file>] | idp config print --effective [-config <file>]"
+
+// configCommand implements `idp config validate|print`. The config file is
+// taken from -config or IDP_CONFIG_FILE and the environment is applied on top,
+// exactly as the server does on start.
+func configCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(configUsage)
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("IDP_CONFIG_FILE"), "config file")
+	effective := fs.Bool("effective", false, "print the config after applying defaults and environment overrides")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "validate":
+		cfg, err := config.Load(*path)
+		if err != nil {
+			return err
+		}
+		if err := validateReferences(cfg); err != nil {
+			return err
+		}
+		fmt.Println("config OK")
+		return nil
+	case "print":
+		if !*effective {
+			return errors.New("only --effective is supported")
+		}
+		cfg, err := config.Load(*path)
+		if err != nil {
+			return err
+		}
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		defer encoder.Close()
+		return encoder.Encode(cfg.Redacted())
+	default:
+		return errors.New(configUsage)
+	}
+}
+
+// validateReferences checks what config.Validate cannot see on its own: the
+// signing algorithm, the TLS files and the clients and users files the config
+// points at.
+func validateReferences(cfg config.Config) error {
+	var errs []error
+
+	if _, err := keys.ParseAlgorithm(cfg.Keys.Algorithm); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.TLS.Enabled() {
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tls certificate: %w", err))
+		}
+	}
+	if _, err := cfg.TLS.ClientCAs(); err != nil {
+		errs = append(errs, err)
+	}
+
+	hasher, err := password.NewHasher(cfg.Passwords)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid password settings: %w", err))
+	}
+	if _, err := data.LoadClients(cfg.ClientsPath); err != nil {
+		errs = append(errs, err)
+	}
+	if hasher != nil {
+		if _, err := data.LoadUserStore(cfg.UsersPath, hasher); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"idp/internal/config"
+	"idp/internal/storage"
+)
+
+// grants implements `idp grants list|revoke`. It opens the storage file
+// directly, so the server has to be stopped first: while it runs, the bolt
+// file is locked and the command times out. Use GET and DELETE
+// /admin/grants on a running server instead.
+func grants(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: idp grants list -user <id> | idp grants revoke -user <id> -client <id>")
+	}
+
+	fs := flag.NewFlagSet("grants "+args[0], flag.ContinueOnError)
+	userID := fs.String("user", "", "user id")
+	clientID := fs.String("client", "", "client id")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *userID == "" {
+		return errors.New("-user is required")
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.Storage.Backend != storage.BackendBolt {
+		return fmt.Errorf("grants can only be managed offline with the %s backend", storage.BackendBolt)
+	}
+
+	backend, err := storage.OpenBackend(cfg.Storage.Backend, cfg.Storage.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	store := storage.New(backend, nil, nil, nil, cfg.Provider.Lifetimes, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	defer store.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		list, err := store.Grants(ctx, *userID)
+		if err != nil {
+			return err
+		}
+		for _, grant := range list {
+			fmt.Printf("%s\t%s\t%s\n", grant.ClientID, strings.Join(grant.Scopes, " "), grant.UpdatedAt.Format(time.RFC3339))
+		}
+		return nil
+	case "revoke":
+		if *clientID == "" {
+			return errors.New("-client is required")
+		}
+		return store.RevokeGrant(ctx, *userID, *clientID)
+	default:
+		return fmt.Errorf("unknown grants command %q", args[0])
+	}
+}
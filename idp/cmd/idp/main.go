@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"idp/internal/config"
+	"idp/internal/keys"
 	"idp/internal/op"
+	"idp/internal/password"
+	"idp/internal/storage"
 	"log"
 	"log/slog"
 	"net/http"
@@ -14,12 +18,18 @@ import (
 	"time"
 
 	"idp/internal/data"
-
-	"github.com/zitadel/oidc/v3/example/server/storage"
 )
 
 func main() {
-	cfg := config.LoadConfig()
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
 
 	logger := slog.New(
 		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -28,37 +38,71 @@ func main() {
 		}),
 	)
 
-	clients, err := data.LoadClients(cfg.ClientsPath)
+	hasher, err := password.NewHasher(cfg.Passwords)
 	if err != nil {
-		log.Fatalf("failed to load clients: %v", err)
+		log.Fatalf("failed to configure password hashing: %v", err)
 	}
-	storage.RegisterClients(clients...)
 
-	userStore, err := data.LoadUserStore(cfg.UsersPath)
+	watcher := data.NewWatcher(cfg.ClientsPath, cfg.UsersPath, hasher, logger)
+	clients, userStore, err := watcher.Load()
 	if err != nil {
-		log.Fatalf("failed to load users: %v", err)
+		log.Fatalf("failed to load clients and users: %v", err)
 	}
 
-	if len(clients) > 0 {
-		userStore.SetExampleClientID(clients[0].GetID())
+	keyManager, err := keys.NewManager(cfg.Keys, logger)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
 	}
 
-	store := storage.NewStorage(userStore)
+	cryptoKey, err := keys.CryptoKey(cfg.Keys.Dir, cfg.Provider.CryptoKey)
+	if err != nil {
+		log.Fatalf("failed to load crypto key: %v", err)
+	}
+
+	backend, err := storage.OpenBackend(cfg.Storage.Backend, cfg.Storage.Path)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
 
-	r := op.NewRouter(cfg.Issuer, store, logger)
+	store := storage.New(backend, clients, userStore, keyManager, cfg.Provider.Lifetimes, logger)
+	defer store.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go keyManager.Run(ctx)
+	go store.Run(ctx)
+	go watcher.Run(ctx, store.Replace)
+
+	r := op.NewRouter(cfg, cryptoKey, store, logger)
 
 	srv := &http.Server{
 		Addr:    cfg.HTTPAddr,
 		Handler: r,
 	}
+	if cfg.TLS.Enabled() {
+		// certificates are requested but verified per client, so that
+		// self-signed ones reach self_signed_tls_client_auth
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.RequestClientCert,
+		}
+	}
 
 	go func() {
 		slog.Info(
 			"OIDC provider starting",
 			"address", cfg.HTTPAddr,
 			"issuer", cfg.Issuer,
+			"storage", cfg.Storage.Backend,
+			"tls", cfg.TLS.Enabled(),
 		)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if cfg.TLS.Enabled() {
+			err = srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("http server failed", "error", err)
 		}
 	}()
@@ -66,6 +110,25 @@ func main() {
 	waitForShutdown(srv)
 }
 
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "hash-password":
+		err = hashPassword(args)
+	case "totp-secret":
+		err = totpSecret(args)
+	case "grants":
+		err = grants(args)
+	case "config":
+		err = configCommand(args)
+	default:
+		log.Fatalf("unknown command %q", name)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
 func waitForShutdown(server *http.Server) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
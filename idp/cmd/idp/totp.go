@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+
+	"idp/internal/config"
+	"idp/internal/totp"
+)
+
+// totpSecret implements `idp totp-secret`. It prints a new secret for the
+// totp_secret of a user in users.json and the otpauth URI to import it into
+// an authenticator app.
+func totpSecret(args []string) error {
+	fs := flag.NewFlagSet("totp-secret", flag.ContinueOnError)
+	username := fs.String("user", "", "username shown in the authenticator app")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: idp totp-secret -user <username>")
+		fmt.Fprintln(fs.Output(), "Generates a TOTP secret and the otpauth URI for authenticator apps.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		fs.Usage()
+		return errors.New("-user is required")
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	issuer := cfg.Issuer
+	if u, err := url.Parse(cfg.Issuer); err == nil && u.Hostname() != "" {
+		issuer = u.Hostname()
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	fmt.Println(totp.URI(issuer, *username, secret))
+	return nil
+}
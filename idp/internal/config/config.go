@@ -1,33 +1,389 @@
 package config
 
 import (
+	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// Config is read from the optional config file named by IDP_CONFIG_FILE
+// (YAML or JSON) and the IDP_* environment variables, which override single
+// fields of the file.
 type Config struct {
-	HTTPAddr    string
-	Issuer      string
-	UsersPath   string
-	ClientsPath string
+	HTTPAddr    string          `yaml:"http_addr"`
+	Issuer      string          `yaml:"issuer"`
+	UsersPath   string          `yaml:"users_path"`
+	ClientsPath string          `yaml:"clients_path"`
+	TLS         TLSConfig       `yaml:"tls"`
+	Storage     StorageConfig   `yaml:"storage"`
+	Keys        KeysConfig      `yaml:"keys"`
+	Passwords   PasswordsConfig `yaml:"passwords"`
+	Login       LoginConfig     `yaml:"login"`
+	Device      DeviceConfig    `yaml:"device"`
+	WebAuthn    WebAuthnConfig  `yaml:"webauthn"`
+	Provider    ProviderConfig  `yaml:"provider"`
+}
+
+// TLSConfig enables HTTPS, with optional client certificates for mutual-TLS
+// client authentication and certificate-bound access tokens. ClientCAFile
+// holds the CAs that tls_client_auth certificates must chain to. When TLS is
+// terminated in front of the IdP, the client certificate is read from
+// ClientCertHeader, as a URL-escaped PEM or base64 DER, on requests from
+// TrustedProxies only.
+type TLSConfig struct {
+	CertFile         string   `yaml:"cert_file"`
+	KeyFile          string   `yaml:"key_file"`
+	ClientCAFile     string   `yaml:"client_ca_file"`
+	ClientCertHeader string   `yaml:"client_cert_header"`
+	TrustedProxies   []string `yaml:"trusted_proxies"`
 }
 
-func LoadConfig() Config {
-	httpAddr := getEnv("IDP_HTTP_ADDR", ":8080")
+// Enabled reports whether the IdP serves HTTPS itself.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// ClientCertificates reports whether requests can carry client
+// certificates, either from the TLS handshake or from a trusted proxy.
+func (t TLSConfig) ClientCertificates() bool {
+	return t.Enabled() || t.ClientCertHeader != ""
+}
 
-	issuer, ok := lookupEnv("IDP_ISSUER")
-	if !ok || issuer == "" {
-		issuer = defaultIssuer(httpAddr)
+// ClientCAs loads the CAs in ClientCAFile, or returns nil when it is not
+// set.
+func (t TLSConfig) ClientCAs() (*x509.CertPool, error) {
+	if t.ClientCAFile == "" {
+		return nil, nil
 	}
+	raw, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("tls client CA file %s has no PEM certificates", t.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// StorageConfig selects the backend that holds auth requests, tokens and
+// device codes.
+type StorageConfig struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+}
+
+// KeysConfig controls where signing keys are kept and how they are rotated.
+type KeysConfig struct {
+	Dir              string        `yaml:"dir"`
+	Algorithm        string        `yaml:"algorithm"`
+	CurrentKeyID     string        `yaml:"current_key_id"`
+	NextKeyID        string        `yaml:"next_key_id"`
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+	RotationOverlap  time.Duration `yaml:"rotation_overlap"`
+}
+
+// PasswordsConfig controls how user passwords are hashed and verified.
+// Argon2 memory is given in KiB.
+type PasswordsConfig struct {
+	AllowPlaintext    bool   `yaml:"allow_plaintext"`
+	Argon2Memory      uint32 `yaml:"argon2_memory"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism"`
+}
+
+// LoginConfig throttles password sign-ins per username and per client
+// address. Every failure after FreeFailures (FreeFailuresPerIP for an
+// address) doubles the wait before the next attempt, from BaseDelay up to
+// MaxDelay. MaxFailures locks the username and MaxFailuresPerIP the address
+// for LockoutDuration; failures are forgotten LockoutDuration after the last
+// one. X-Forwarded-For names the client only on requests from
+// TrustedProxies, such as the BFF.
+type LoginConfig struct {
+	FreeFailures      uint32        `yaml:"free_failures"`
+	FreeFailuresPerIP uint32        `yaml:"free_failures_per_ip"`
+	BaseDelay         time.Duration `yaml:"base_delay"`
+	MaxDelay          time.Duration `yaml:"max_delay"`
+	MaxFailures       uint32        `yaml:"max_failures"`
+	MaxFailuresPerIP  uint32        `yaml:"max_failures_per_ip"`
+	LockoutDuration   time.Duration `yaml:"lockout_duration"`
+	TrustedProxies    []string      `yaml:"trusted_proxies"`
+}
+
+// DeviceConfig controls the device authorization grant. UserCodeCharset is
+// either "base20" (BCDF-GHJK) or "digits" (123-456-789).
+type DeviceConfig struct {
+	Lifetime        time.Duration `yaml:"lifetime"`
+	PollInterval    time.Duration `yaml:"poll_interval"`
+	UserCodeCharset string        `yaml:"user_code_charset"`
+}
+
+// WebAuthnConfig sets the relying party that passkeys are registered for.
+// RPID defaults to the issuer's host and Origins to the issuer's origin;
+// passkeys stop working when RPID changes.
+type WebAuthnConfig struct {
+	RPID    string   `yaml:"rp_id"`
+	RPName  string   `yaml:"rp_name"`
+	Origins []string `yaml:"origins"`
+}
 
+// Default returns the configuration used when neither a file nor the
+// environment sets a field.
+func Default() Config {
 	return Config{
-		HTTPAddr:    httpAddr,
-		Issuer:      issuer,
-		UsersPath:   getEnv("IDP_USERS_PATH", "data/users.json"),
-		ClientsPath: getEnv("IDP_CLIENTS_PATH", "data/clients.json"),
+		HTTPAddr:    ":8080",
+		UsersPath:   "data/users.json",
+		ClientsPath: "data/clients.json",
+		Storage: StorageConfig{
+			Backend: "bolt",
+			Path:    "data/idp.db",
+		},
+		Keys: KeysConfig{
+			Dir:              "data/keys",
+			Algorithm:        "RS256",
+			RotationInterval: 30 * 24 * time.Hour,
+			RotationOverlap:  24 * time.Hour,
+		},
+		Passwords: PasswordsConfig{
+			Argon2Memory:      64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 2,
+		},
+		Login: LoginConfig{
+			FreeFailures:      3,
+			FreeFailuresPerIP: 20,
+			BaseDelay:         time.Second,
+			MaxDelay:          time.Minute,
+			MaxFailures:       10,
+			MaxFailuresPerIP:  100,
+			LockoutDuration:   15 * time.Minute,
+		},
+		Device: DeviceConfig{
+			Lifetime:        5 * time.Minute,
+			PollInterval:    5 * time.Second,
+			UserCodeCharset: "base20",
+		},
+		WebAuthn: WebAuthnConfig{
+			RPName: "IdP",
+		},
+		Provider: defaultProvider(),
+	}
+}
+
+func LoadConfig() (Config, error) {
+	return Load(getEnv("IDP_CONFIG_FILE", ""))
+}
+
+// Load layers the config file at path, if any, and the environment over the
+// defaults and validates the result.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("failed to decode config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	cfg.Storage.Backend = strings.ToLower(cfg.Storage.Backend)
+	cfg.Keys.Algorithm = strings.ToUpper(cfg.Keys.Algorithm)
+	cfg.Device.UserCodeCharset = strings.ToLower(cfg.Device.UserCodeCharset)
+	if cfg.Issuer == "" {
+		cfg.Issuer = defaultIssuer(cfg.HTTPAddr)
+	}
+	if u, err := url.Parse(cfg.Issuer); err == nil {
+		if cfg.WebAuthn.RPID == "" {
+			cfg.WebAuthn.RPID = u.Hostname()
+		}
+		if len(cfg.WebAuthn.Origins) == 0 && u.Host != "" {
+			cfg.WebAuthn.Origins = []string{u.Scheme + "://" + u.Host}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	overrideString(&c.HTTPAddr, "IDP_HTTP_ADDR")
+	overrideString(&c.Issuer, "IDP_ISSUER")
+	overrideString(&c.UsersPath, "IDP_USERS_PATH")
+	overrideString(&c.ClientsPath, "IDP_CLIENTS_PATH")
+
+	overrideString(&c.TLS.CertFile, "IDP_TLS_CERT_FILE")
+	overrideString(&c.TLS.KeyFile, "IDP_TLS_KEY_FILE")
+	overrideString(&c.TLS.ClientCAFile, "IDP_TLS_CLIENT_CA_FILE")
+	overrideString(&c.TLS.ClientCertHeader, "IDP_TLS_CLIENT_CERT_HEADER")
+	overrideList(&c.TLS.TrustedProxies, "IDP_TLS_TRUSTED_PROXIES")
+
+	overrideString(&c.Storage.Backend, "IDP_STORAGE")
+	overrideString(&c.Storage.Path, "IDP_STORAGE_PATH")
+
+	overrideString(&c.Keys.Dir, "IDP_KEYS_DIR")
+	overrideString(&c.Keys.Algorithm, "IDP_SIGNING_ALGORITHM")
+	overrideString(&c.Keys.CurrentKeyID, "IDP_SIGNING_KEY_ID")
+	overrideString(&c.Keys.NextKeyID, "IDP_NEXT_SIGNING_KEY_ID")
+	overrideString(&c.Device.UserCodeCharset, "IDP_DEVICE_USER_CODE_CHARSET")
+
+	overrideList(&c.Login.TrustedProxies, "IDP_LOGIN_TRUSTED_PROXIES")
+
+	overrideString(&c.WebAuthn.RPID, "IDP_WEBAUTHN_RP_ID")
+	overrideString(&c.WebAuthn.RPName, "IDP_WEBAUTHN_RP_NAME")
+	overrideList(&c.WebAuthn.Origins, "IDP_WEBAUTHN_ORIGINS")
+
+	return errors.Join(
+		overrideDuration(&c.Keys.RotationInterval, "IDP_KEY_ROTATION_INTERVAL"),
+		overrideDuration(&c.Keys.RotationOverlap, "IDP_KEY_ROTATION_OVERLAP"),
+		overrideBool(&c.Passwords.AllowPlaintext, "IDP_ALLOW_PLAINTEXT_PASSWORDS"),
+		overrideUint(&c.Passwords.Argon2Memory, "IDP_ARGON2_MEMORY"),
+		overrideUint(&c.Passwords.Argon2Iterations, "IDP_ARGON2_ITERATIONS"),
+		overrideUint(&c.Passwords.Argon2Parallelism, "IDP_ARGON2_PARALLELISM"),
+		overrideUint(&c.Login.FreeFailures, "IDP_LOGIN_FREE_FAILURES"),
+		overrideUint(&c.Login.FreeFailuresPerIP, "IDP_LOGIN_FREE_FAILURES_PER_IP"),
+		overrideDuration(&c.Login.BaseDelay, "IDP_LOGIN_BASE_DELAY"),
+		overrideDuration(&c.Login.MaxDelay, "IDP_LOGIN_MAX_DELAY"),
+		overrideUint(&c.Login.MaxFailures, "IDP_LOGIN_MAX_FAILURES"),
+		overrideUint(&c.Login.MaxFailuresPerIP, "IDP_LOGIN_MAX_FAILURES_PER_IP"),
+		overrideDuration(&c.Login.LockoutDuration, "IDP_LOGIN_LOCKOUT_DURATION"),
+		overrideDuration(&c.Device.Lifetime, "IDP_DEVICE_CODE_LIFETIME"),
+		overrideDuration(&c.Device.PollInterval, "IDP_DEVICE_POLL_INTERVAL"),
+		c.Provider.applyEnv(),
+	)
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.HTTPAddr == "" {
+		errs = append(errs, errors.New("http_addr is required"))
+	}
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("issuer %q must be an absolute URL", c.Issuer))
+	}
+	if c.UsersPath == "" {
+		errs = append(errs, errors.New("users_path is required"))
+	}
+	if c.ClientsPath == "" {
+		errs = append(errs, errors.New("clients_path is required"))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.cert_file and tls.key_file must be set together"))
+	}
+	if c.TLS.ClientCertHeader != "" && len(c.TLS.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("tls.client_cert_header requires tls.trusted_proxies"))
+	}
+	for _, proxy := range c.TLS.TrustedProxies {
+		if _, err := ParsePrefix(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tls trusted proxy %q", proxy))
+		}
+	}
+
+	switch c.Storage.Backend {
+	case "memory":
+	case "bolt":
+		if c.Storage.Path == "" {
+			errs = append(errs, errors.New("storage.path is required for the bolt backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported storage backend %q", c.Storage.Backend))
+	}
+
+	if c.Keys.Dir == "" {
+		errs = append(errs, errors.New("keys.dir is required"))
+	}
+	if c.Keys.RotationInterval < 0 || c.Keys.RotationOverlap < 0 {
+		errs = append(errs, errors.New("key rotation interval and overlap must not be negative"))
+	}
+	// tokens signed just before a rotation must verify until they expire
+	if longest := max(c.Provider.Lifetimes.AccessToken, c.Provider.Lifetimes.IDToken); c.Keys.RotationOverlap < longest {
+		errs = append(errs, fmt.Errorf("key rotation overlap must be at least the longest access or id token lifetime (%s)", longest))
+	}
+
+	if c.Login.MaxFailures == 0 || c.Login.MaxFailuresPerIP == 0 {
+		errs = append(errs, errors.New("login max_failures and max_failures_per_ip must be positive"))
+	}
+	if c.Login.BaseDelay <= 0 || c.Login.MaxDelay < c.Login.BaseDelay || c.Login.LockoutDuration <= 0 {
+		errs = append(errs, errors.New("login base_delay and lockout_duration must be positive and max_delay at least base_delay"))
+	}
+	for _, proxy := range c.Login.TrustedProxies {
+		if _, err := ParsePrefix(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("invalid login trusted proxy %q", proxy))
+		}
 	}
+
+	if c.Device.Lifetime <= 0 || c.Device.PollInterval <= 0 {
+		errs = append(errs, errors.New("device code lifetime and poll interval must be positive"))
+	}
+	switch c.Device.UserCodeCharset {
+	case "base20", "digits":
+	default:
+		errs = append(errs, fmt.Errorf("unsupported device user code charset %q", c.Device.UserCodeCharset))
+	}
+
+	if c.WebAuthn.RPID == "" {
+		errs = append(errs, errors.New("webauthn.rp_id is required"))
+	}
+	for _, origin := range c.WebAuthn.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("webauthn origin %q must be a scheme and host", origin))
+			continue
+		}
+		if host := u.Hostname(); host != c.WebAuthn.RPID && !strings.HasSuffix(host, "."+c.WebAuthn.RPID) {
+			errs = append(errs, fmt.Errorf("webauthn origin %q is not within rp_id %q", origin, c.WebAuthn.RPID))
+		}
+	}
+
+	if err := c.Provider.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy that is safe to print.
+func (c Config) Redacted() Config {
+	if c.Provider.CryptoKey != "" {
+		c.Provider.CryptoKey = "<redacted>"
+	}
+	return c
+}
+
+// ParsePrefix parses a trusted proxy given as a CIDR prefix or a single
+// address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
 
 func defaultIssuer(addr string) string {
@@ -52,15 +408,3 @@ func defaultIssuer(addr string) string {
 
 	return fmt.Sprintf("http://%s:%s", host, port)
 }
-
-func lookupEnv(key string) (string, bool) {
-	val, ok := os.LookupEnv(key)
-	return val, ok
-}
-
-func getEnv(key, fallback string) string {
-	if val, ok := lookupEnv(key); ok && val != "" {
-		return val
-	}
-	return fallback
-}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func lookupEnv(key string) (string, bool) {
+	val, ok := os.LookupEnv(key)
+	return val, ok
+}
+
+func getEnv(key, fallback string) string {
+	if val, ok := lookupEnv(key); ok && val != "" {
+		return val
+	}
+	return fallback
+}
+
+func overrideString(field *string, key string) {
+	*field = getEnv(key, *field)
+}
+
+func overrideDuration(field *time.Duration, key string) error {
+	val, ok := lookupEnv(key)
+	if !ok || val == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("invalid duration for %s: %w", key, err)
+	}
+	*field = d
+	return nil
+}
+
+func overrideBool(field *bool, key string) error {
+	val, ok := lookupEnv(key)
+	if !ok || val == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fmt.Errorf("invalid boolean for %s: %w", key, err)
+	}
+	*field = b
+	return nil
+}
+
+func overrideUint[T uint8 | uint32](field *T, key string) error {
+	val, ok := lookupEnv(key)
+	if !ok || val == "" {
+		return nil
+	}
+
+	bitSize := 32
+	if _, ok := any(*field).(uint8); ok {
+		bitSize = 8
+	}
+	n, err := strconv.ParseUint(val, 10, bitSize)
+	if err != nil {
+		return fmt.Errorf("invalid number for %s: %w", key, err)
+	}
+	*field = T(n)
+	return nil
+}
+
+// overrideList splits a comma or space separated value.
+func overrideList(field *[]string, key string) {
+	val, ok := lookupEnv(key)
+	if !ok || val == "" {
+		return
+	}
+	*field = strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
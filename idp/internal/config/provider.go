@@ -0,0 +1,241 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"golang.org/x/text/language"
+)
+
+// ProviderConfig selects the OpenID Provider features that are enabled.
+type ProviderConfig struct {
+	GrantTypes             []string       `yaml:"grant_types"`
+	AuthMethods            []string       `yaml:"auth_methods"`
+	CodeChallengeMethods   []string       `yaml:"code_challenge_methods"`
+	Lifetimes              TokenLifetimes `yaml:"lifetimes"`
+	UILocales              []string       `yaml:"ui_locales"`
+	RequestObjectSupported bool           `yaml:"request_object_supported"`
+	// DPoPNonceRequired makes DPoP proofs echo a DPoP-Nonce from the IdP,
+	// which bounds how long a proof can be used even if iat is forged.
+	DPoPNonceRequired bool `yaml:"dpop_nonce_required"`
+	// CryptoKey encrypts opaque tokens and cookies. It is 32 bytes, hex or
+	// base64 encoded; when empty a key is generated in the keys directory.
+	CryptoKey string `yaml:"crypto_key"`
+}
+
+// TokenLifetimes bounds how long issued artifacts stay valid. A refresh
+// token expires when it is not used for RefreshTokenIdle; rotation never
+// extends its family beyond RefreshTokenAbsolute from the original login.
+// Session is how long a browser stays signed in to the IdP itself.
+// PushedAuthRequest is how long a request_uri from the PAR endpoint can be
+// used.
+type TokenLifetimes struct {
+	AccessToken          time.Duration `yaml:"access_token"`
+	RefreshTokenIdle     time.Duration `yaml:"refresh_token_idle"`
+	RefreshTokenAbsolute time.Duration `yaml:"refresh_token_absolute"`
+	IDToken              time.Duration `yaml:"id_token"`
+	AuthRequest          time.Duration `yaml:"auth_request"`
+	Session              time.Duration `yaml:"session"`
+	PushedAuthRequest    time.Duration `yaml:"pushed_auth_request"`
+}
+
+var (
+	supportedGrantTypes = []string{
+		string(oidc.GrantTypeCode),
+		string(oidc.GrantTypeImplicit),
+		string(oidc.GrantTypeRefreshToken),
+		string(oidc.GrantTypeDeviceCode),
+		string(oidc.GrantTypeClientCredentials),
+		string(oidc.GrantTypeTokenExchange),
+		string(oidc.GrantTypeBearer),
+	}
+	supportedAuthMethods = []string{
+		string(oidc.AuthMethodBasic),
+		string(oidc.AuthMethodPost),
+		string(oidc.AuthMethodPrivateKeyJWT),
+		"client_secret_jwt",
+		"tls_client_auth",
+		"self_signed_tls_client_auth",
+		string(oidc.AuthMethodNone),
+	}
+	supportedCodeChallengeMethods = []string{
+		string(oidc.CodeChallengeMethodS256),
+		string(oidc.CodeChallengeMethodPlain),
+	}
+)
+
+func defaultProvider() ProviderConfig {
+	return ProviderConfig{
+		GrantTypes: []string{
+			string(oidc.GrantTypeCode),
+			string(oidc.GrantTypeImplicit),
+			string(oidc.GrantTypeRefreshToken),
+			string(oidc.GrantTypeDeviceCode),
+			string(oidc.GrantTypeClientCredentials),
+			string(oidc.GrantTypeTokenExchange),
+		},
+		AuthMethods: []string{
+			string(oidc.AuthMethodBasic),
+			string(oidc.AuthMethodPost),
+			string(oidc.AuthMethodPrivateKeyJWT),
+			"client_secret_jwt",
+			"tls_client_auth",
+			"self_signed_tls_client_auth",
+			string(oidc.AuthMethodNone),
+		},
+		CodeChallengeMethods: []string{
+			string(oidc.CodeChallengeMethodS256),
+		},
+		Lifetimes: TokenLifetimes{
+			AccessToken:          5 * time.Minute,
+			RefreshTokenIdle:     24 * time.Hour,
+			RefreshTokenAbsolute: 30 * 24 * time.Hour,
+			IDToken:              time.Hour,
+			AuthRequest:          30 * time.Minute,
+			Session:              12 * time.Hour,
+			PushedAuthRequest:    time.Minute,
+		},
+		UILocales:              []string{"ja", "en"},
+		RequestObjectSupported: true,
+	}
+}
+
+func (p *ProviderConfig) applyEnv() error {
+	overrideList(&p.GrantTypes, "IDP_GRANT_TYPES")
+	overrideList(&p.AuthMethods, "IDP_AUTH_METHODS")
+	overrideList(&p.CodeChallengeMethods, "IDP_CODE_CHALLENGE_METHODS")
+	overrideList(&p.UILocales, "IDP_UI_LOCALES")
+	overrideString(&p.CryptoKey, "IDP_CRYPTO_KEY")
+
+	return errors.Join(
+		overrideBool(&p.RequestObjectSupported, "IDP_REQUEST_OBJECT_SUPPORTED"),
+		overrideBool(&p.DPoPNonceRequired, "IDP_DPOP_NONCE_REQUIRED"),
+		overrideDuration(&p.Lifetimes.AccessToken, "IDP_ACCESS_TOKEN_LIFETIME"),
+		overrideDuration(&p.Lifetimes.RefreshTokenIdle, "IDP_REFRESH_TOKEN_IDLE_LIFETIME"),
+		overrideDuration(&p.Lifetimes.RefreshTokenAbsolute, "IDP_REFRESH_TOKEN_ABSOLUTE_LIFETIME"),
+		overrideDuration(&p.Lifetimes.IDToken, "IDP_ID_TOKEN_LIFETIME"),
+		overrideDuration(&p.Lifetimes.AuthRequest, "IDP_AUTH_REQUEST_LIFETIME"),
+		overrideDuration(&p.Lifetimes.Session, "IDP_SESSION_LIFETIME"),
+		overrideDuration(&p.Lifetimes.PushedAuthRequest, "IDP_PUSHED_AUTH_REQUEST_LIFETIME"),
+	)
+}
+
+// Validate reports every invalid setting at once.
+func (p ProviderConfig) Validate() error {
+	var errs []error
+
+	errs = append(errs, validateList("grant type", p.GrantTypes, supportedGrantTypes)...)
+	if !p.GrantTypeEnabled(oidc.GrantTypeCode) {
+		errs = append(errs, fmt.Errorf("grant type %s cannot be disabled", oidc.GrantTypeCode))
+	}
+
+	errs = append(errs, validateList("auth method", p.AuthMethods, supportedAuthMethods)...)
+	for _, method := range []oidc.AuthMethod{oidc.AuthMethodBasic, oidc.AuthMethodNone} {
+		// both are always accepted by the token endpoint
+		if !p.AuthMethodEnabled(method) {
+			errs = append(errs, fmt.Errorf("auth method %s cannot be disabled", method))
+		}
+	}
+
+	errs = append(errs, validateList("code challenge method", p.CodeChallengeMethods, supportedCodeChallengeMethods)...)
+
+	for _, lifetime := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"access token", p.Lifetimes.AccessToken},
+		{"refresh token idle", p.Lifetimes.RefreshTokenIdle},
+		{"refresh token absolute", p.Lifetimes.RefreshTokenAbsolute},
+		{"id token", p.Lifetimes.IDToken},
+		{"auth request", p.Lifetimes.AuthRequest},
+		{"session", p.Lifetimes.Session},
+		{"pushed auth request", p.Lifetimes.PushedAuthRequest},
+	} {
+		if lifetime.d <= 0 {
+			errs = append(errs, fmt.Errorf("%s lifetime must be positive", lifetime.name))
+		}
+	}
+	if p.Lifetimes.RefreshTokenIdle > p.Lifetimes.RefreshTokenAbsolute {
+		errs = append(errs, errors.New("refresh token idle lifetime must not exceed the absolute lifetime"))
+	}
+
+	if len(p.UILocales) == 0 {
+		errs = append(errs, errors.New("at least one ui locale is required"))
+	}
+	for _, locale := range p.UILocales {
+		if _, err := language.Parse(locale); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ui locale %q: %w", locale, err))
+		}
+	}
+
+	if p.CryptoKey != "" {
+		if _, err := ParseCryptoKey(p.CryptoKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p ProviderConfig) GrantTypeEnabled(grantType oidc.GrantType) bool {
+	return slices.Contains(p.GrantTypes, string(grantType))
+}
+
+func (p ProviderConfig) AuthMethodEnabled(method oidc.AuthMethod) bool {
+	return slices.Contains(p.AuthMethods, string(method))
+}
+
+func (p ProviderConfig) CodeChallengeMethodEnabled(method oidc.CodeChallengeMethod) bool {
+	return slices.Contains(p.CodeChallengeMethods, string(method))
+}
+
+// Locales returns the parsed UI locales. It must only be called on a
+// validated config.
+func (p ProviderConfig) Locales() []language.Tag {
+	tags := make([]language.Tag, 0, len(p.UILocales))
+	for _, locale := range p.UILocales {
+		tags = append(tags, language.Make(locale))
+	}
+	return tags
+}
+
+// ParseCryptoKey decodes a 32 byte key given as hex or base64.
+func ParseCryptoKey(encoded string) ([32]byte, error) {
+	var key [32]byte
+
+	raw, err := hex.DecodeString(encoded)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return key, errors.New("crypto key must be hex or base64 encoded")
+	}
+	if len(raw) != len(key) {
+		return key, fmt.Errorf("crypto key must be %d bytes, got %d", len(key), len(raw))
+	}
+
+	copy(key[:], raw)
+	return key, nil
+}
+
+func validateList(kind string, values, supported []string) []error {
+	var errs []error
+	if len(values) == 0 {
+		errs = append(errs, fmt.Errorf("at least one %s is required", kind))
+	}
+	for _, value := range values {
+		if !slices.Contains(supported, value) {
+			errs = append(errs, fmt.Errorf("unsupported %s %q, expected one of %s", kind, value, strings.Join(supported, ", ")))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,379 @@
+package data
+
+import (
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+var _ op.Client = (*Client)(nil)
+
+// Client authentication methods the oidc package has no constants for:
+// a JWT signed with the client's secret (OpenID Connect Core 9) and mutual
+// TLS with a CA issued or a self-signed certificate (RFC 8705).
+const (
+	AuthMethodClientSecretJWT         oidc.AuthMethod = "client_secret_jwt"
+	AuthMethodTLSClientAuth           oidc.AuthMethod = "tls_client_auth"
+	AuthMethodSelfSignedTLSClientAuth oidc.AuthMethod = "self_signed_tls_client_auth"
+)
+
+func defaultLoginURL(id string) string {
+	return "/login/username?authRequestID=" + id
+}
+
+// Client is the op.Client built from a ClientRecord.
+type Client struct {
+	id              string
+	secret          string
+	redirectURIs    []string
+	postLogoutURIs  []string
+	applicationType op.ApplicationType
+	authMethod      oidc.AuthMethod
+	verifiedMethod  oidc.AuthMethod
+	tlsSubject      TLSClientAuthSubject
+	certBound       bool
+	dpopBound       bool
+	responseTypes   []oidc.ResponseType
+	grantTypes      []oidc.GrantType
+	accessTokenType op.AccessTokenType
+	devMode         bool
+	firstParty      bool
+	requirePAR      bool
+	requireMFA      bool
+	resourceServer  bool
+	scopes          []string
+	audiences       []string
+	tokenExchange   *TokenExchangePolicy
+	backchannel     backchannelLogout
+	frontchannelURI string
+	keys            clientKeys
+	requestURIs     []string
+}
+
+type backchannelLogout struct {
+	uri             string
+	sessionRequired bool
+}
+
+type clientKeys struct {
+	jwks    *jose.JSONWebKeySet
+	jwksURI string
+}
+
+func (c *Client) GetID() string {
+	return c.id
+}
+
+func (c *Client) Secret() string {
+	return c.secret
+}
+
+// FirstParty reports whether users are not asked for consent.
+func (c *Client) FirstParty() bool {
+	return c.firstParty
+}
+
+// RequirePushedAuthorizationRequests reports whether the client must push
+// its authorization requests to the PAR endpoint.
+func (c *Client) RequirePushedAuthorizationRequests() bool {
+	return c.requirePAR
+}
+
+// RequireMFA reports whether users must sign in to the client with a second
+// factor.
+func (c *Client) RequireMFA() bool {
+	return c.requireMFA
+}
+
+// ResourceServer reports whether the client is an API that may introspect
+// tokens issued to other clients.
+func (c *Client) ResourceServer() bool {
+	return c.resourceServer
+}
+
+// AllowedScopes lists the scopes a service client may request.
+func (c *Client) AllowedScopes() []string {
+	return c.scopes
+}
+
+// AllowedAudiences lists the audiences a service client may request tokens
+// for.
+func (c *Client) AllowedAudiences() []string {
+	return c.audiences
+}
+
+// TokenExchangePolicy is nil when the client may not exchange tokens.
+func (c *Client) TokenExchangePolicy() *TokenExchangePolicy {
+	return c.tokenExchange
+}
+
+// BackchannelLogoutURI is empty when the client does not take back-channel
+// logout notifications.
+func (c *Client) BackchannelLogoutURI() string {
+	return c.backchannel.uri
+}
+
+// BackchannelLogoutSessionRequired reports whether logout tokens sent to the
+// client must carry a sid.
+func (c *Client) BackchannelLogoutSessionRequired() bool {
+	return c.backchannel.sessionRequired
+}
+
+// FrontchannelLogoutURI is empty when the client does not take front-channel
+// logout notifications.
+func (c *Client) FrontchannelLogoutURI() string {
+	return c.frontchannelURI
+}
+
+// JWKS is nil when the client registered no keys or a jwks_uri instead.
+func (c *Client) JWKS() *jose.JSONWebKeySet {
+	return c.keys.jwks
+}
+
+// JWKSURI is empty when the client registered no keys or a jwks instead.
+func (c *Client) JWKSURI() string {
+	return c.keys.jwksURI
+}
+
+// RequestURIs lists where the client may publish request objects.
+func (c *Client) RequestURIs() []string {
+	return c.requestURIs
+}
+
+func (c *Client) RedirectURIs() []string {
+	return c.redirectURIs
+}
+
+func (c *Client) PostLogoutRedirectURIs() []string {
+	return c.postLogoutURIs
+}
+
+func (c *Client) ApplicationType() op.ApplicationType {
+	return c.applicationType
+}
+
+func (c *Client) AuthMethod() oidc.AuthMethod {
+	return c.authMethod
+}
+
+// VerifiedAuthMethod is the token_endpoint_auth_method of a client that
+// authenticates with a JWT or a certificate, which are verified before the
+// provider sees the request, and empty otherwise.
+func (c *Client) VerifiedAuthMethod() oidc.AuthMethod {
+	return c.verifiedMethod
+}
+
+// TLSClientAuthSubject is what the certificate of a tls_client_auth client
+// must name.
+func (c *Client) TLSClientAuthSubject() TLSClientAuthSubject {
+	return c.tlsSubject
+}
+
+// CertificateBoundAccessTokens reports whether the client's access tokens are
+// bound to its certificate.
+func (c *Client) CertificateBoundAccessTokens() bool {
+	return c.certBound
+}
+
+// DPoPBoundAccessTokens reports whether the client must prove possession of
+// a DPoP key to get tokens.
+func (c *Client) DPoPBoundAccessTokens() bool {
+	return c.dpopBound
+}
+
+func (c *Client) ResponseTypes() []oidc.ResponseType {
+	return c.responseTypes
+}
+
+func (c *Client) GrantTypes() []oidc.GrantType {
+	return c.grantTypes
+}
+
+func (c *Client) LoginURL(id string) string {
+	return defaultLoginURL(id)
+}
+
+func (c *Client) AccessTokenType() op.AccessTokenType {
+	return c.accessTokenType
+}
+
+func (c *Client) IDTokenLifetime() time.Duration {
+	return 1 * time.Hour
+}
+
+func (c *Client) DevMode() bool {
+	return c.devMode
+}
+
+func (c *Client) RestrictAdditionalIdTokenScopes() func(scopes []string) []string {
+	return func(scopes []string) []string {
+		return scopes
+	}
+}
+
+func (c *Client) RestrictAdditionalAccessTokenScopes() func(scopes []string) []string {
+	return func(scopes []string) []string {
+		return scopes
+	}
+}
+
+func (c *Client) IsScopeAllowed(string) bool {
+	return false
+}
+
+func (c *Client) IDTokenUserinfoClaimsAssertion() bool {
+	return false
+}
+
+func (c *Client) ClockSkew() time.Duration {
+	return 0
+}
+
+// grantTypes adds the refresh_token and token exchange grants to the base
+// grants of a client type when the record opts in.
+func grantTypes(record ClientRecord, base ...oidc.GrantType) []oidc.GrantType {
+	if record.RefreshTokens {
+		base = append(base, oidc.GrantTypeRefreshToken)
+	}
+	if record.TokenExchange != nil {
+		base = append(base, oidc.GrantTypeTokenExchange)
+	}
+	return base
+}
+
+// authMethods splits a confidential client's token_endpoint_auth_method into
+// the method the provider sees and the method verified in front of it. The
+// provider treats clients using JWTs or certificates like ones using
+// client_secret_basic.
+func authMethods(record ClientRecord) (oidc.AuthMethod, oidc.AuthMethod) {
+	switch method := oidc.AuthMethod(record.TokenEndpointAuthMethod); method {
+	case oidc.AuthMethodPost:
+		return oidc.AuthMethodPost, ""
+	case oidc.AuthMethodPrivateKeyJWT, AuthMethodClientSecretJWT, AuthMethodTLSClientAuth, AuthMethodSelfSignedTLSClientAuth:
+		return oidc.AuthMethodBasic, method
+	default:
+		return oidc.AuthMethodBasic, ""
+	}
+}
+
+func accessTokenType(record ClientRecord) op.AccessTokenType {
+	if record.AccessTokenFormat == "jwt" {
+		return op.AccessTokenTypeJWT
+	}
+	return op.AccessTokenTypeBearer
+}
+
+func webClient(record ClientRecord) *Client {
+	authMethod, verifiedMethod := authMethods(record)
+	return &Client{
+		id:              record.ID,
+		secret:          record.Secret,
+		redirectURIs:    record.RedirectURIs,
+		postLogoutURIs:  record.PostLogoutRedirectURIs,
+		applicationType: op.ApplicationTypeWeb,
+		authMethod:      authMethod,
+		verifiedMethod:  verifiedMethod,
+		tlsSubject:      record.TLSClientAuthSubject,
+		certBound:       record.TLSClientCertificateBoundAccessTokens,
+		dpopBound:       record.DPoPBoundAccessTokens,
+		responseTypes:   []oidc.ResponseType{oidc.ResponseTypeCode, oidc.ResponseTypeIDTokenOnly, oidc.ResponseTypeIDToken},
+		grantTypes:      grantTypes(record, oidc.GrantTypeCode),
+		accessTokenType: accessTokenType(record),
+		devMode:         true,
+		firstParty:      record.FirstParty,
+		requirePAR:      record.RequirePushedAuthorizationRequests,
+		requireMFA:      record.RequireMFA,
+		backchannel:     backchannelLogout{record.BackchannelLogoutURI, record.BackchannelLogoutSessionRequired},
+		frontchannelURI: record.FrontchannelLogoutURI,
+		tokenExchange:   record.TokenExchange,
+		keys:            clientKeys{record.JWKS, record.JWKSURI},
+		requestURIs:     record.RequestURIs,
+	}
+}
+
+func nativeClient(record ClientRecord) *Client {
+	return &Client{
+		id:              record.ID,
+		redirectURIs:    record.RedirectURIs,
+		postLogoutURIs:  record.PostLogoutRedirectURIs,
+		applicationType: op.ApplicationTypeNative,
+		authMethod:      oidc.AuthMethodNone,
+		certBound:       record.TLSClientCertificateBoundAccessTokens,
+		dpopBound:       record.DPoPBoundAccessTokens,
+		responseTypes:   []oidc.ResponseType{oidc.ResponseTypeCode},
+		grantTypes:      grantTypes(record, oidc.GrantTypeCode),
+		accessTokenType: accessTokenType(record),
+		firstParty:      record.FirstParty,
+		requirePAR:      record.RequirePushedAuthorizationRequests,
+		requireMFA:      record.RequireMFA,
+		backchannel:     backchannelLogout{record.BackchannelLogoutURI, record.BackchannelLogoutSessionRequired},
+		frontchannelURI: record.FrontchannelLogoutURI,
+		tokenExchange:   record.TokenExchange,
+		keys:            clientKeys{record.JWKS, record.JWKSURI},
+		requestURIs:     record.RequestURIs,
+	}
+}
+
+func deviceClient(record ClientRecord) *Client {
+	authMethod, verifiedMethod := authMethods(record)
+	return &Client{
+		id:              record.ID,
+		secret:          record.Secret,
+		applicationType: op.ApplicationTypeWeb,
+		authMethod:      authMethod,
+		verifiedMethod:  verifiedMethod,
+		tlsSubject:      record.TLSClientAuthSubject,
+		certBound:       record.TLSClientCertificateBoundAccessTokens,
+		dpopBound:       record.DPoPBoundAccessTokens,
+		responseTypes:   []oidc.ResponseType{oidc.ResponseTypeCode},
+		grantTypes:      grantTypes(record, oidc.GrantTypeDeviceCode),
+		accessTokenType: accessTokenType(record),
+		firstParty:      record.FirstParty,
+		requireMFA:      record.RequireMFA,
+		backchannel:     backchannelLogout{record.BackchannelLogoutURI, record.BackchannelLogoutSessionRequired},
+		frontchannelURI: record.FrontchannelLogoutURI,
+		tokenExchange:   record.TokenExchange,
+		keys:            clientKeys{record.JWKS, record.JWKSURI},
+	}
+}
+
+// serviceClient acts on its own behalf with the client_credentials grant and
+// gets JWT access tokens that resource servers can verify offline.
+func serviceClient(record ClientRecord) *Client {
+	authMethod, verifiedMethod := authMethods(record)
+	return &Client{
+		id:              record.ID,
+		secret:          record.Secret,
+		applicationType: op.ApplicationTypeWeb,
+		authMethod:      authMethod,
+		verifiedMethod:  verifiedMethod,
+		tlsSubject:      record.TLSClientAuthSubject,
+		certBound:       record.TLSClientCertificateBoundAccessTokens,
+		dpopBound:       record.DPoPBoundAccessTokens,
+		grantTypes:      grantTypes(record, oidc.GrantTypeClientCredentials),
+		accessTokenType: op.AccessTokenTypeJWT,
+		scopes:          record.Scopes,
+		audiences:       record.Audiences,
+		tokenExchange:   record.TokenExchange,
+		keys:            clientKeys{record.JWKS, record.JWKSURI},
+	}
+}
+
+// resourceServerClient only authenticates at the introspection endpoint; it
+// has no grants and cannot sign users in.
+func resourceServerClient(record ClientRecord) *Client {
+	authMethod, verifiedMethod := authMethods(record)
+	return &Client{
+		id:              record.ID,
+		secret:          record.Secret,
+		applicationType: op.ApplicationTypeWeb,
+		authMethod:      authMethod,
+		verifiedMethod:  verifiedMethod,
+		tlsSubject:      record.TLSClientAuthSubject,
+		accessTokenType: op.AccessTokenTypeBearer,
+		resourceServer:  true,
+		keys:            clientKeys{record.JWKS, record.JWKSURI},
+	}
+}
@@ -3,31 +3,102 @@ package data
 import (
 	"encoding/json"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"strings"
 
-	"github.com/zitadel/oidc/v3/example/server/storage"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
 )
 
-var postLogoutByClient = make(map[string][]string)
-
 type ClientRecord struct {
 	ID                     string   `json:"id"`
 	Type                   string   `json:"type"`
 	Secret                 string   `json:"secret"`
 	RedirectURIs           []string `json:"redirect_uris"`
 	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
+	FirstParty             bool     `json:"first_party"`
+	// TokenEndpointAuthMethod is how a confidential client authenticates:
+	// client_secret_basic (the default), client_secret_post,
+	// client_secret_jwt, private_key_jwt or self_signed_tls_client_auth, which
+	// need jwks or jwks_uri, or tls_client_auth, which needs one of the
+	// TLSClientAuthSubject fields.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+	TLSClientAuthSubject
+	// TLSClientCertificateBoundAccessTokens binds the client's access tokens
+	// to the certificate it presents at the token endpoint.
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens"`
+	// DPoPBoundAccessTokens requires a DPoP proof at the token endpoint, so
+	// that all of the client's tokens are bound to a DPoP key (RFC 9449).
+	DPoPBoundAccessTokens bool `json:"dpop_bound_access_tokens"`
+	// RequireMFA only lets users sign in with a second factor, as if every
+	// request asked for the multi-factor acr.
+	RequireMFA bool `json:"require_mfa"`
+	// RequirePushedAuthorizationRequests rejects authorization requests that
+	// were not pushed to the PAR endpoint first.
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+	// AccessTokenFormat is "opaque" (the default) or "jwt". Only JWT access
+	// tokens can be exchanged with the token exchange grant.
+	AccessTokenFormat string `json:"access_token_format"`
+	// RefreshTokens allows the client to request offline_access and use the
+	// refresh_token grant.
+	RefreshTokens bool `json:"refresh_tokens"`
+	// BackchannelLogoutURI receives a logout token when a session the client
+	// took part in ends.
+	BackchannelLogoutURI             string `json:"backchannel_logout_uri"`
+	BackchannelLogoutSessionRequired bool   `json:"backchannel_logout_session_required"`
+	// FrontchannelLogoutURI is loaded in an iframe, with iss and sid, when a
+	// session the client took part in is ended from the browser.
+	FrontchannelLogoutURI string `json:"frontchannel_logout_uri"`
+	// Scopes and Audiences are what a service client may request with the
+	// client_credentials grant.
+	Scopes    []string `json:"scopes"`
+	Audiences []string `json:"audiences"`
+	// TokenExchange allows the client to exchange tokens issued to it for
+	// tokens narrowed to other audiences.
+	TokenExchange *TokenExchangePolicy `json:"token_exchange"`
+	// JWKS or JWKSURI holds the public keys that verify JWTs signed by the
+	// client, such as request objects.
+	JWKS    *jose.JSONWebKeySet `json:"jwks"`
+	JWKSURI string              `json:"jwks_uri"`
+	// RequestURIs lists where the client may publish request objects that it
+	// passes by reference.
+	RequestURIs []string `json:"request_uris"`
+}
+
+// TLSClientAuthSubject is the subject distinguished name or the subject
+// alternative name that the certificate of a tls_client_auth client must
+// have (RFC 8705 2.1.2).
+type TLSClientAuthSubject struct {
+	SubjectDN string `json:"tls_client_auth_subject_dn"`
+	SANDNS    string `json:"tls_client_auth_san_dns"`
+	SANURI    string `json:"tls_client_auth_san_uri"`
+	SANIP     string `json:"tls_client_auth_san_ip"`
+	SANEmail  string `json:"tls_client_auth_san_email"`
 }
 
-func LoadClients(path string) ([]*storage.Client, error) {
-	file, err := os.Open(path)
+// TokenExchangePolicy limits what a client may request with the token
+// exchange grant. Exchanged tokens name the client, or the subject of the
+// actor token, in an act claim; only with Impersonation and no actor token
+// are they issued as if to the user directly.
+type TokenExchangePolicy struct {
+	Audiences     []string `json:"audiences"`
+	Scopes        []string `json:"scopes"`
+	Impersonation bool     `json:"impersonation"`
+}
+
+func LoadClients(path string) ([]*Client, error) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open clients file: %w", err)
 	}
-	defer file.Close()
+	return parseClients(raw)
+}
 
+func parseClients(raw []byte) ([]*Client, error) {
 	var records []ClientRecord
-	if err := json.NewDecoder(file).Decode(&records); err != nil {
+	if err := json.Unmarshal(raw, &records); err != nil {
 		return nil, fmt.Errorf("failed to decode clients file: %w", err)
 	}
 
@@ -35,50 +106,163 @@ func LoadClients(path string) ([]*storage.Client, error) {
 		return nil, fmt.Errorf("clients file must define at least one client")
 	}
 
-	clients := make([]*storage.Client, 0, len(records))
-
-	postLogout := make(map[string][]string, len(records))
+	clients := make([]*Client, 0, len(records))
+	seen := make(map[string]bool, len(records))
 
 	for _, record := range records {
 		if record.ID == "" {
 			return nil, fmt.Errorf("client record is missing id")
 		}
+		if seen[record.ID] {
+			return nil, fmt.Errorf("duplicate client id %s", record.ID)
+		}
+		seen[record.ID] = true
+
+		if !validURI(record.BackchannelLogoutURI) {
+			return nil, fmt.Errorf("client %s has an invalid backchannel_logout_uri", record.ID)
+		}
+		if !validURI(record.FrontchannelLogoutURI) {
+			return nil, fmt.Errorf("client %s has an invalid frontchannel_logout_uri", record.ID)
+		}
+		if err := validateKeys(record); err != nil {
+			return nil, err
+		}
+		if err := validateAuthMethod(record); err != nil {
+			return nil, err
+		}
+
+		switch record.AccessTokenFormat {
+		case "", "opaque", "jwt":
+		default:
+			return nil, fmt.Errorf("client %s has an unsupported access_token_format %q", record.ID, record.AccessTokenFormat)
+		}
 
 		clientType := strings.ToLower(record.Type)
-		var client *storage.Client
+		if record.TokenExchange != nil && !record.confidential() {
+			return nil, fmt.Errorf("client %s requires a secret or private_key_jwt to use token exchange", record.ID)
+		}
+		var client *Client
 
 		switch clientType {
 		case "web", "confidential":
-			if record.Secret == "" {
-				return nil, fmt.Errorf("web client %s requires a secret", record.ID)
+			if !record.confidential() {
+				return nil, fmt.Errorf("web client %s requires a secret or private_key_jwt", record.ID)
 			}
-			client = storage.WebClient(record.ID, record.Secret, record.RedirectURIs...)
+			client = webClient(record)
 		case "native", "public":
-			client = storage.NativeClient(record.ID, record.RedirectURIs...)
+			client = nativeClient(record)
 		case "device":
-			if record.Secret == "" {
-				return nil, fmt.Errorf("device client %s requires a secret", record.ID)
+			if !record.confidential() {
+				return nil, fmt.Errorf("device client %s requires a secret or private_key_jwt", record.ID)
+			}
+			client = deviceClient(record)
+		case "service":
+			if !record.confidential() {
+				return nil, fmt.Errorf("service client %s requires a secret or private_key_jwt", record.ID)
 			}
-			client = storage.DeviceClient(record.ID, record.Secret)
+			client = serviceClient(record)
+		case "resource_server":
+			if !record.confidential() {
+				return nil, fmt.Errorf("resource server %s requires a secret or private_key_jwt", record.ID)
+			}
+			client = resourceServerClient(record)
 		default:
 			return nil, fmt.Errorf("unsupported client type %q for client %s", record.Type, record.ID)
 		}
 
-		if len(record.PostLogoutRedirectURIs) > 0 {
-			postLogout[record.ID] = append([]string(nil), record.PostLogoutRedirectURIs...)
-		}
 		clients = append(clients, client)
 	}
 
-	postLogoutByClient = postLogout
-
 	return clients, nil
 }
 
-func PostLogoutRedirectURIs(clientID string) []string {
-	uris := postLogoutByClient[clientID]
-	if len(uris) == 0 {
+// confidential reports whether the client has credentials to authenticate
+// with.
+func (r ClientRecord) confidential() bool {
+	switch oidc.AuthMethod(r.TokenEndpointAuthMethod) {
+	case oidc.AuthMethodPrivateKeyJWT, AuthMethodTLSClientAuth, AuthMethodSelfSignedTLSClientAuth:
+		return true
+	}
+	return r.Secret != ""
+}
+
+// validateAuthMethod checks that the client has what its
+// token_endpoint_auth_method needs. Native clients are public and cannot
+// authenticate. The secret of client_secret_jwt is an HMAC key and must be
+// at least as long as the SHA-256 output.
+func validateAuthMethod(record ClientRecord) error {
+	method := oidc.AuthMethod(record.TokenEndpointAuthMethod)
+	switch strings.ToLower(record.Type) {
+	case "native", "public":
+		if method != "" && method != oidc.AuthMethodNone {
+			return fmt.Errorf("native client %s cannot use token_endpoint_auth_method %s", record.ID, method)
+		}
 		return nil
 	}
-	return append([]string(nil), uris...)
+
+	switch method {
+	case "", oidc.AuthMethodBasic, oidc.AuthMethodPost:
+	case AuthMethodClientSecretJWT:
+		if len(record.Secret) < 32 {
+			return fmt.Errorf("client %s requires a secret of at least 32 bytes for client_secret_jwt", record.ID)
+		}
+	case oidc.AuthMethodPrivateKeyJWT, AuthMethodSelfSignedTLSClientAuth:
+		if record.JWKS == nil && record.JWKSURI == "" {
+			return fmt.Errorf("client %s requires jwks or jwks_uri for %s", record.ID, method)
+		}
+	case AuthMethodTLSClientAuth:
+		subject := record.TLSClientAuthSubject
+		set := 0
+		for _, value := range []string{subject.SubjectDN, subject.SANDNS, subject.SANURI, subject.SANIP, subject.SANEmail} {
+			if value != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("client %s requires exactly one tls_client_auth subject for tls_client_auth", record.ID)
+		}
+		if _, err := netip.ParseAddr(subject.SANIP); subject.SANIP != "" && err != nil {
+			return fmt.Errorf("client %s has an invalid tls_client_auth_san_ip", record.ID)
+		}
+	default:
+		return fmt.Errorf("client %s has an unsupported token_endpoint_auth_method %q", record.ID, record.TokenEndpointAuthMethod)
+	}
+	return nil
+}
+
+// validateKeys checks that the client registered public signing keys in at
+// most one of jwks and jwks_uri, and where its request objects are published.
+func validateKeys(record ClientRecord) error {
+	if record.JWKS != nil && record.JWKSURI != "" {
+		return fmt.Errorf("client %s must not set both jwks and jwks_uri", record.ID)
+	}
+	if !validURI(record.JWKSURI) {
+		return fmt.Errorf("client %s has an invalid jwks_uri", record.ID)
+	}
+	if record.JWKS != nil {
+		if len(record.JWKS.Keys) == 0 {
+			return fmt.Errorf("client %s has an empty jwks", record.ID)
+		}
+		for _, key := range record.JWKS.Keys {
+			if !key.Valid() || !key.IsPublic() {
+				return fmt.Errorf("client %s has a jwks key %q that is not a public key", record.ID, key.KeyID)
+			}
+		}
+	}
+	for _, uri := range record.RequestURIs {
+		if u, err := url.Parse(uri); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("client %s has an invalid request_uri %q", record.ID, uri)
+		}
+	}
+	return nil
+}
+
+// validURI accepts an empty value or an absolute http(s) URI without a
+// fragment.
+func validURI(uri string) bool {
+	if uri == "" {
+		return true
+	}
+	u, err := url.Parse(uri)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Fragment == ""
 }
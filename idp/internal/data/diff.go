@@ -0,0 +1,58 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const maxDiffLines = 100
+
+var secretField = regexp.MustCompile(`("(?:password|secret|totp_secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// diffLines returns a line diff between the live and the rejected file with
+// passwords, client secrets and TOTP secrets redacted. Lines are prefixed
+// with "-" or "+" and their line number in the respective file.
+func diffLines(live, rejected []byte) string {
+	a := strings.Split(redact(live), "\n")
+	b := strings.Split(redact(rejected), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for (i < len(a) || j < len(b)) && len(out) < maxDiffLines {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			out = append(out, fmt.Sprintf("+%d: %s", j+1, b[j]))
+			j++
+		default:
+			out = append(out, fmt.Sprintf("-%d: %s", i+1, a[i]))
+			i++
+		}
+	}
+	if len(out) == maxDiffLines {
+		out = append(out, "...")
+	}
+	return strings.Join(out, "\n")
+}
+
+func redact(raw []byte) string {
+	return secretField.ReplaceAllString(string(raw), `$1"<redacted>"`)
+}
@@ -2,14 +2,26 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 
-	"github.com/zitadel/oidc/v3/example/server/storage"
 	"golang.org/x/text/language"
+
+	"idp/internal/atomicfile"
+	"idp/internal/password"
+	"idp/internal/totp"
 )
 
+// ErrInvalidCredentials is returned by Authenticate for an unknown user or a
+// wrong password.
+var ErrInvalidCredentials = errors.New("username or password wrong")
+
 type UserRecord struct {
 	ID                string `json:"id"`
 	Username          string `json:"username"`
@@ -22,42 +34,89 @@ type UserRecord struct {
 	PhoneVerified     bool   `json:"phone_verified"`
 	PreferredLanguage string `json:"preferred_language"`
 	IsAdmin           bool   `json:"is_admin"`
+	// TOTPSecret enrolls the user in two-factor sign-in with an
+	// authenticator app. It is the base32 secret from `idp totp-secret`.
+	TOTPSecret string `json:"totp_secret,omitempty"`
+}
+
+type User struct {
+	ID                string
+	Username          string
+	Password          string
+	FirstName         string
+	LastName          string
+	Email             string
+	EmailVerified     bool
+	Phone             string
+	PhoneVerified     bool
+	PreferredLanguage language.Tag
+	IsAdmin           bool
+	TOTPKey           []byte
+}
+
+// TOTPEnrolled reports whether the user signs in with a second factor.
+func (u *User) TOTPEnrolled() bool {
+	return len(u.TOTPKey) > 0
 }
 
 type UserStore struct {
-	usersByID       map[string]*storage.User
-	usersByUsername map[string]*storage.User
-	exampleClientID string
+	mu              sync.RWMutex
+	path            string
+	readOnly        bool
+	hasher          *password.Hasher
+	usersByID       map[string]*User
+	usersByUsername map[string]*User
 }
 
-func LoadUserStore(path string) (*UserStore, error) {
-	file, err := os.Open(path)
+func LoadUserStore(path string, hasher *password.Hasher) (*UserStore, error) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open users file: %w", err)
 	}
-	defer file.Close()
+	return parseUsers(raw, path, hasher)
+}
 
+func parseUsers(raw []byte, path string, hasher *password.Hasher) (*UserStore, error) {
 	var records []UserRecord
-	if err := json.NewDecoder(file).Decode(&records); err != nil {
+	if err := json.Unmarshal(raw, &records); err != nil {
 		return nil, fmt.Errorf("failed to decode users file: %w", err)
 	}
 
 	store := &UserStore{
-		usersByID:       make(map[string]*storage.User),
-		usersByUsername: make(map[string]*storage.User),
+		path:            path,
+		hasher:          hasher,
+		usersByID:       make(map[string]*User),
+		usersByUsername: make(map[string]*User),
 	}
 
 	for _, record := range records {
 		if record.ID == "" || record.Username == "" {
 			return nil, fmt.Errorf("user record must include id and username")
 		}
+		if _, ok := store.usersByID[record.ID]; ok {
+			return nil, fmt.Errorf("duplicate user id %s", record.ID)
+		}
+		if _, ok := store.usersByUsername[record.Username]; ok {
+			return nil, fmt.Errorf("duplicate username %s", record.Username)
+		}
+		if err := hasher.Check(record.Password); err != nil {
+			return nil, fmt.Errorf("user %s: %w", record.ID, err)
+		}
+		var totpKey []byte
+		if record.TOTPSecret != "" {
+			key, err := totp.DecodeSecret(record.TOTPSecret)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", record.ID, err)
+			}
+			totpKey = key
+		}
 
 		preferredLang := language.English
 		if strings.TrimSpace(record.PreferredLanguage) != "" {
 			preferredLang = language.Make(record.PreferredLanguage)
 		}
 
-		user := &storage.User{
+		user := &User{
 			ID:                record.ID,
 			Username:          record.Username,
 			Password:          record.Password,
@@ -69,6 +128,7 @@ func LoadUserStore(path string) (*UserStore, error) {
 			PhoneVerified:     record.PhoneVerified,
 			PreferredLanguage: preferredLang,
 			IsAdmin:           record.IsAdmin,
+			TOTPKey:           totpKey,
 		}
 
 		store.usersByID[user.ID] = user
@@ -78,18 +138,115 @@ func LoadUserStore(path string) (*UserStore, error) {
 	return store, nil
 }
 
-func (s *UserStore) SetExampleClientID(id string) {
-	s.exampleClientID = id
+func (s *UserStore) GetUserByID(id string) *User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usersByID[id]
 }
 
-func (s *UserStore) ExampleClientID() string {
-	return s.exampleClientID
+func (s *UserStore) GetUserByUsername(username string) *User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usersByUsername[username]
 }
 
-func (s *UserStore) GetUserByID(id string) *storage.User {
-	return s.usersByID[id]
+// Authenticate verifies the password of the user. Hashes made with outdated
+// parameters are replaced and written back to the users file; a failed write
+// is logged and does not fail the login. Once the file turns out to be
+// read-only, as when it is mounted :ro, hashes are no longer upgraded.
+func (s *UserStore) Authenticate(username, plain string) (*User, error) {
+	user := s.GetUserByUsername(username)
+	if user == nil {
+		s.hasher.VerifyDummy(plain)
+		return nil, ErrInvalidCredentials
+	}
+
+	rehash, err := s.hasher.Verify(user.Password, plain)
+	if err != nil {
+		if errors.Is(err, password.ErrPlaintext) {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	if rehash && !s.isReadOnly() {
+		err := s.rehash(user, plain)
+		switch {
+		case errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS):
+			s.mu.Lock()
+			s.readOnly = true
+			s.mu.Unlock()
+			slog.Warn("users file is read-only, outdated password hashes will not be upgraded", "path", s.path, "error", err)
+		case err != nil:
+			slog.Error("failed to upgrade password hash", "user", user.ID, "error", err)
+		default:
+			slog.Info("password hash upgraded", "user", user.ID)
+		}
+	}
+
+	return user, nil
 }
 
-func (s *UserStore) GetUserByUsername(username string) *storage.User {
-	return s.usersByUsername[username]
+func (s *UserStore) isReadOnly() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readOnly
+}
+
+func (s *UserStore) rehash(user *User, plain string) error {
+	hash, err := s.hasher.Hash(plain)
+	if err != nil {
+		return err
+	}
+	if err := s.writePassword(user.ID, hash); err != nil {
+		return err
+	}
+
+	updated := *user
+	updated.Password = hash
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usersByID[updated.ID] = &updated
+	s.usersByUsername[updated.Username] = &updated
+	return nil
+}
+
+// writePassword replaces the password of a single record in the users file.
+// The file is read again so that edits made since startup are kept.
+func (s *UserStore) writePassword(id, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	var records []UserRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return fmt.Errorf("failed to decode users file: %w", err)
+	}
+
+	found := false
+	for i := range records {
+		if records[i].ID == id {
+			records[i].Password = hash
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("user %s no longer exists in users file", id)
+	}
+
+	out, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode users file: %w", err)
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat users file: %w", err)
+	}
+	return atomicfile.WriteFile(s.path, append(out, '\n'), info.Mode().Perm())
 }
@@ -0,0 +1,197 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"idp/internal/password"
+)
+
+// reloadDelay coalesces the bursts of events editors and config map updates
+// produce for a single change.
+const reloadDelay = 250 * time.Millisecond
+
+// ApplyFunc receives a client and user set that passed validation.
+type ApplyFunc func(clients []*Client, users *UserStore)
+
+// Watcher loads the clients and users files and reloads them when they change
+// on disk or the process receives SIGHUP. Both files are validated before
+// either is applied; a rejected reload keeps the previous set live.
+type Watcher struct {
+	clientsPath string
+	usersPath   string
+	hasher      *password.Hasher
+	logger      *slog.Logger
+
+	mu          sync.Mutex
+	liveClients []byte
+	liveUsers   []byte
+}
+
+func NewWatcher(clientsPath, usersPath string, hasher *password.Hasher, logger *slog.Logger) *Watcher {
+	return &Watcher{
+		clientsPath: clientsPath,
+		usersPath:   usersPath,
+		hasher:      hasher,
+		logger:      logger.With("component", "reload"),
+	}
+}
+
+// Load reads both files and records them as the live configuration.
+func (w *Watcher) Load() ([]*Client, *UserStore, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	clientsRaw, usersRaw, err := w.read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clients, err := parseClients(clientsRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	users, err := parseUsers(usersRaw, w.usersPath, w.hasher)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.liveClients, w.liveUsers = clientsRaw, usersRaw
+	return clients, users, nil
+}
+
+// Run reloads the files until the context is cancelled.
+func (w *Watcher) Run(ctx context.Context, apply ApplyFunc) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	fsw, err := w.watch()
+	if err != nil {
+		w.logger.Warn("file watching disabled, reload with SIGHUP", "error", err)
+	} else {
+		defer fsw.Close()
+		events, errs = fsw.Events, fsw.Errors
+	}
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.logger.Info("reload requested by SIGHUP")
+			w.Reload(apply)
+		case event := <-events:
+			if w.relevant(event) {
+				timer.Reset(reloadDelay)
+			}
+		case err := <-errs:
+			w.logger.Error("file watcher failed", "error", err)
+		case <-timer.C:
+			w.Reload(apply)
+		}
+	}
+}
+
+// Reload validates both files and applies them if they changed. It returns
+// false when the files were rejected.
+func (w *Watcher) Reload(apply ApplyFunc) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	clientsRaw, usersRaw, err := w.read()
+	if err != nil {
+		w.logger.Error("configuration reload failed, keeping previous configuration", "error", err)
+		return false
+	}
+	if bytes.Equal(clientsRaw, w.liveClients) && bytes.Equal(usersRaw, w.liveUsers) {
+		return true
+	}
+
+	clients, clientsErr := parseClients(clientsRaw)
+	users, usersErr := parseUsers(usersRaw, w.usersPath, w.hasher)
+	if clientsErr != nil || usersErr != nil {
+		w.reject(w.clientsPath, w.liveClients, clientsRaw, clientsErr)
+		w.reject(w.usersPath, w.liveUsers, usersRaw, usersErr)
+		return false
+	}
+
+	apply(clients, users)
+	w.liveClients, w.liveUsers = clientsRaw, usersRaw
+	w.logger.Info("configuration reloaded", "clients", len(clients), "users", len(users.usersByID))
+	return true
+}
+
+func (w *Watcher) reject(path string, live, rejected []byte, err error) {
+	if err == nil {
+		return
+	}
+	w.logger.Error(
+		"configuration rejected, keeping previous configuration",
+		"file", path,
+		"error", err,
+		"diff", diffLines(live, rejected),
+	)
+}
+
+func (w *Watcher) read() ([]byte, []byte, error) {
+	clientsRaw, err := os.ReadFile(w.clientsPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open clients file: %w", err)
+	}
+	usersRaw, err := os.ReadFile(w.usersPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open users file: %w", err)
+	}
+	return clientsRaw, usersRaw, nil
+}
+
+// watch watches the parent directories rather than the files themselves so
+// that atomic replacements by editors and config map symlink swaps are seen.
+func (w *Watcher) watch() (*fsnotify.Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, path := range []string{w.clientsPath, w.usersPath} {
+		dir := filepath.Dir(path)
+		if slices.Contains(dirs, dir) {
+			continue
+		}
+		if err := fsw.Add(dir); err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	return fsw, nil
+}
+
+func (w *Watcher) relevant(event fsnotify.Event) bool {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	return name == filepath.Clean(w.clientsPath) ||
+		name == filepath.Clean(w.usersPath) ||
+		filepath.Base(name) == "..data"
+}
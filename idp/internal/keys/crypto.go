@@ -0,0 +1,53 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"idp/internal/atomicfile"
+	"idp/internal/config"
+)
+
+// cryptoKeyName must not use an extension the keystore treats as a signing
+// key.
+const cryptoKeyName = "crypto.secret"
+
+// CryptoKey returns the configured symmetric key, or the one stored in the
+// keys directory, generating it on first start so that encrypted tokens and
+// cookies survive restarts.
+func CryptoKey(dir, configured string) ([32]byte, error) {
+	if configured != "" {
+		return config.ParseCryptoKey(configured)
+	}
+
+	path := filepath.Join(dir, cryptoKeyName)
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		key, err := config.ParseCryptoKey(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return key, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return [32]byte{}, fmt.Errorf("failed to read crypto key: %w", err)
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return key, fmt.Errorf("failed to generate crypto key: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return key, fmt.Errorf("failed to create keystore directory: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key[:]) + "\n"
+	if err := atomicfile.WriteFile(path, []byte(encoded), 0o600); err != nil {
+		return key, fmt.Errorf("failed to write crypto key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,146 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+type Status string
+
+const (
+	StatusCurrent Status = "current"
+	StatusNext    Status = "next"
+	StatusRetired Status = "retired"
+	// StatusExpired marks a key the operator supplied whose overlap window
+	// has passed. It is no longer published, but its file is left in place.
+	StatusExpired Status = "expired"
+)
+
+// Key is a private signing key together with its rotation state.
+type Key struct {
+	id          string
+	algorithm   jose.SignatureAlgorithm
+	private     crypto.Signer
+	file        string
+	generated   bool
+	status      Status
+	createdAt   time.Time
+	activatedAt time.Time
+	retiredAt   time.Time
+}
+
+func (k *Key) ID() string {
+	return k.id
+}
+
+func (k *Key) SignatureAlgorithm() jose.SignatureAlgorithm {
+	return k.algorithm
+}
+
+func (k *Key) Key() any {
+	return k.private
+}
+
+func (k *Key) Status() Status {
+	return k.status
+}
+
+// PublicKey is the published half of a Key as it appears on the JWKS endpoint.
+type PublicKey struct {
+	id        string
+	algorithm jose.SignatureAlgorithm
+	key       crypto.PublicKey
+}
+
+func (k *PublicKey) ID() string {
+	return k.id
+}
+
+func (k *PublicKey) Algorithm() jose.SignatureAlgorithm {
+	return k.algorithm
+}
+
+func (k *PublicKey) Use() string {
+	return "sig"
+}
+
+func (k *PublicKey) Key() any {
+	return k.key
+}
+
+func (k *Key) public() *PublicKey {
+	return &PublicKey{
+		id:        k.id,
+		algorithm: k.algorithm,
+		key:       k.private.Public(),
+	}
+}
+
+// ParseAlgorithm validates a configured signing algorithm.
+func ParseAlgorithm(name string) (jose.SignatureAlgorithm, error) {
+	switch alg := jose.SignatureAlgorithm(strings.ToUpper(name)); alg {
+	case jose.RS256, jose.ES256:
+		return alg, nil
+	case "EDDSA":
+		return jose.EdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm %q", name)
+	}
+}
+
+func generatePrivateKey(alg jose.SignatureAlgorithm) (crypto.Signer, error) {
+	switch alg {
+	case jose.RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jose.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.EdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// algorithmFor derives the signature algorithm from the key material.
+func algorithmFor(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("unsupported ecdsa curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// thumbprintID returns the RFC 7638 thumbprint of the public key, used as key ID
+// for generated keys when none is configured.
+func thumbprintID(key crypto.Signer) (string, error) {
+	jwk := jose.JSONWebKey{Key: key.Public()}
+	sum, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,233 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+
+	"idp/internal/atomicfile"
+)
+
+const manifestName = "keystore.json"
+
+// keystore is a directory of PEM or JWK private keys plus a manifest that
+// records which key is current, next or retired.
+type keystore struct {
+	dir string
+}
+
+type manifest struct {
+	Keys []manifestEntry `json:"keys"`
+}
+
+type manifestEntry struct {
+	ID          string    `json:"kid"`
+	File        string    `json:"file"`
+	Generated   bool      `json:"generated,omitempty"`
+	Status      Status    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatedAt time.Time `json:"activated_at,omitzero"`
+	RetiredAt   time.Time `json:"retired_at,omitzero"`
+}
+
+// load reads every key in the directory. Keys listed in the manifest keep
+// their recorded state; key files dropped in by an operator are returned
+// without a status.
+func (s *keystore) load() ([]*Key, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create keystore directory: %w", err)
+	}
+
+	var m manifest
+	raw, err := os.ReadFile(filepath.Join(s.dir, manifestName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read keystore manifest: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("failed to decode keystore manifest: %w", err)
+		}
+	}
+
+	keys := make([]*Key, 0, len(m.Keys))
+	known := make(map[string]bool, len(m.Keys))
+
+	for _, entry := range m.Keys {
+		private, _, err := readKeyFile(filepath.Join(s.dir, entry.File))
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+		}
+		alg, err := algorithmFor(private)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+		}
+		keys = append(keys, &Key{
+			id:          entry.ID,
+			algorithm:   alg,
+			private:     private,
+			file:        entry.File,
+			generated:   entry.Generated,
+			status:      entry.Status,
+			createdAt:   entry.CreatedAt,
+			activatedAt: entry.ActivatedAt,
+			retiredAt:   entry.RetiredAt,
+		})
+		known[entry.File] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keystore directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || known[name] || !isKeyFile(name) {
+			continue
+		}
+		private, kid, err := readKeyFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", name, err)
+		}
+		alg, err := algorithmFor(private)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", name, err)
+		}
+		if kid == "" {
+			kid = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", name, err)
+		}
+		keys = append(keys, &Key{
+			id:        kid,
+			algorithm: alg,
+			private:   private,
+			file:      name,
+			createdAt: info.ModTime(),
+		})
+	}
+
+	return keys, nil
+}
+
+// save writes the manifest for the given keys and removes the files of the
+// removed ones, which are always keys the manager generated.
+func (s *keystore) save(keys []*Key, removed []*Key) error {
+	m := manifest{Keys: make([]manifestEntry, 0, len(keys))}
+	for _, key := range keys {
+		if key.file == "" {
+			key.file = key.id + ".pem"
+			if err := writeKeyFile(filepath.Join(s.dir, key.file), key.private); err != nil {
+				return fmt.Errorf("key %s: %w", key.id, err)
+			}
+		}
+		m.Keys = append(m.Keys, manifestEntry{
+			ID:          key.id,
+			File:        key.file,
+			Generated:   key.generated,
+			Status:      key.status,
+			CreatedAt:   key.createdAt,
+			ActivatedAt: key.activatedAt,
+			RetiredAt:   key.retiredAt,
+		})
+	}
+
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keystore manifest: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(s.dir, manifestName), raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write keystore manifest: %w", err)
+	}
+
+	for _, key := range removed {
+		if key.file == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, key.file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove key file %s: %w", key.file, err)
+		}
+	}
+
+	return nil
+}
+
+func isKeyFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pem", ".key", ".jwk":
+		return true
+	default:
+		return false
+	}
+}
+
+// readKeyFile parses a PEM (PKCS#8, PKCS#1 or SEC 1) or JWK private key.
+// For JWK files the embedded "kid" is returned as well.
+func readKeyFile(path string) (crypto.Signer, string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".jwk") {
+		var jwk jose.JSONWebKey
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, "", fmt.Errorf("failed to decode jwk: %w", err)
+		}
+		if jwk.IsPublic() {
+			return nil, "", fmt.Errorf("jwk does not contain a private key")
+		}
+		signer, ok := jwk.Key.(crypto.Signer)
+		if !ok {
+			return nil, "", fmt.Errorf("unsupported jwk key type %T", jwk.Key)
+		}
+		return signer, jwk.KeyID, nil
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, "", fmt.Errorf("no pem block found")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, "", fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return signer, "", nil
+}
+
+func writeKeyFile(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	raw := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return atomicfile.WriteFile(path, raw, 0o600)
+}
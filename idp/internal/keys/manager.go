@@ -0,0 +1,392 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+)
+
+// Manager owns the signing keys of the provider. It publishes the current,
+// next and recently retired keys and rotates them on a fixed schedule.
+type Manager struct {
+	mu        sync.RWMutex
+	store     keystore
+	cfg       config.KeysConfig
+	algorithm jose.SignatureAlgorithm
+	keys      []*Key
+	logger    *slog.Logger
+}
+
+func NewManager(cfg config.KeysConfig, logger *slog.Logger) (*Manager, error) {
+	alg, err := ParseAlgorithm(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RotationInterval < 0 || cfg.RotationOverlap < 0 {
+		return nil, fmt.Errorf("key rotation interval and overlap must not be negative")
+	}
+	if cfg.CurrentKeyID != "" && cfg.CurrentKeyID == cfg.NextKeyID {
+		return nil, fmt.Errorf("current and next signing key ids must differ")
+	}
+
+	m := &Manager{
+		store:     keystore{dir: cfg.Dir},
+		cfg:       cfg,
+		algorithm: alg,
+		logger:    logger.With("component", "keys"),
+	}
+
+	if err := m.load(time.Now()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manager) load(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	loaded, err := m.store.load()
+	if err != nil {
+		return err
+	}
+	m.keys = loaded
+
+	if err := m.assignCurrent(now); err != nil {
+		return err
+	}
+	if err := m.assignNext(now); err != nil {
+		return err
+	}
+
+	// keys that were dropped into the keystore without being selected stay
+	// verifiable for one overlap window
+	for _, key := range m.keys {
+		if key.status == "" {
+			key.status = StatusRetired
+			key.retiredAt = now
+		}
+	}
+
+	return m.persist(now)
+}
+
+func (m *Manager) assignCurrent(now time.Time) error {
+	current := m.find(func(k *Key) bool { return k.status == StatusCurrent })
+
+	if id := m.cfg.CurrentKeyID; id != "" && (current == nil || current.id != id) {
+		pinned := m.find(func(k *Key) bool { return k.id == id })
+		switch {
+		case pinned != nil && (pinned.status == StatusRetired || pinned.status == StatusExpired):
+			m.logger.Warn("configured signing key is retired, keeping current key", "kid", id)
+		case pinned != nil:
+			m.activate(pinned, current, now)
+			return nil
+		case current == nil:
+			key, err := m.generate(id, now)
+			if err != nil {
+				return err
+			}
+			m.activate(key, nil, now)
+			return nil
+		}
+	}
+
+	if current != nil {
+		if current.activatedAt.IsZero() {
+			current.activatedAt = now
+		}
+		return nil
+	}
+
+	if next := m.find(func(k *Key) bool { return k.status == StatusNext }); next != nil {
+		m.activate(next, nil, now)
+		return nil
+	}
+
+	var unassigned []*Key
+	for _, key := range m.keys {
+		if key.status == "" {
+			unassigned = append(unassigned, key)
+		}
+	}
+	switch len(unassigned) {
+	case 0:
+		key, err := m.generate("", now)
+		if err != nil {
+			return err
+		}
+		m.activate(key, nil, now)
+	case 1:
+		m.activate(unassigned[0], nil, now)
+	default:
+		return fmt.Errorf("keystore contains %d unassigned keys, set IDP_SIGNING_KEY_ID to choose the current one", len(unassigned))
+	}
+	return nil
+}
+
+func (m *Manager) assignNext(now time.Time) error {
+	next := m.find(func(k *Key) bool { return k.status == StatusNext })
+
+	if id := m.cfg.NextKeyID; id != "" && (next == nil || next.id != id) {
+		pinned := m.find(func(k *Key) bool { return k.id == id })
+		switch {
+		case pinned != nil && pinned.status == "":
+			if next != nil {
+				next.status = ""
+			}
+			pinned.status = StatusNext
+			return nil
+		case pinned == nil && next == nil:
+			_, err := m.generateNext(id, now)
+			return err
+		}
+	}
+
+	if next == nil && m.cfg.RotationInterval > 0 {
+		_, err := m.generateNext("", now)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) activate(key, previous *Key, now time.Time) {
+	if previous != nil {
+		previous.status = StatusRetired
+		previous.retiredAt = now
+	}
+	key.status = StatusCurrent
+	key.activatedAt = now
+	key.retiredAt = time.Time{}
+	m.logger.Info("signing key activated", "kid", key.id, "alg", key.algorithm)
+}
+
+func (m *Manager) generate(id string, now time.Time) (*Key, error) {
+	private, err := generatePrivateKey(m.algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	if id == "" {
+		id, err = thumbprintID(private)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.find(func(k *Key) bool { return k.id == id }) != nil {
+		return nil, fmt.Errorf("signing key id %q already exists", id)
+	}
+
+	key := &Key{
+		id:        id,
+		algorithm: m.algorithm,
+		private:   private,
+		generated: true,
+		createdAt: now,
+	}
+	m.keys = append(m.keys, key)
+	m.logger.Info("signing key generated", "kid", key.id, "alg", key.algorithm)
+	return key, nil
+}
+
+func (m *Manager) generateNext(id string, now time.Time) (*Key, error) {
+	key, err := m.generate(id, now)
+	if err != nil {
+		return nil, err
+	}
+	key.status = StatusNext
+	return key, nil
+}
+
+func (m *Manager) find(match func(*Key) bool) *Key {
+	for _, key := range m.keys {
+		if match(key) {
+			return key
+		}
+	}
+	return nil
+}
+
+// persist drops retired keys whose overlap window has passed and writes the
+// keystore. Keys the operator supplied are only marked expired, so that
+// their files are never deleted and they are not picked up again.
+func (m *Manager) persist(now time.Time) error {
+	var removed []*Key
+	m.keys = slices.DeleteFunc(m.keys, func(k *Key) bool {
+		if k.status != StatusRetired || now.Before(k.retiredAt.Add(m.cfg.RotationOverlap)) {
+			return false
+		}
+		if !k.generated {
+			k.status = StatusExpired
+			m.logger.Info("signing key expired, keeping its file", "kid", k.id, "file", k.file)
+			return false
+		}
+		removed = append(removed, k)
+		m.logger.Info("signing key removed", "kid", k.id)
+		return true
+	})
+	return m.store.save(m.keys, removed)
+}
+
+// Rotate retires the current key, promotes the next key and generates a new
+// next key.
+func (m *Manager) Rotate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rotate(time.Now())
+}
+
+func (m *Manager) rotate(now time.Time) error {
+	current := m.find(func(k *Key) bool { return k.status == StatusCurrent })
+	next := m.find(func(k *Key) bool { return k.status == StatusNext })
+
+	if next == nil {
+		var err error
+		next, err = m.generate("", now)
+		if err != nil {
+			return err
+		}
+	}
+	m.activate(next, current, now)
+
+	if _, err := m.generateNext("", now); err != nil {
+		return err
+	}
+	return m.persist(now)
+}
+
+// Run rotates keys and prunes retired keys until the context is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := m.untilNextEvent(time.Now())
+		if wait < 0 {
+			<-ctx.Done()
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := m.tick(time.Now()); err != nil {
+			m.logger.Error("key rotation failed", "error", err)
+			// avoid a hot loop when the keystore is not writable
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}
+}
+
+func (m *Manager) tick(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if due, ok := m.rotationDue(); ok && !now.Before(due) {
+		return m.rotate(now)
+	}
+	return m.persist(now)
+}
+
+func (m *Manager) rotationDue() (time.Time, bool) {
+	if m.cfg.RotationInterval <= 0 {
+		return time.Time{}, false
+	}
+	current := m.find(func(k *Key) bool { return k.status == StatusCurrent })
+	if current == nil {
+		return time.Time{}, false
+	}
+	return current.activatedAt.Add(m.cfg.RotationInterval), true
+}
+
+// untilNextEvent returns how long to wait for the next rotation or expiry of
+// a retired key, or a negative duration if nothing is scheduled.
+func (m *Manager) untilNextEvent(now time.Time) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var next time.Time
+	if due, ok := m.rotationDue(); ok {
+		next = due
+	}
+	for _, key := range m.keys {
+		if key.status != StatusRetired {
+			continue
+		}
+		expiry := key.retiredAt.Add(m.cfg.RotationOverlap)
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+
+	if next.IsZero() {
+		return -1
+	}
+	return max(next.Sub(now), 0)
+}
+
+// SigningKey implements the signing part of op.Storage.
+func (m *Manager) SigningKey(context.Context) (op.SigningKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	current := m.find(func(k *Key) bool { return k.status == StatusCurrent })
+	if current == nil {
+		return nil, errors.New("no current signing key")
+	}
+	return current, nil
+}
+
+// SignatureAlgorithms implements the signing part of op.Storage.
+func (m *Manager) SignatureAlgorithms(context.Context) ([]jose.SignatureAlgorithm, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	algs := make([]jose.SignatureAlgorithm, 0, 1)
+	for _, key := range m.published() {
+		if !slices.Contains(algs, key.algorithm) {
+			algs = append(algs, key.algorithm)
+		}
+	}
+	return algs, nil
+}
+
+// KeySet implements the signing part of op.Storage.
+func (m *Manager) KeySet(context.Context) ([]op.Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	published := m.published()
+	keySet := make([]op.Key, 0, len(published))
+	for _, key := range published {
+		keySet = append(keySet, key.public())
+	}
+	return keySet, nil
+}
+
+// published returns current, next and retired keys in that order.
+func (m *Manager) published() []*Key {
+	published := make([]*Key, 0, len(m.keys))
+	for _, status := range []Status{StatusCurrent, StatusNext, StatusRetired} {
+		for _, key := range m.keys {
+			if key.status == status {
+				published = append(published, key)
+			}
+		}
+	}
+	return published
+}
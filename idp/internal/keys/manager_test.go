@@ -0,0 +1,99 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"idp/internal/config"
+)
+
+func newTestManager(t *testing.T, dir string, overlap time.Duration) *Manager {
+	t.Helper()
+	m, err := NewManager(config.KeysConfig{
+		Dir:             dir,
+		Algorithm:       "ES256",
+		CurrentKeyID:    "current",
+		RotationOverlap: overlap,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	return m
+}
+
+func writeOperatorKey(t *testing.T, dir, name string) {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(filepath.Join(dir, name), private); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistKeepsOperatorKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeOperatorKey(t, dir, "operator.pem")
+
+	m := newTestManager(t, dir, 0)
+	if _, err := os.Stat(filepath.Join(dir, "operator.pem")); err != nil {
+		t.Fatalf("operator key file was removed: %v", err)
+	}
+	operator := m.find(func(k *Key) bool { return k.id == "operator" })
+	if operator == nil || operator.status != StatusExpired {
+		t.Fatalf("operator key = %+v, want it kept as expired", operator)
+	}
+	for _, key := range m.published() {
+		if key.id == "operator" {
+			t.Fatal("expired operator key is still published")
+		}
+	}
+
+	// an expired key stays expired instead of being picked up again
+	m = newTestManager(t, dir, 0)
+	if operator := m.find(func(k *Key) bool { return k.id == "operator" }); operator == nil || operator.status != StatusExpired {
+		t.Fatalf("operator key after reload = %+v, want expired", operator)
+	}
+}
+
+func TestPersistRemovesGeneratedKeys(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestManager(t, dir, time.Hour)
+
+	now := time.Now()
+	if err := m.rotate(now); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	retired := m.find(func(k *Key) bool { return k.id == "current" })
+	if retired == nil || retired.status != StatusRetired {
+		t.Fatalf("rotated key = %+v, want retired", retired)
+	}
+
+	if err := m.persist(now.Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "current.pem")); err != nil {
+		t.Fatalf("retired key removed within the overlap: %v", err)
+	}
+
+	if err := m.persist(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if m.find(func(k *Key) bool { return k.id == "current" }) != nil {
+		t.Fatal("generated key kept after the overlap")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "current.pem")); !os.IsNotExist(err) {
+		t.Fatalf("generated key file not removed: %v", err)
+	}
+}
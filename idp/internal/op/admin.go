@@ -0,0 +1,213 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/data"
+	"idp/internal/storage"
+)
+
+const pathAdmin = "/admin"
+
+type adminUserKey struct{}
+
+// Admin serves the administration API. Callers present an access token that
+// was issued to a user with is_admin.
+type Admin struct {
+	router   chi.Router
+	storage  *storage.Storage
+	provider op.OpenIDProvider
+}
+
+func NewAdmin(storage *storage.Storage, provider op.OpenIDProvider) *Admin {
+	a := &Admin{
+		storage:  storage,
+		provider: provider,
+	}
+	a.router = a.newRouter()
+	return a
+}
+
+func (a *Admin) newRouter() chi.Router {
+	router := chi.NewRouter()
+	router.Use(a.authenticate)
+	router.Get("/lockouts", a.lockoutsHandler)
+	router.Delete("/lockouts", a.unlockHandler)
+	router.Get("/grants", a.grantsHandler)
+	router.Delete("/grants", a.revokeGrantHandler)
+	return router
+}
+
+func (a *Admin) Router() chi.Router {
+	return a.router
+}
+
+// authenticate lets only admins through, with 401 for a missing or invalid
+// token and 403 for a token of anyone else.
+func (a *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, oidc.BearerToken) || token == "" {
+			w.Header().Set("WWW-Authenticate", oidc.BearerToken)
+			writeJSONError(w, http.StatusUnauthorized, "access token is required")
+			return
+		}
+
+		user, err := a.userFromToken(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", oidc.BearerToken+` error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "access token is invalid or has expired")
+			return
+		}
+		if user == nil || !user.IsAdmin {
+			w.Header().Set("WWW-Authenticate", oidc.BearerToken+` error="insufficient_scope"`)
+			writeJSONError(w, http.StatusForbidden, "administrator access is required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user)))
+	})
+}
+
+// userFromToken accepts both opaque and JWT access tokens, as the userinfo
+// endpoint does.
+func (a *Admin) userFromToken(ctx context.Context, token string) (*data.User, error) {
+	if plain, err := a.provider.Crypto().Decrypt(token); err == nil {
+		tokenID, _, ok := strings.Cut(plain, ":")
+		if !ok {
+			return nil, errors.New("token is malformed")
+		}
+		return a.storage.UserFromToken(ctx, tokenID)
+	}
+	claims, err := op.VerifyAccessToken[*oidc.AccessTokenClaims](ctx, token, a.provider.AccessTokenVerifier(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return a.storage.UserFromToken(ctx, claims.JWTID)
+}
+
+type lockout struct {
+	Key         string     `json:"key"`
+	Failures    uint32     `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	RetryAfter  int        `json:"retry_after"`
+}
+
+// lockoutsHandler lists the usernames ("user:") and client addresses ("ip:")
+// with recent failed sign-ins, and the addresses with wrong device user codes
+// ("code:"), whether they are locked and how many seconds remain until they
+// may try again.
+func (a *Admin) lockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := a.storage.LoginFailureEntries(r.Context())
+	if err != nil {
+		slog.Error("failed to list lockouts", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list lockouts")
+		return
+	}
+
+	now := time.Now()
+	lockouts := make([]lockout, 0, len(entries))
+	for _, entry := range entries {
+		l := lockout{
+			Key:         entry.Key,
+			Failures:    entry.Failures,
+			LastFailure: entry.LastFailure,
+		}
+		if entry.LockedUntil.After(now) {
+			l.Locked, l.LockedUntil = true, &entry.LockedUntil
+		}
+		if wait := entry.NextAttempt.Sub(now); wait > 0 {
+			l.RetryAfter = retryAfterSeconds(wait)
+		}
+		lockouts = append(lockouts, l)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Lockouts []lockout `json:"lockouts"`
+	}{
+		Lockouts: lockouts,
+	})
+}
+
+// unlockHandler forgets the failures of the key given as query parameter.
+func (a *Admin) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+
+	err := a.storage.ResetLoginFailures(r.Context(), key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeJSONError(w, http.StatusNotFound, "no failures recorded for key")
+		return
+	case err != nil:
+		slog.Error("failed to unlock login", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to unlock")
+		return
+	}
+
+	admin := r.Context().Value(adminUserKey{}).(*data.User)
+	slog.Info("login unlocked", "key", key, "admin", admin.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grantsHandler lists the consent grants of the user given as query
+// parameter.
+func (a *Admin) grantsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+
+	grants, err := a.storage.Grants(r.Context(), userID)
+	if err != nil {
+		slog.Error("failed to list grants", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list grants")
+		return
+	}
+	if grants == nil {
+		grants = []storage.Grant{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Grants []storage.Grant `json:"grants"`
+	}{
+		Grants: grants,
+	})
+}
+
+// revokeGrantHandler revokes the user's grant for a client together with the
+// tokens issued under it.
+func (a *Admin) revokeGrantHandler(w http.ResponseWriter, r *http.Request) {
+	userID, clientID := r.URL.Query().Get("user"), r.URL.Query().Get("client")
+	if userID == "" || clientID == "" {
+		writeJSONError(w, http.StatusBadRequest, "user and client are required")
+		return
+	}
+
+	err := a.storage.RevokeGrant(r.Context(), userID, clientID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeJSONError(w, http.StatusNotFound, "grant not found")
+		return
+	case err != nil:
+		slog.Error("failed to revoke grant", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke grant")
+		return
+	}
+
+	admin := r.Context().Value(adminUserKey{}).(*data.User)
+	slog.Info("grant revoked", "user", userID, "client", clientID, "admin", admin.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/storage"
+)
+
+// clientAssertionMaxLifetime bounds how far in the future a client assertion
+// may expire, and so how long its jti is remembered.
+const clientAssertionMaxLifetime = time.Hour
+
+// authenticatedSecret stands in for the secret when a request authenticated
+// with a client assertion or certificate is handed to the provider as
+// client_secret_basic; the storage accepts the client because of the
+// context, not the secret.
+const authenticatedSecret = "authenticated"
+
+var secretAlgorithms = []jose.SignatureAlgorithm{jose.HS256, jose.HS384, jose.HS512}
+
+type assertionClient interface {
+	VerifiedAuthMethod() oidc.AuthMethod
+	Secret() string
+}
+
+// clientAssertions implements the private_key_jwt and client_secret_jwt
+// client authentication methods (RFC 7523) at the endpoints where clients
+// authenticate. The provider only knows private_key_jwt, at some endpoints
+// and without replay protection, so the assertion is verified here and the
+// request continues as if the client had used client_secret_basic.
+type clientAssertions struct {
+	storage *storage.Storage
+	cfg     config.ProviderConfig
+	issuer  string
+	paths   []string
+}
+
+func newClientAssertions(storage *storage.Storage, cfg config.ProviderConfig, issuer string, provider op.OpenIDProvider) *clientAssertions {
+	return &clientAssertions{
+		storage: storage,
+		cfg:     cfg,
+		issuer:  strings.TrimSuffix(issuer, "/"),
+		paths: []string{
+			provider.TokenEndpoint().Relative(),
+			provider.IntrospectionEndpoint().Relative(),
+			provider.RevocationEndpoint().Relative(),
+			provider.DeviceAuthorizationEndpoint().Relative(),
+			pathPAR,
+		},
+	}
+}
+
+func (c *clientAssertions) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !slices.Contains(c.paths, r.URL.Path) || r.ParseForm() != nil || !r.PostForm.Has("client_assertion") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.PostForm.Get("client_assertion_type") != oidc.ClientAssertionTypeJWTAssertion {
+			writeClientError(w, oidc.ErrInvalidClient().WithDescription("client_assertion_type must be %s", oidc.ClientAssertionTypeJWTAssertion))
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok || r.PostForm.Has("client_secret") {
+			writeClientError(w, oidc.ErrInvalidClient().WithDescription("only one client authentication method may be used"))
+			return
+		}
+		clientID, err := c.verify(r.Context(), r.PostForm.Get("client_assertion"), c.issuer+r.URL.Path)
+		if err != nil {
+			writeClientError(w, err)
+			return
+		}
+		if id := r.PostForm.Get("client_id"); id != "" && id != clientID {
+			writeClientError(w, oidc.ErrInvalidClient().WithDescription("client_id does not match the client_assertion"))
+			return
+		}
+
+		next.ServeHTTP(w, asAuthenticatedClient(r, clientID))
+	})
+}
+
+// asAuthenticatedClient returns r without its client credentials, as a
+// request from the client with client_secret_basic that the storage accepts.
+func asAuthenticatedClient(r *http.Request, clientID string) *http.Request {
+	authenticated := r.Clone(storage.WithAuthenticatedClient(r.Context(), clientID))
+	for _, form := range []url.Values{authenticated.Form, authenticated.PostForm} {
+		form.Del("client_assertion")
+		form.Del("client_assertion_type")
+		form.Del("client_id")
+	}
+	authenticated.Body = http.NoBody
+	authenticated.SetBasicAuth(url.QueryEscape(clientID), authenticatedSecret)
+	return authenticated
+}
+
+// verify returns the client that signed the assertion after checking the
+// signature with the key its authentication method calls for, the iss, sub,
+// aud and exp claims and that the jti was not used before. The audience is
+// the issuer or the endpoint the assertion was sent to.
+func (c *clientAssertions) verify(ctx context.Context, assertion, endpoint string) (string, *oidc.Error) {
+	token, err := jwt.ParseSigned(assertion, slices.Concat(requestObjectAlgorithms, secretAlgorithms))
+	if err != nil {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion must be a signed JWT")
+	}
+	var unverified jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil || unverified.Issuer == "" {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion must have an iss claim")
+	}
+	clientID := unverified.Issuer
+
+	client, err := c.storage.GetClientByClientID(ctx, clientID)
+	if err != nil {
+		return "", oidc.ErrInvalidClient().WithDescription("unknown client %s", clientID)
+	}
+	asserting, ok := client.(assertionClient)
+	var method oidc.AuthMethod
+	if ok {
+		method = asserting.VerifiedAuthMethod()
+	}
+	if method != oidc.AuthMethodPrivateKeyJWT && method != data.AuthMethodClientSecretJWT {
+		return "", oidc.ErrInvalidClient().WithDescription("client %s does not authenticate with a client assertion", clientID)
+	}
+	if !c.cfg.AuthMethodEnabled(method) {
+		return "", oidc.ErrInvalidClient().WithDescription("%s is not supported", method)
+	}
+
+	alg := jose.SignatureAlgorithm(token.Headers[0].Algorithm)
+	var key any
+	switch method {
+	case oidc.AuthMethodPrivateKeyJWT:
+		if !slices.Contains(requestObjectAlgorithms, alg) {
+			return "", oidc.ErrInvalidClient().WithDescription("private_key_jwt must be signed with one of %s", joinAlgorithms(requestObjectAlgorithms))
+		}
+		jwk, err := c.storage.GetKeyByIDAndClientID(ctx, token.Headers[0].KeyID, clientID)
+		if err != nil {
+			return "", oidc.ErrInvalidClient().WithDescription("no key to verify the client_assertion: %v", err)
+		}
+		if jwk.Algorithm != "" && jwk.Algorithm != string(alg) {
+			return "", oidc.ErrInvalidClient().WithDescription("client_assertion is signed with %s, but key %q is for %s", alg, jwk.KeyID, jwk.Algorithm)
+		}
+		key = jwk
+	case data.AuthMethodClientSecretJWT:
+		if !slices.Contains(secretAlgorithms, alg) {
+			return "", oidc.ErrInvalidClient().WithDescription("client_secret_jwt must be signed with one of %s", joinAlgorithms(secretAlgorithms))
+		}
+		key = []byte(asserting.Secret())
+	}
+
+	var claims jwt.Claims
+	if err := token.Claims(key, &claims); err != nil {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion signature is invalid")
+	}
+	if claims.Subject != clientID {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion sub must be the client_id %s", clientID)
+	}
+	if !claims.Audience.Contains(c.issuer) && !claims.Audience.Contains(c.issuer+"/") && !claims.Audience.Contains(endpoint) {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion aud must contain %s or %s", c.issuer, endpoint)
+	}
+	if claims.Expiry == nil {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion must have an exp claim")
+	}
+	if claims.Expiry.Time().After(time.Now().Add(clientAssertionMaxLifetime)) {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion must expire within %s", clientAssertionMaxLifetime)
+	}
+	switch err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, jwt.DefaultLeeway); {
+	case errors.Is(err, jwt.ErrExpired):
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion has expired")
+	case err != nil:
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion is invalid: %v", err)
+	}
+	if claims.ID == "" {
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion must have a jti claim")
+	}
+
+	switch err := c.storage.UseClientAssertion(ctx, clientID, claims.ID, claims.Expiry.Time().Add(jwt.DefaultLeeway)); {
+	case errors.Is(err, storage.ErrClientAssertionReplayed):
+		return "", oidc.ErrInvalidClient().WithDescription("client_assertion was already used")
+	case err != nil:
+		return "", oidc.ErrServerError().WithParent(err)
+	}
+	return clientID, nil
+}
@@ -0,0 +1,130 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+
+	"idp/internal/storage"
+)
+
+const (
+	logoutTokenLifetime = 2 * time.Minute
+	backchannelAttempts = 4
+	backchannelBackoff  = time.Second
+	backchannelTimeout  = 5 * time.Second
+)
+
+type backchannelClient interface {
+	BackchannelLogoutURI() string
+	BackchannelLogoutSessionRequired() bool
+}
+
+// backchannelLogout tells relying parties that a session they took part in
+// has ended, following OpenID Connect Back-Channel Logout 1.0.
+type backchannelLogout struct {
+	storage *storage.Storage
+	issuer  string
+	client  *http.Client
+	backoff time.Duration
+	logger  *slog.Logger
+}
+
+func newBackchannelLogout(storage *storage.Storage, issuer string, logger *slog.Logger) *backchannelLogout {
+	return &backchannelLogout{
+		storage: storage,
+		issuer:  issuer,
+		client:  &http.Client{Timeout: backchannelTimeout},
+		backoff: backchannelBackoff,
+		logger:  logger.With("component", "backchannel_logout"),
+	}
+}
+
+// notify sends a logout token to every client of the session that has a
+// back-channel logout URI. Deliveries continue in the background.
+func (b *backchannelLogout) notify(session *storage.Session) {
+	ctx := context.Background()
+	for _, clientID := range session.Clients {
+		client, err := b.storage.GetClientByClientID(ctx, clientID)
+		if err != nil {
+			continue
+		}
+		receiver, ok := client.(backchannelClient)
+		if !ok || receiver.BackchannelLogoutURI() == "" {
+			continue
+		}
+
+		token, err := b.logoutToken(ctx, clientID, session, receiver.BackchannelLogoutSessionRequired())
+		if err != nil {
+			b.logger.Error("failed to create logout token", "client_id", clientID, "error", err)
+			continue
+		}
+		go b.deliver(clientID, receiver.BackchannelLogoutURI(), token)
+	}
+}
+
+// logoutToken always carries sub and adds sid for clients that registered
+// backchannel_logout_session_required.
+func (b *backchannelLogout) logoutToken(ctx context.Context, clientID string, session *storage.Session, sessionRequired bool) (string, error) {
+	var sid string
+	if sessionRequired {
+		sid = session.ID
+	}
+	claims := oidc.NewLogoutTokenClaims(
+		b.issuer,
+		session.UserID,
+		oidc.Audience{clientID},
+		time.Now().Add(logoutTokenLifetime),
+		uuid.NewString(),
+		sid,
+		0,
+	)
+	return signJWT(ctx, b.storage, "logout+jwt", claims)
+}
+
+// deliver posts the logout token, retrying with exponential backoff while
+// the receiver is unreachable or fails with a server error.
+func (b *backchannelLogout) deliver(clientID, uri, token string) {
+	logger := b.logger.With("client_id", clientID, "uri", uri)
+	body := url.Values{"logout_token": {token}}.Encode()
+
+	delay := b.backoff
+	for attempt := 1; ; attempt++ {
+		status, err := b.post(uri, body)
+		switch {
+		case err == nil && status < 300:
+			logger.Info("back-channel logout delivered", "status", status, "attempt", attempt)
+			return
+		case err == nil && status < 500:
+			logger.Warn("back-channel logout rejected", "status", status, "attempt", attempt)
+			return
+		case attempt == backchannelAttempts:
+			logger.Error("back-channel logout failed", "status", status, "attempt", attempt, "error", err)
+			return
+		}
+		logger.Warn("back-channel logout attempt failed, retrying", "status", status, "attempt", attempt, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (b *backchannelLogout) post(uri, body string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, uri, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send logout token: %w", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,234 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/keys"
+	"idp/internal/storage"
+)
+
+const (
+	testIssuer             = "https://idp.example"
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+)
+
+type logoutDelivery struct {
+	path  string
+	token string
+}
+
+// newBackchannelTest returns a backchannel logout whose clients post to
+// receiver: rp at /logout, rp-sid with backchannel_logout_session_required
+// at /logout-sid, and no-logout without a URI.
+func newBackchannelTest(t *testing.T, receiver string) (*backchannelLogout, *storage.Storage) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager, err := keys.NewManager(config.KeysConfig{
+		Dir:          t.TempDir(),
+		Algorithm:    "ES256",
+		CurrentKeyID: "current",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := fmt.Sprintf(`[
+  {"id": "rp", "type": "web", "secret": "rp-secret", "redirect_uris": ["https://rp.example/callback"],
+   "backchannel_logout_uri": "%[1]s/logout"},
+  {"id": "rp-sid", "type": "web", "secret": "rp-secret", "redirect_uris": ["https://rp.example/callback"],
+   "backchannel_logout_uri": "%[1]s/logout-sid", "backchannel_logout_session_required": true},
+  {"id": "no-logout", "type": "web", "secret": "rp-secret", "redirect_uris": ["https://rp.example/callback"]}
+]`, receiver)
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte(clients), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := data.LoadClients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// logout tokens never look at users
+	s := storage.New(storage.NewMemoryBackend(), loaded, nil, manager, config.Default().Provider.Lifetimes, logger)
+	b := newBackchannelLogout(s, testIssuer, logger)
+	b.backoff = 10 * time.Millisecond
+	return b, s
+}
+
+// verifyLogoutToken checks the signature of the token against the keys the
+// provider publishes and returns its claims.
+func verifyLogoutToken(t *testing.T, s *storage.Storage, token string) map[string]any {
+	t.Helper()
+	published, err := s.KeySet(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks jose.JSONWebKeySet
+	for _, key := range published {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: key.Key(), KeyID: key.ID(), Algorithm: string(key.Algorithm()), Use: key.Use()})
+	}
+
+	signed, err := jose.ParseSigned(token, []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		t.Fatalf("logout token: %v", err)
+	}
+	header := signed.Signatures[0].Header
+	if typ := header.ExtraHeaders[jose.HeaderType]; typ != "logout+jwt" {
+		t.Errorf("typ = %v, want logout+jwt", typ)
+	}
+	matching := jwks.Key(header.KeyID)
+	if len(matching) != 1 {
+		t.Fatalf("kid %q is not in the JWKS", header.KeyID)
+	}
+	payload, err := signed.Verify(matching[0].Public())
+	if err != nil {
+		t.Fatalf("logout token signature: %v", err)
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestBackchannelLogoutToken(t *testing.T) {
+	deliveries := make(chan logoutDelivery, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			t.Errorf("logout token sent as %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		deliveries <- logoutDelivery{path: r.URL.Path, token: r.PostFormValue("logout_token")}
+	}))
+	defer receiver.Close()
+	b, s := newBackchannelTest(t, receiver.URL)
+
+	b.notify(&storage.Session{
+		ID:      "session-1",
+		UserID:  "user-1",
+		Clients: []string{"rp", "rp-sid", "no-logout", "unknown"},
+	})
+
+	tokens := make(map[string]string)
+	for len(tokens) < 2 {
+		select {
+		case delivery := <-deliveries:
+			tokens[delivery.path] = delivery.token
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received logout tokens for %v, want /logout and /logout-sid", tokens)
+		}
+	}
+
+	for path, audience := range map[string]string{"/logout": "rp", "/logout-sid": "rp-sid"} {
+		claims := verifyLogoutToken(t, s, tokens[path])
+		if claims["iss"] != testIssuer || claims["sub"] != "user-1" {
+			t.Errorf("%s: iss %v, sub %v, want %s and user-1", path, claims["iss"], claims["sub"], testIssuer)
+		}
+		var aud oidc.Audience
+		raw, _ := json.Marshal(claims["aud"])
+		if err := json.Unmarshal(raw, &aud); err != nil || len(aud) != 1 || aud[0] != audience {
+			t.Errorf("%s: aud = %v, want [%s]", path, claims["aud"], audience)
+		}
+		if jti, _ := claims["jti"].(string); jti == "" {
+			t.Errorf("%s: jti is missing", path)
+		}
+		iat, _ := claims["iat"].(float64)
+		exp, _ := claims["exp"].(float64)
+		if exp-iat != logoutTokenLifetime.Seconds() {
+			t.Errorf("%s: token lives %vs, want %v", path, exp-iat, logoutTokenLifetime)
+		}
+
+		// OpenID Connect Back-Channel Logout 1.0, 2.4
+		events, _ := claims["events"].(map[string]any)
+		if event, ok := events[backchannelLogoutEvent].(map[string]any); len(events) != 1 || !ok || len(event) != 0 {
+			t.Errorf("%s: events = %v, want only %s with an empty object", path, claims["events"], backchannelLogoutEvent)
+		}
+		if _, ok := claims["nonce"]; ok {
+			t.Errorf("%s: logout token carries a nonce", path)
+		}
+	}
+
+	if sid, ok := verifyLogoutToken(t, s, tokens["/logout-sid"])["sid"]; sid != "session-1" {
+		t.Errorf("sid = %v (present %t), want session-1 for a client that requires it", sid, ok)
+	}
+	if sid, ok := verifyLogoutToken(t, s, tokens["/logout"])["sid"]; ok {
+		t.Errorf("sid = %v, want none for a client that does not require it", sid)
+	}
+}
+
+func TestBackchannelLogoutRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"delivered at once", []int{http.StatusOK}, 1},
+		{"server errors are retried", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusNoContent}, 3},
+		{"client errors are not retried", []int{http.StatusBadRequest}, 1},
+		{"gives up", slices.Repeat([]int{http.StatusInternalServerError}, backchannelAttempts+1), backchannelAttempts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				attempts []time.Time
+			)
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.PostFormValue("logout_token") != "token" {
+					t.Errorf("logout_token = %q", r.PostFormValue("logout_token"))
+				}
+				w.WriteHeader(test.statuses[len(attempts)])
+				attempts = append(attempts, time.Now())
+			}))
+			defer receiver.Close()
+			b, _ := newBackchannelTest(t, receiver.URL)
+
+			b.deliver("rp", receiver.URL+"/logout", "token")
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(attempts) != test.attempts {
+				t.Fatalf("receiver got %d attempts, want %d", len(attempts), test.attempts)
+			}
+			// the delay doubles after every failed attempt
+			delay := b.backoff
+			for i := 1; i < len(attempts); i++ {
+				if gap := attempts[i].Sub(attempts[i-1]); gap < delay {
+					t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, gap, delay)
+				}
+				delay *= 2
+			}
+		})
+	}
+}
+
+func TestBackchannelLogoutUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	uri := receiver.URL + "/logout"
+	receiver.Close()
+	b, _ := newBackchannelTest(t, receiver.URL)
+
+	start := time.Now()
+	b.deliver("rp", uri, "token")
+	// 10ms, 20ms and 40ms between the four attempts
+	if elapsed, want := time.Since(start), 7*b.backoff; elapsed < want {
+		t.Fatalf("gave up after %v, want at least %v of backoff", elapsed, want)
+	}
+}
@@ -0,0 +1,144 @@
+package op
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/storage"
+)
+
+const pathConsent = "/login/consent"
+
+type consentScope struct {
+	Name        string
+	Description string
+	Claims      []string
+}
+
+// knownScopes describes the scopes whose claims are filled in by
+// storage.setUserinfo.
+var knownScopes = map[string]consentScope{
+	oidc.ScopeOpenID: {
+		Description: "ユーザー ID",
+		Claims:      []string{"sub"},
+	},
+	oidc.ScopeProfile: {
+		Description: "プロフィール",
+		Claims:      []string{"name", "given_name", "family_name", "preferred_username", "locale"},
+	},
+	oidc.ScopeEmail: {
+		Description: "メールアドレス",
+		Claims:      []string{"email", "email_verified"},
+	},
+	oidc.ScopePhone: {
+		Description: "電話番号",
+		Claims:      []string{"phone_number", "phone_number_verified"},
+	},
+	oidc.ScopeOfflineAccess: {
+		Description: "ログアウト後も継続するアクセス",
+	},
+}
+
+func consentURL(id string) string {
+	return pathConsent + "?id=" + url.QueryEscape(id)
+}
+
+func consentScopes(scopes []string) []consentScope {
+	described := make([]consentScope, 0, len(scopes))
+	for _, scope := range scopes {
+		entry, ok := knownScopes[scope]
+		if !ok {
+			entry.Description = scope
+		}
+		entry.Name = scope
+		described = append(described, entry)
+	}
+	return described
+}
+
+func (l *Login) renderConsentPage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	authReq, ok := l.authenticatedRequest(w, r, id)
+	if !ok {
+		return
+	}
+
+	data := struct {
+		ID        string
+		ClientID  string
+		Scopes    []consentScope
+		CSRFToken string
+	}{
+		ID:        id,
+		ClientID:  authReq.GetClientID(),
+		Scopes:    consentScopes(authReq.GetScopes()),
+		CSRFToken: l.csrf.token(w, r, id),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := templates.ExecuteTemplate(w, "consent", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (l *Login) consentHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "cannot parse form", http.StatusBadRequest)
+		return
+	}
+
+	id := r.PostForm.Get("id")
+	authReq, ok := l.authenticatedRequest(w, r, id)
+	if !ok {
+		return
+	}
+	if err := l.csrf.verify(r, id, r.PostForm.Get("csrf_token")); err != nil {
+		slog.Warn("consent rejected", "error", err, "origin", r.Header.Get("Origin"), "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.PostForm.Get("action") {
+	case "allow":
+		if err := l.storage.GrantConsent(r.Context(), id); err != nil {
+			slog.Error("failed to store consent", "error", err)
+			http.Error(w, "failed to store consent", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, l.callback(r.Context(), id), http.StatusSeeOther)
+	case "deny":
+		op.AuthRequestError(w, r, authReq, oidc.ErrAccessDenied().WithDescription("the user denied the request"), l.authorizer)
+		if err := l.storage.DeleteAuthRequest(r.Context(), id); err != nil {
+			slog.Error("failed to delete denied auth request", "error", err)
+		}
+	default:
+		http.Error(w, `action must be one of "allow" or "deny"`, http.StatusBadRequest)
+	}
+}
+
+// authenticatedRequest loads an auth request whose user has signed in and
+// writes an error response otherwise.
+func (l *Login) authenticatedRequest(w http.ResponseWriter, r *http.Request, id string) (*storage.AuthRequest, bool) {
+	if id == "" {
+		http.Error(w, "auth request id is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	authReq, err := l.storage.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "auth request not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	request := authReq.(*storage.AuthRequest)
+	if !request.Authenticated {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return nil, false
+	}
+	return request, true
+}
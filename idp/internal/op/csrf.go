@@ -0,0 +1,111 @@
+package op
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+const csrfCookieName = "idp_login_csrf"
+
+var (
+	errCrossSite        = errors.New("cross-site request")
+	errInvalidCSRFToken = errors.New("invalid csrf token")
+)
+
+// loginCSRF binds the sign-in form to the browser and the auth request it
+// was rendered for. The browser gets a random cookie; the form carries an
+// HMAC of the cookie and the auth request id, which a page on another
+// origin can neither read nor compute.
+type loginCSRF struct {
+	key    []byte
+	path   string
+	secure bool
+}
+
+func newLoginCSRF(cryptoKey [32]byte, issuer string) *loginCSRF {
+	key := sha256.Sum256(append([]byte("idp login csrf\x00"), cryptoKey[:]...))
+	return &loginCSRF{
+		key:    key[:],
+		path:   "/login",
+		secure: strings.HasPrefix(issuer, "https://"),
+	}
+}
+
+// forPath returns the same protection with its cookie sent to the pages
+// under path instead of /login.
+func (c *loginCSRF) forPath(path string) *loginCSRF {
+	scoped := *c
+	scoped.path = path
+	return &scoped
+}
+
+// token returns the form token for the auth request, setting the browser's
+// cookie first if it has none.
+func (c *loginCSRF) token(w http.ResponseWriter, r *http.Request, authRequestID string) string {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		cookie = &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    rand.Text(),
+			Path:     c.path,
+			HttpOnly: true,
+			Secure:   c.secure,
+			SameSite: http.SameSiteLaxMode,
+		}
+		http.SetCookie(w, cookie)
+	}
+	return c.sign(cookie.Value, authRequestID)
+}
+
+// verify checks that the request comes from the issuer's own pages and that
+// token was rendered for this browser and auth request.
+func (c *loginCSRF) verify(r *http.Request, authRequestID, token string) error {
+	if !sameOrigin(r) {
+		return errCrossSite
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" || token == "" {
+		return errInvalidCSRFToken
+	}
+	if !hmac.Equal([]byte(token), []byte(c.sign(cookie.Value, authRequestID))) {
+		return errInvalidCSRFToken
+	}
+	return nil
+}
+
+func (c *loginCSRF) sign(browser, authRequestID string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(browser))
+	mac.Write([]byte{0})
+	mac.Write([]byte(authRequestID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sameOrigin rejects requests that browsers mark as sent from another site
+// through Sec-Fetch-Site, or from another origin than the issuer through
+// Origin. Clients that send neither are left to the token.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	issuer, err := url.Parse(op.IssuerFromContext(r.Context()))
+	if err != nil {
+		return false
+	}
+	return origin == issuer.Scheme+"://"+issuer.Host
+}
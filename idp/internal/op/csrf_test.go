@@ -0,0 +1,135 @@
+package op
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+const csrfTestIssuer = "https://idp.example"
+
+// csrfRequest returns a POST to the login page as the issuer's router sees
+// it, with the given headers set.
+func csrfRequest(headers map[string]string, cookies ...*http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, csrfTestIssuer+"/login/username", nil)
+	r = r.WithContext(op.ContextWithIssuer(r.Context(), csrfTestIssuer))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// mintCSRF renders the login page once and returns the browser's cookie
+// and the form token.
+func mintCSRF(t *testing.T, c *loginCSRF, authRequestID string) (*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	token := c.token(w, httptest.NewRequest(http.MethodGet, csrfTestIssuer+"/login/username", nil), authRequestID)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatalf("cookies = %v, want %s", cookies, csrfCookieName)
+	}
+	return cookies[0], token
+}
+
+func TestLoginCSRFToken(t *testing.T) {
+	c := newLoginCSRF([32]byte{1}, csrfTestIssuer)
+	cookie, token := mintCSRF(t, c, "request-1")
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/login" {
+		t.Errorf("cookie = %+v, want HttpOnly, Secure and SameSite=Lax on /login", cookie)
+	}
+
+	// a browser that has the cookie keeps it
+	w := httptest.NewRecorder()
+	again := c.token(w, csrfRequest(nil, cookie), "request-1")
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("cookie set again: %v", w.Result().Cookies())
+	}
+	if again != token {
+		t.Errorf("token = %s, want %s for the same browser and auth request", again, token)
+	}
+
+	if cookie, _ := mintCSRF(t, newLoginCSRF([32]byte{1}, "http://localhost"), "request-1"); cookie.Secure {
+		t.Error("cookie is Secure for an http issuer")
+	}
+}
+
+func TestLoginCSRFVerify(t *testing.T) {
+	c := newLoginCSRF([32]byte{1}, csrfTestIssuer)
+	cookie, token := mintCSRF(t, c, "request-1")
+	otherCookie, otherToken := mintCSRF(t, c, "request-1")
+
+	tests := []struct {
+		name          string
+		authRequestID string
+		token         string
+		headers       map[string]string
+		cookies       []*http.Cookie
+		want          error
+	}{
+		{"no headers, token only", "request-1", token, nil, []*http.Cookie{cookie}, nil},
+		{"same origin", "request-1", token, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": csrfTestIssuer}, []*http.Cookie{cookie}, nil},
+		{"missing cookie", "request-1", token, nil, nil, errInvalidCSRFToken},
+		{"empty cookie", "request-1", token, nil, []*http.Cookie{{Name: csrfCookieName, Value: ""}}, errInvalidCSRFToken},
+		{"cookie of another browser", "request-1", token, nil, []*http.Cookie{otherCookie}, errInvalidCSRFToken},
+		{"token of another browser", "request-1", otherToken, nil, []*http.Cookie{cookie}, errInvalidCSRFToken},
+		{"missing token", "request-1", "", nil, []*http.Cookie{cookie}, errInvalidCSRFToken},
+		{"token of another auth request", "request-2", token, nil, []*http.Cookie{cookie}, errInvalidCSRFToken},
+		{"cross-site", "request-1", token, map[string]string{"Sec-Fetch-Site": "cross-site"}, []*http.Cookie{cookie}, errCrossSite},
+		{"same-site", "request-1", token, map[string]string{"Sec-Fetch-Site": "same-site"}, []*http.Cookie{cookie}, errCrossSite},
+		{"foreign origin", "request-1", token, map[string]string{"Origin": "https://evil.example"}, []*http.Cookie{cookie}, errCrossSite},
+	}
+	for _, test := range tests {
+		err := c.verify(csrfRequest(test.headers, test.cookies...), test.authRequestID, test.token)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: verify = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// a token signed with another key is worthless
+	if err := newLoginCSRF([32]byte{2}, csrfTestIssuer).verify(csrfRequest(nil, cookie), "request-1", token); !errors.Is(err, errInvalidCSRFToken) {
+		t.Errorf("verify with another key = %v, want %v", err, errInvalidCSRFToken)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no headers", nil, true},
+		{"same-origin", map[string]string{"Sec-Fetch-Site": "same-origin"}, true},
+		{"typed by the user", map[string]string{"Sec-Fetch-Site": "none"}, true},
+		{"same-site", map[string]string{"Sec-Fetch-Site": "same-site"}, false},
+		{"cross-site", map[string]string{"Sec-Fetch-Site": "cross-site"}, false},
+		{"unknown Sec-Fetch-Site", map[string]string{"Sec-Fetch-Site": "whatever"}, false},
+		{"issuer origin", map[string]string{"Origin": csrfTestIssuer}, true},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}, false},
+		{"other scheme", map[string]string{"Origin": "http://idp.example"}, false},
+		{"other port", map[string]string{"Origin": "https://idp.example:8443"}, false},
+		{"subdomain", map[string]string{"Origin": "https://login.idp.example"}, false},
+		{"opaque origin", map[string]string{"Origin": "null"}, false},
+		{"origin with a trailing slash", map[string]string{"Origin": csrfTestIssuer + "/"}, false},
+		{"same-origin from a foreign origin", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://evil.example"}, false},
+	}
+	for _, test := range tests {
+		if got := sameOrigin(csrfRequest(test.headers)); got != test.want {
+			t.Errorf("%s: sameOrigin = %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	// the issuer's path does not take part in the origin
+	r := httptest.NewRequest(http.MethodPost, "/login/username", nil)
+	r = r.WithContext(op.ContextWithIssuer(r.Context(), csrfTestIssuer+"/tenant"))
+	r.Header.Set("Origin", csrfTestIssuer)
+	if !sameOrigin(r) {
+		t.Errorf("sameOrigin = false for an issuer with a path")
+	}
+}
@@ -0,0 +1,416 @@
+package op
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/storage"
+)
+
+const (
+	pathDevice         = "/device"
+	userCodeCookieName = "device_user_code"
+)
+
+var (
+	errUserCodeNotFound = errors.New("コードが見つかりません")
+	errUserCodeExpired  = errors.New("コードの有効期限が切れています")
+	errUserCodeUsed     = errors.New("このコードは既に使用されています")
+)
+
+// DeviceLogin serves the user-facing pages of the device authorization grant:
+// user code entry, sign-in and confirmation.
+type DeviceLogin struct {
+	router   chi.Router
+	storage  *storage.Storage
+	cookie   *securecookie.SecureCookie
+	userCode op.UserCodeConfig
+	lifetime time.Duration
+	secure   bool
+	throttle *loginThrottle
+	csrf     *loginCSRF
+}
+
+type userCodeCookie struct {
+	UserCode string
+	Subject  string
+	Username string
+	// OTPPending is set until the user enters the one-time password, OTP
+	// once they did.
+	OTPPending bool
+	OTP        bool
+}
+
+// NewDeviceLogin derives the cookie keys from the provider's crypto key, so
+// that a device sign-in survives restarts and works across replicas. The
+// forms carry csrf tokens bound to the user code.
+func NewDeviceLogin(storage *storage.Storage, config op.DeviceAuthorizationConfig, cryptoKey [32]byte, issuer string, throttle *loginThrottle, csrf *loginCSRF) *DeviceLogin {
+	hashKey := sha256.Sum256(append([]byte("idp device cookie\x00"), cryptoKey[:]...))
+	blockKey := sha256.Sum256(append([]byte("idp device cookie encryption\x00"), cryptoKey[:]...))
+	d := &DeviceLogin{
+		storage:  storage,
+		cookie:   securecookie.New(hashKey[:], blockKey[:]),
+		userCode: config.UserCode,
+		lifetime: config.Lifetime,
+		secure:   strings.HasPrefix(issuer, "https://"),
+		throttle: throttle,
+		csrf:     csrf,
+	}
+	d.cookie.MaxAge(int(config.Lifetime.Seconds()))
+	d.router = d.newRouter()
+	return d
+}
+
+func (d *DeviceLogin) newRouter() chi.Router {
+	router := chi.NewRouter()
+	router.Get("/", d.userCodeHandler)
+	router.Post("/login", d.loginHandler)
+	router.Post("/otp", d.otpHandler)
+	router.Post("/confirm", d.confirmHandler)
+	return router
+}
+
+func (d *DeviceLogin) Router() chi.Router {
+	return d.router
+}
+
+// userCodeHandler renders the code entry page, or the sign-in page when a
+// valid user_code is given (verification_uri_complete or form submit).
+func (d *DeviceLogin) userCodeHandler(w http.ResponseWriter, r *http.Request) {
+	input := r.URL.Query().Get("user_code")
+	if input == "" {
+		renderDevicePage(w, http.StatusOK, "usercode", deviceUserCodeData{})
+		return
+	}
+
+	userCode := d.normalizeUserCode(input)
+	if _, ok := d.lookupUserCode(w, r, userCode, input); !ok {
+		return
+	}
+
+	renderDevicePage(w, http.StatusOK, "device_login", deviceUserCodeData{UserCode: userCode, CSRFToken: d.csrf.token(w, r, userCode)})
+}
+
+func (d *DeviceLogin) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{Error: "リクエストが不正です"})
+		return
+	}
+
+	userCode := d.normalizeUserCode(r.PostForm.Get("user_code"))
+	if !d.verifyCSRF(w, r, userCode) {
+		return
+	}
+	state, ok := d.lookupUserCode(w, r, userCode, "")
+	if !ok {
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+	if username == "" || password == "" {
+		renderDevicePage(w, http.StatusBadRequest, "device_login", deviceUserCodeData{
+			UserCode:  userCode,
+			CSRFToken: d.csrf.token(w, r, userCode),
+			Error:     "ユーザー名とパスワードを入力してください",
+		})
+		return
+	}
+
+	wait, err := d.throttle.begin(r, username)
+	if err != nil {
+		slog.Error("failed to throttle device login", "error", err)
+		http.Error(w, "failed to check credentials", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		renderDevicePage(w, http.StatusTooManyRequests, "device_login", deviceUserCodeData{
+			UserCode:  userCode,
+			CSRFToken: d.csrf.token(w, r, userCode),
+			Error:     fmt.Sprintf("サインインの試行回数が多すぎます。%d 秒後にもう一度お試しください", retryAfterSeconds(wait)),
+		})
+		return
+	}
+
+	// a user without the second factor the client demands is turned away
+	// like a wrong password, so that the answer does not confirm the password
+	subject, err := d.storage.AuthenticateUser(username, password)
+	enrolled := err == nil && d.storage.TOTPEnrolled(subject)
+	if err == nil && !enrolled && d.storage.MFARequired(state.ClientID, nil) {
+		err = storage.ErrMFANotEnrolled
+	}
+	if err != nil {
+		slog.Warn("device login failed", "error", err)
+		renderDevicePage(w, http.StatusUnauthorized, "device_login", deviceUserCodeData{
+			UserCode:  userCode,
+			CSRFToken: d.csrf.token(w, r, userCode),
+			Error:     "ユーザー名またはパスワードが正しくありません",
+		})
+		return
+	}
+	if !enrolled {
+		d.throttle.succeeded(r, username)
+	}
+
+	data := userCodeCookie{
+		UserCode:   userCode,
+		Subject:    subject,
+		Username:   username,
+		OTPPending: enrolled,
+	}
+	if err := d.setCookie(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enrolled {
+		renderDevicePage(w, http.StatusOK, "device_otp", deviceUserCodeData{CSRFToken: d.csrf.token(w, r, userCode)})
+		return
+	}
+	d.renderConfirmPage(w, r, data, state)
+}
+
+// otpHandler checks the one-time password of a user who signed in with the
+// password and goes on to the confirmation.
+func (d *DeviceLogin) otpHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := d.readCookie(r)
+	if !ok || !data.OTPPending {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{Error: "セッションの有効期限が切れました。もう一度コードを入力してください"})
+		return
+	}
+	if !d.verifyCSRF(w, r, data.UserCode) {
+		return
+	}
+
+	state, err := d.lookup(r, data.UserCode)
+	if err != nil {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{Error: err.Error()})
+		return
+	}
+
+	// wrong codes count against the username like wrong passwords, a new
+	// device code does not start over
+	wait, err := d.throttle.beginSecondFactor(r, data.Username)
+	if err != nil {
+		slog.Error("failed to throttle device otp", "error", err)
+		http.Error(w, "failed to check the code", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		renderDevicePage(w, http.StatusTooManyRequests, "device_otp", deviceUserCodeData{
+			CSRFToken: d.csrf.token(w, r, data.UserCode),
+			Error:     fmt.Sprintf("サインインの試行回数が多すぎます。%d 秒後にもう一度お試しください", retryAfterSeconds(wait)),
+		})
+		return
+	}
+
+	err = d.storage.CheckDeviceTOTP(r.Context(), data.UserCode, data.Subject, strings.TrimSpace(r.PostFormValue("code")))
+	switch {
+	case errors.Is(err, storage.ErrTooManyOTPAttempts):
+		renderDevicePage(w, http.StatusUnauthorized, "usercode", deviceUserCodeData{Error: "確認コードの試行回数が上限に達したため、このコードは無効になりました"})
+		return
+	case errors.Is(err, storage.ErrInvalidOTP):
+		renderDevicePage(w, http.StatusUnauthorized, "device_otp", deviceUserCodeData{CSRFToken: d.csrf.token(w, r, data.UserCode), Error: "確認コードが正しくありません"})
+		return
+	case err != nil:
+		slog.Error("device otp check failed", "error", err)
+		http.Error(w, "failed to check the code", http.StatusInternalServerError)
+		return
+	}
+
+	d.throttle.succeeded(r, data.Username)
+	data.OTPPending, data.OTP = false, true
+	if err := d.setCookie(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.renderConfirmPage(w, r, data, state)
+}
+
+func (d *DeviceLogin) renderConfirmPage(w http.ResponseWriter, r *http.Request, data userCodeCookie, state *op.DeviceAuthorizationState) {
+	renderDevicePage(w, http.StatusOK, "confirm_device", struct {
+		Username  string
+		ClientID  string
+		Scopes    []string
+		CSRFToken string
+	}{
+		Username:  data.Username,
+		ClientID:  state.ClientID,
+		Scopes:    state.Scopes,
+		CSRFToken: d.csrf.token(w, r, data.UserCode),
+	})
+}
+
+// verifyCSRF runs d.csrf.verify for a form of the device pages and writes
+// the error response when it fails.
+func (d *DeviceLogin) verifyCSRF(w http.ResponseWriter, r *http.Request, userCode string) bool {
+	if err := d.csrf.verify(r, userCode, r.PostFormValue("csrf_token")); err != nil {
+		slog.Warn("device form rejected", "error", err, "origin", r.Header.Get("Origin"), "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (d *DeviceLogin) setCookie(w http.ResponseWriter, data userCodeCookie) error {
+	encoded, err := d.cookie.Encode(userCodeCookieName, data)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     userCodeCookieName,
+		Value:    encoded,
+		Path:     pathDevice,
+		MaxAge:   int(d.lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   d.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (d *DeviceLogin) readCookie(r *http.Request) (userCodeCookie, bool) {
+	var data userCodeCookie
+	cookie, err := r.Cookie(userCodeCookieName)
+	if err != nil {
+		return data, false
+	}
+	if err := d.cookie.Decode(userCodeCookieName, cookie.Value, &data); err != nil {
+		return data, false
+	}
+	return data, true
+}
+
+func (d *DeviceLogin) confirmHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := d.readCookie(r)
+	if !ok || data.OTPPending {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{Error: "セッションの有効期限が切れました。もう一度コードを入力してください"})
+		return
+	}
+	if !d.verifyCSRF(w, r, data.UserCode) {
+		return
+	}
+
+	if _, err := d.lookup(r, data.UserCode); err != nil {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{Error: err.Error()})
+		return
+	}
+
+	var (
+		allowed bool
+		err     error
+	)
+	switch r.PostFormValue("action") {
+	case "allowed":
+		allowed = true
+		err = d.storage.CompleteDeviceAuthorization(r.Context(), data.UserCode, data.Subject, data.OTP)
+	case "denied":
+		err = d.storage.DenyDeviceAuthorization(r.Context(), data.UserCode)
+	default:
+		http.Error(w, `action must be one of "allowed" or "denied"`, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to update device authorization", "error", err)
+		http.Error(w, "failed to update device authorization", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     userCodeCookieName,
+		Path:     pathDevice,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   d.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	renderDevicePage(w, http.StatusOK, "device_done", struct{ Allowed bool }{Allowed: allowed})
+}
+
+// lookupUserCode is lookup for a code the user entered, which renders the
+// code entry page with input on failure. Wrong codes count against the
+// client address, so that pending codes cannot be guessed (RFC 8628
+// section 5.1).
+func (d *DeviceLogin) lookupUserCode(w http.ResponseWriter, r *http.Request, userCode, input string) (*op.DeviceAuthorizationState, bool) {
+	wait, err := d.throttle.beginUserCode(r)
+	if err != nil {
+		slog.Error("failed to throttle user code", "error", err)
+		http.Error(w, "failed to check the code", http.StatusInternalServerError)
+		return nil, false
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		renderDevicePage(w, http.StatusTooManyRequests, "usercode", deviceUserCodeData{
+			UserCode: input,
+			Error:    fmt.Sprintf("コードの入力回数が多すぎます。%d 秒後にもう一度お試しください", retryAfterSeconds(wait)),
+		})
+		return nil, false
+	}
+
+	state, err := d.lookup(r, userCode)
+	if err != nil {
+		renderDevicePage(w, http.StatusBadRequest, "usercode", deviceUserCodeData{UserCode: input, Error: err.Error()})
+		return nil, false
+	}
+	d.throttle.userCodeFound(r)
+	return state, true
+}
+
+// lookup returns the pending authorization for the user code or an error
+// that can be shown to the user.
+func (d *DeviceLogin) lookup(r *http.Request, userCode string) (*op.DeviceAuthorizationState, error) {
+	state, err := d.storage.GetDeviceAuthorizationByUserCode(r.Context(), userCode)
+	switch {
+	case err != nil:
+		return nil, errUserCodeNotFound
+	case state.Done || state.Denied:
+		return nil, errUserCodeUsed
+	case time.Now().After(state.Expires):
+		return nil, errUserCodeExpired
+	}
+	return state, nil
+}
+
+// normalizeUserCode accepts codes typed in lower case, without dashes or with
+// extra whitespace and returns them in the form they were issued.
+func (d *DeviceLogin) normalizeUserCode(input string) string {
+	var chars []rune
+	for _, r := range strings.ToUpper(input) {
+		if strings.ContainsRune(d.userCode.CharSet, r) {
+			chars = append(chars, r)
+		}
+	}
+
+	var b strings.Builder
+	for i, r := range chars {
+		if d.userCode.DashInterval > 0 && i > 0 && i%d.userCode.DashInterval == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type deviceUserCodeData struct {
+	UserCode  string
+	CSRFToken string
+	Error     string
+}
+
+func renderDevicePage(w http.ResponseWriter, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("failed to render device page", "template", name, "error", err)
+	}
+}
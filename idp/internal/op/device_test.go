@@ -0,0 +1,184 @@
+package op
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/storage"
+)
+
+const testUserCode = "BCDF-GHJK"
+
+// newDeviceTest returns the device pages with a pending authorization for
+// testUserCode and login limits that back off after two wrong attempts.
+func newDeviceTest(t *testing.T) *DeviceLogin {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte(`[{"id": "tv", "type": "native", "redirect_uris": ["http://127.0.0.1/callback"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := data.LoadClients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the device pages up to the sign-in need neither users nor keys
+	s := storage.New(storage.NewMemoryBackend(), clients, nil, nil, config.Default().Provider.Lifetimes, logger)
+	if err := s.StoreDeviceAuthorization(context.Background(), "tv", "device-code", testUserCode, time.Now().Add(time.Minute), []string{"openid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default().Login
+	cfg.FreeFailuresPerIP, cfg.MaxFailuresPerIP = 2, 5
+	throttle, err := newLoginThrottle(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf := newLoginCSRF([32]byte{1}, testIssuer).forPath(pathDevice)
+	return NewDeviceLogin(s, op.DeviceAuthorizationConfig{Lifetime: time.Minute, UserCode: op.UserCodeBase20}, [32]byte{1}, testIssuer, throttle, csrf)
+}
+
+// enterUserCode submits the code entry page from addr.
+func enterUserCode(d *DeviceLogin, addr, userCode string) *http.Response {
+	r := httptest.NewRequest(http.MethodGet, "/?user_code="+url.QueryEscape(userCode), nil)
+	r.RemoteAddr = addr + ":1234"
+	w := httptest.NewRecorder()
+	d.Router().ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestDeviceCookieSecure(t *testing.T) {
+	for issuer, want := range map[string]bool{"https://idp.example": true, "http://localhost:8080": false} {
+		d := NewDeviceLogin(nil, op.DeviceAuthorizationConfig{Lifetime: time.Minute}, [32]byte{1}, issuer, nil, nil)
+		w := httptest.NewRecorder()
+		if err := d.setCookie(w, userCodeCookie{UserCode: "BCDF-GHJK"}); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure != want {
+			t.Errorf("%s: cookies = %v, want Secure %t", issuer, cookies, want)
+		}
+	}
+}
+
+func TestUserCodeLookupThrottled(t *testing.T) {
+	d := newDeviceTest(t)
+
+	// the free wrong codes and the one that starts the backoff are answered
+	for i, userCode := range []string{"BCDF-GHJL", "BCDF-GHJM", "BCDF-GHJN"} {
+		if res := enterUserCode(d, "192.0.2.1", userCode); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("wrong code %d: status %d, want %d", i+1, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+	// then even the right code has to wait
+	res := enterUserCode(d, "192.0.2.1", testUserCode)
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("status %d, Retry-After %q, want %d with Retry-After", res.StatusCode, res.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	// found codes are taken back, so coming back to the page is not limited
+	for i := range 5 {
+		if res := enterUserCode(d, "192.0.2.2", "bcdfghjk"); res.StatusCode != http.StatusOK {
+			t.Fatalf("right code %d from another address: status %d, want %d", i+1, res.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// postDeviceForm posts form to a device page with the cookies set.
+func postDeviceForm(d *DeviceLogin, path string, form url.Values, headers map[string]string, cookies ...*http.Cookie) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r = r.WithContext(op.ContextWithIssuer(r.Context(), testIssuer))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	d.Router().ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestDeviceLoginCSRF(t *testing.T) {
+	d := newDeviceTest(t)
+
+	res := enterUserCode(d, "192.0.2.1", testUserCode)
+	cookies := res.Cookies()
+	if res.StatusCode != http.StatusOK || len(cookies) != 1 || cookies[0].Name != csrfCookieName || cookies[0].Path != pathDevice || !cookies[0].Secure {
+		t.Fatalf("status %d, cookies %v, want a Secure csrf cookie for %s", res.StatusCode, cookies, pathDevice)
+	}
+	cookie := cookies[0]
+	token := d.csrf.sign(cookie.Value, testUserCode)
+	other := d.csrf.sign(cookie.Value, "BCDF-GHJL")
+	if body, _ := io.ReadAll(res.Body); !strings.Contains(string(body), `name="csrf_token" value="`+token+`"`) {
+		t.Fatalf("sign-in page does not carry the token %s", token)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		headers map[string]string
+		cookies []*http.Cookie
+		want    int
+	}{
+		// the empty username shows the form passed the csrf check
+		{"valid token", token, nil, []*http.Cookie{cookie}, http.StatusBadRequest},
+		{"missing token", "", nil, []*http.Cookie{cookie}, http.StatusForbidden},
+		{"missing cookie", token, nil, nil, http.StatusForbidden},
+		{"token of another user code", other, nil, []*http.Cookie{cookie}, http.StatusForbidden},
+		{"cross-site", token, map[string]string{"Sec-Fetch-Site": "cross-site"}, []*http.Cookie{cookie}, http.StatusForbidden},
+		{"foreign origin", token, map[string]string{"Origin": "https://evil.example"}, []*http.Cookie{cookie}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		form := url.Values{"user_code": {testUserCode}, "csrf_token": {test.token}}
+		if res := postDeviceForm(d, "/login", form, test.headers, test.cookies...); res.StatusCode != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, res.StatusCode, test.want)
+		}
+	}
+}
+
+func TestDeviceConfirmCSRF(t *testing.T) {
+	d := newDeviceTest(t)
+	w := httptest.NewRecorder()
+	token := d.csrf.token(w, httptest.NewRequest(http.MethodGet, "/", nil), testUserCode)
+	if err := d.setCookie(w, userCodeCookie{UserCode: testUserCode, Subject: "user-1", Username: "user1"}); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+
+	denied := func() bool {
+		t.Helper()
+		state, err := d.storage.GetDeviceAuthorizationByUserCode(context.Background(), testUserCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.Denied
+	}
+
+	// a page on another site cannot deny, or allow, the device for the user
+	form := url.Values{"action": {"denied"}}
+	if res := postDeviceForm(d, "/confirm", form, nil, cookies...); res.StatusCode != http.StatusForbidden || denied() {
+		t.Fatalf("without token: status %d, denied %t, want %d and untouched", res.StatusCode, denied(), http.StatusForbidden)
+	}
+	form.Set("csrf_token", token)
+	if res := postDeviceForm(d, "/confirm", form, map[string]string{"Sec-Fetch-Site": "cross-site"}, cookies...); res.StatusCode != http.StatusForbidden || denied() {
+		t.Fatalf("cross-site: status %d, denied %t, want %d and untouched", res.StatusCode, denied(), http.StatusForbidden)
+	}
+	if res := postDeviceForm(d, "/confirm", form, nil, cookies...); res.StatusCode != http.StatusOK || !denied() {
+		t.Fatalf("with token: status %d, denied %t, want %d and denied", res.StatusCode, denied(), http.StatusOK)
+	}
+}
@@ -0,0 +1,284 @@
+package op
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/storage"
+)
+
+const (
+	// dpopProofLifetime is how long after its iat a DPoP proof is accepted,
+	// and so how long its jti is remembered.
+	dpopProofLifetime = 5 * time.Minute
+	dpopNonceLifetime = 5 * time.Minute
+)
+
+type dpopClient interface {
+	DPoPBoundAccessTokens() bool
+}
+
+// dpopClaims are the claims of a DPoP proof (RFC 9449 4.2).
+type dpopClaims struct {
+	jwt.Claims
+	Method          string `json:"htm"`
+	URI             string `json:"htu"`
+	AccessTokenHash string `json:"ath"`
+	Nonce           string `json:"nonce"`
+}
+
+// dpopProofs implements DPoP (RFC 9449). At the token endpoint a proof binds
+// the issued tokens to its key and the response says token_type DPoP; at the
+// userinfo endpoint a DPoP access token must come with a proof from the same
+// key. The key reaches the storage in the context, where tokens are bound
+// and checked. Every response to a proof carries a fresh DPoP-Nonce, which
+// proofs must echo when nonces are required.
+type dpopProofs struct {
+	storage       *storage.Storage
+	issuer        string
+	nonceRequired bool
+	nonceKey      [32]byte
+	tokenPath     string
+	userinfoPath  string
+}
+
+func newDPoPProofs(storage *storage.Storage, issuer string, nonceRequired bool, cryptoKey [32]byte, provider op.OpenIDProvider) *dpopProofs {
+	return &dpopProofs{
+		storage:       storage,
+		issuer:        strings.TrimSuffix(issuer, "/"),
+		nonceRequired: nonceRequired,
+		nonceKey:      sha256.Sum256(append([]byte("idp dpop nonce\x00"), cryptoKey[:]...)),
+		tokenPath:     provider.TokenEndpoint().Relative(),
+		userinfoPath:  provider.UserinfoEndpoint().Relative(),
+	}
+}
+
+func (d *dpopProofs) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == d.tokenPath && r.Method == http.MethodPost:
+			d.serveToken(w, r, next)
+		case r.URL.Path == d.userinfoPath:
+			d.serveUserinfo(w, r, next)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (d *dpopProofs) serveToken(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.ParseForm() != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) == 0 {
+		clientID := r.PostForm.Get("client_id")
+		if basicID, _, ok := r.BasicAuth(); ok {
+			clientID, _ = url.QueryUnescape(basicID)
+		}
+		if client, err := d.storage.GetClientByClientID(r.Context(), clientID); err == nil {
+			if bound, ok := client.(dpopClient); ok && bound.DPoPBoundAccessTokens() {
+				writeOAuthError(w, errInvalidDPoPProof("client %s must send a DPoP proof", clientID))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("DPoP-Nonce", d.nonce())
+	if len(proofs) > 1 {
+		writeOAuthError(w, errInvalidDPoPProof("only one DPoP proof may be sent"))
+		return
+	}
+	thumbprint, err := d.verify(r.Context(), proofs[0], r.Method, d.issuer+r.URL.Path, "")
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	capture := newResponseCapture()
+	next.ServeHTTP(capture, r.WithContext(storage.WithDPoPKey(r.Context(), thumbprint)))
+	var response map[string]any
+	if capture.status != http.StatusOK || json.Unmarshal(capture.body.Bytes(), &response) != nil || response["token_type"] != oidc.BearerToken {
+		capture.flush(w)
+		return
+	}
+	response["token_type"] = storage.DPoPTokenType
+	raw, _ := json.Marshal(response)
+	for key, values := range capture.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.WriteHeader(capture.status)
+	w.Write(raw)
+}
+
+// serveUserinfo verifies the proof that comes with a DPoP access token and
+// hands the token to the provider as a bearer token. Bearer requests pass
+// through; the storage turns away DPoP-bound tokens among them.
+func (d *dpopProofs) serveUserinfo(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	scheme, accessToken, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, storage.DPoPTokenType) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("DPoP-Nonce", d.nonce())
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		writeDPoPChallenge(w, errInvalidDPoPProof("exactly one DPoP proof is required"))
+		return
+	}
+	thumbprint, err := d.verify(r.Context(), proofs[0], r.Method, d.issuer+r.URL.Path, accessToken)
+	if err != nil {
+		writeDPoPChallenge(w, err)
+		return
+	}
+
+	bearer := r.Clone(storage.WithDPoPKey(r.Context(), thumbprint))
+	bearer.Header.Set("Authorization", oidc.PrefixBearer+accessToken)
+	next.ServeHTTP(w, bearer)
+}
+
+// verify checks a DPoP proof for a request to endpoint and returns the
+// thumbprint of its key. With an access token, the proof must carry its
+// hash in ath.
+func (d *dpopProofs) verify(ctx context.Context, proof, method, endpoint, accessToken string) (string, *oidc.Error) {
+	token, err := jwt.ParseSigned(proof, requestObjectAlgorithms)
+	if err != nil {
+		return "", errInvalidDPoPProof("DPoP proof must be a JWT signed with one of %s", joinAlgorithms(requestObjectAlgorithms))
+	}
+	header := token.Headers[0]
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" {
+		return "", errInvalidDPoPProof("DPoP proof typ must be dpop+jwt")
+	}
+	key := header.JSONWebKey
+	if key == nil || !key.Valid() || !key.IsPublic() {
+		return "", errInvalidDPoPProof("DPoP proof must carry a public jwk")
+	}
+
+	var claims dpopClaims
+	if err := token.Claims(key, &claims); err != nil {
+		return "", errInvalidDPoPProof("DPoP proof signature is invalid")
+	}
+	if claims.ID == "" {
+		return "", errInvalidDPoPProof("DPoP proof must have a jti claim")
+	}
+	if claims.Method != method {
+		return "", errInvalidDPoPProof("DPoP proof htm must be %s", method)
+	}
+	if !sameEndpoint(claims.URI, endpoint) {
+		return "", errInvalidDPoPProof("DPoP proof htu must be %s", endpoint)
+	}
+	if claims.IssuedAt == nil {
+		return "", errInvalidDPoPProof("DPoP proof must have an iat claim")
+	}
+	issuedAt := claims.IssuedAt.Time()
+	if now := time.Now(); issuedAt.After(now.Add(jwt.DefaultLeeway)) || issuedAt.Before(now.Add(-dpopProofLifetime)) {
+		return "", errInvalidDPoPProof("DPoP proof iat must be within %s of the current time", dpopProofLifetime)
+	}
+	if accessToken != "" && claims.AccessTokenHash != accessTokenHash(accessToken) {
+		return "", errInvalidDPoPProof("DPoP proof ath does not match the access token")
+	}
+	if (d.nonceRequired || claims.Nonce != "") && !d.validNonce(claims.Nonce) {
+		return "", &oidc.Error{ErrorType: "use_dpop_nonce", Description: "DPoP proof must use the DPoP-Nonce of the last response"}
+	}
+
+	sum, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", errInvalidDPoPProof("DPoP proof jwk is invalid")
+	}
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum)
+	switch err := d.storage.UseDPoPProof(ctx, thumbprint, claims.ID, issuedAt.Add(dpopProofLifetime)); {
+	case errors.Is(err, storage.ErrDPoPProofReplayed):
+		return "", errInvalidDPoPProof("DPoP proof was already used")
+	case err != nil:
+		return "", oidc.ErrServerError().WithParent(err)
+	}
+	return thumbprint, nil
+}
+
+// nonce is the time it was issued with a MAC, so that any instance can
+// check it without keeping state.
+func (d *dpopProofs) nonce() string {
+	return base64.RawURLEncoding.EncodeToString(d.signNonce(time.Now()))
+}
+
+func (d *dpopProofs) validNonce(nonce string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return hmac.Equal(d.signNonce(issued), raw) && time.Since(issued) < dpopNonceLifetime && !issued.After(time.Now())
+}
+
+func (d *dpopProofs) signNonce(issued time.Time) []byte {
+	raw := binary.BigEndian.AppendUint64(nil, uint64(issued.Unix()))
+	mac := hmac.New(sha256.New, d.nonceKey[:])
+	mac.Write(raw)
+	return mac.Sum(raw)
+}
+
+// sameEndpoint compares the htu of a proof with the endpoint, ignoring
+// query and fragment, the case of scheme and host and a default port.
+func sameEndpoint(uri, endpoint string) bool {
+	u, ok := normalizeEndpoint(uri)
+	if !ok {
+		return false
+	}
+	e, ok := normalizeEndpoint(endpoint)
+	return ok && u == e
+}
+
+func normalizeEndpoint(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	u.RawQuery, u.Fragment, u.RawFragment = "", "", ""
+	u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			u.Host = "[" + u.Host + "]"
+		}
+	}
+	return u.String(), true
+}
+
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// writeDPoPChallenge answers a resource request with a DPoP proof problem
+// as RFC 9449 7.1 describes.
+func writeDPoPChallenge(w http.ResponseWriter, err *oidc.Error) {
+	algorithms := strings.ReplaceAll(joinAlgorithms(requestObjectAlgorithms), ", ", " ")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("DPoP error=%q, error_description=%q, algs=%q", err.ErrorType, err.Description, algorithms))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func errInvalidDPoPProof(format string, args ...any) *oidc.Error {
+	return &oidc.Error{ErrorType: "invalid_dpop_proof", Description: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,35 @@
+package op
+
+import "testing"
+
+func TestSameEndpoint(t *testing.T) {
+	tests := []struct {
+		htu      string
+		endpoint string
+		want     bool
+	}{
+		{"https://idp.example/oauth/token", "https://idp.example/oauth/token", true},
+		{"https://idp.example/oauth/token?x=1#frag", "https://idp.example/oauth/token", true},
+		{"HTTPS://IDP.Example/oauth/token", "https://idp.example/oauth/token", true},
+		{"https://idp.example/oauth/token", "https://IDP.example/oauth/token", true},
+		{"https://idp.example:443/oauth/token", "https://idp.example/oauth/token", true},
+		{"https://idp.example/oauth/token", "https://idp.example:443/oauth/token", true},
+		{"http://localhost:80/oauth/token", "http://localhost/oauth/token", true},
+		{"https://[2001:DB8::1]:443/oauth/token", "https://[2001:db8::1]/oauth/token", true},
+		{"http://localhost:8080/oauth/token", "http://localhost:8080/oauth/token", true},
+		{"https://idp.example:8443/oauth/token", "https://idp.example/oauth/token", false},
+		{"http://idp.example:443/oauth/token", "https://idp.example/oauth/token", false},
+		{"http://idp.example/oauth/token", "https://idp.example/oauth/token", false},
+		{"https://idp.example/OAUTH/token", "https://idp.example/oauth/token", false},
+		{"https://idp.example/oauth/token/", "https://idp.example/oauth/token", false},
+		{"https://other.example/oauth/token", "https://idp.example/oauth/token", false},
+		{"/oauth/token", "https://idp.example/oauth/token", false},
+		{"https://idp.example/%zz", "https://idp.example/oauth/token", false},
+		{"", "https://idp.example/oauth/token", false},
+	}
+	for _, test := range tests {
+		if got := sameEndpoint(test.htu, test.endpoint); got != test.want {
+			t.Errorf("sameEndpoint(%q, %q) = %t, want %t", test.htu, test.endpoint, got, test.want)
+		}
+	}
+}
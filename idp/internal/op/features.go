@@ -0,0 +1,262 @@
+package op
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/storage"
+)
+
+// features enforces the parts of config.ProviderConfig that op.Config has no
+// switch for: grants that the library enables whenever the storage supports
+// them, the implicit flow and the plain PKCE method.
+type features struct {
+	cfg                 config.ProviderConfig
+	authorizePath       string
+	tokenPath           string
+	deviceAuthorizePath string
+	clientCertificates  bool
+}
+
+func newFeatures(cfg config.ProviderConfig, clientCertificates bool, provider op.OpenIDProvider) *features {
+	return &features{
+		cfg:                 cfg,
+		clientCertificates:  clientCertificates,
+		authorizePath:       provider.AuthorizationEndpoint().Relative(),
+		tokenPath:           provider.TokenEndpoint().Relative(),
+		deviceAuthorizePath: provider.DeviceAuthorizationEndpoint().Relative(),
+	}
+}
+
+func (f *features) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case f.authorizePath, pathPAR:
+			if err := f.checkAuthorize(r); err != nil {
+				writeOAuthError(w, err)
+				return
+			}
+		case f.tokenPath:
+			if err := r.ParseForm(); err == nil && !f.grantEnabled(r.PostForm.Get("grant_type")) {
+				writeOAuthError(w, oidc.ErrUnsupportedGrantType())
+				return
+			}
+			switch oidc.GrantType(r.PostForm.Get("grant_type")) {
+			case oidc.GrantTypeClientCredentials:
+				audience := strings.Fields(strings.Join(r.PostForm["audience"], " "))
+				r = r.WithContext(storage.WithRequestedAudience(r.Context(), audience))
+			case oidc.GrantTypeTokenExchange:
+				if err := checkTokenExchange(r); err != nil {
+					writeOAuthError(w, err)
+					return
+				}
+			}
+		case f.deviceAuthorizePath:
+			if !f.cfg.GrantTypeEnabled(oidc.GrantTypeDeviceCode) {
+				writeOAuthError(w, oidc.ErrUnsupportedGrantType())
+				return
+			}
+		case oidc.DiscoveryEndpoint:
+			f.serveDiscovery(w, r, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grantEnabled leaves unknown grant types to the provider, which rejects
+// them itself.
+func (f *features) grantEnabled(grantType string) bool {
+	switch oidc.GrantType(grantType) {
+	case oidc.GrantTypeCode, oidc.GrantTypeImplicit, oidc.GrantTypeRefreshToken, oidc.GrantTypeDeviceCode, oidc.GrantTypeClientCredentials, oidc.GrantTypeTokenExchange, oidc.GrantTypeBearer:
+		return f.cfg.GrantTypeEnabled(oidc.GrantType(grantType))
+	default:
+		return true
+	}
+}
+
+// checkTokenExchange turns away opaque access tokens, on which the
+// provider's token exchange dereferences the missing JWT claims.
+func checkTokenExchange(r *http.Request) *oidc.Error {
+	for _, param := range []string{"subject_token", "actor_token"} {
+		token := r.PostForm.Get(param)
+		if oidc.TokenType(r.PostForm.Get(param+"_type")) == oidc.AccessTokenType && token != "" && strings.Count(token, ".") != 2 {
+			return oidc.ErrInvalidRequest().WithDescription("%s must be a JWT access token", param)
+		}
+	}
+	return nil
+}
+
+func (f *features) checkAuthorize(r *http.Request) *oidc.Error {
+	if err := r.ParseForm(); err != nil {
+		return nil
+	}
+
+	responseType := r.Form.Get("response_type")
+	if responseType != "" && responseType != string(oidc.ResponseTypeCode) && !f.cfg.GrantTypeEnabled(oidc.GrantTypeImplicit) {
+		return oidc.ErrInvalidRequest().WithDescription("response_type %s is not supported, the implicit flow is disabled", responseType)
+	}
+
+	if r.Form.Get("code_challenge") == "" {
+		return nil
+	}
+	method := oidc.CodeChallengeMethod(r.Form.Get("code_challenge_method"))
+	if method == "" {
+		method = oidc.CodeChallengeMethodPlain
+	}
+	if !f.cfg.CodeChallengeMethodEnabled(method) {
+		return oidc.ErrInvalidRequest().WithDescription("code_challenge_method %s is not supported", method)
+	}
+	return nil
+}
+
+// serveDiscovery removes the disabled grants and the plain PKCE method from
+// the discovery document and advertises front-channel logout, signed
+// introspection responses, the PAR endpoint, request objects,
+// client_secret_jwt, mutual TLS and DPoP, which the library does not know
+// about.
+func (f *features) serveDiscovery(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	capture := newResponseCapture()
+	next.ServeHTTP(capture, r)
+
+	var document map[string]any
+	if capture.status != http.StatusOK || json.Unmarshal(capture.body.Bytes(), &document) != nil {
+		capture.flush(w)
+		return
+	}
+
+	if grants, ok := document["grant_types_supported"].([]any); ok {
+		document["grant_types_supported"] = slices.DeleteFunc(grants, func(v any) bool {
+			grant, _ := v.(string)
+			return !f.grantEnabled(grant)
+		})
+	}
+	if !f.cfg.GrantTypeEnabled(oidc.GrantTypeDeviceCode) {
+		delete(document, "device_authorization_endpoint")
+	}
+	if !f.cfg.GrantTypeEnabled(oidc.GrantTypeImplicit) {
+		document["response_types_supported"] = []string{string(oidc.ResponseTypeCode)}
+	}
+	document["code_challenge_methods_supported"] = f.cfg.CodeChallengeMethods
+	// front-channel logout is served by sessions.EndSessionHandler
+	document["frontchannel_logout_supported"] = true
+	document["frontchannel_logout_session_supported"] = true
+	if issuer, ok := document["issuer"].(string); ok {
+		// the PAR endpoint is served by pushedAuthorization
+		document["pushed_authorization_request_endpoint"] = strings.TrimSuffix(issuer, "/") + pathPAR
+		document["require_pushed_authorization_requests"] = false
+	}
+	// signed introspection responses are served by introspectionJWT with the
+	// keys that sign ID tokens
+	document["introspection_signing_alg_values_supported"] = document["id_token_signing_alg_values_supported"]
+	// client assertions are verified by clientAssertions and client
+	// certificates by mutualTLS
+	extraMethods := f.extraAuthMethods()
+	algorithms := f.clientAssertionAlgorithms()
+	for _, endpoint := range []string{"token", "introspection", "revocation"} {
+		if methods, ok := document[endpoint+"_endpoint_auth_methods_supported"].([]any); ok {
+			for _, method := range extraMethods {
+				methods = append(methods, method)
+			}
+			document[endpoint+"_endpoint_auth_methods_supported"] = methods
+		}
+		if len(algorithms) > 0 {
+			document[endpoint+"_endpoint_auth_signing_alg_values_supported"] = algorithms
+		}
+	}
+	if f.clientCertificates {
+		document["tls_client_certificate_bound_access_tokens"] = true
+	}
+	// the second factor is asked for by the login UI
+	document["acr_values_supported"] = storage.ACRValues
+	// DPoP proofs are verified by dpopProofs
+	document["dpop_signing_alg_values_supported"] = requestObjectAlgorithms
+	// request objects are verified by requestObjects
+	document["request_uri_parameter_supported"] = f.cfg.RequestObjectSupported
+	if f.cfg.RequestObjectSupported {
+		document["require_request_uri_registration"] = true
+		document["request_object_signing_alg_values_supported"] = requestObjectAlgorithms
+	}
+
+	raw, err := json.Marshal(document)
+	if err != nil {
+		capture.flush(w)
+		return
+	}
+	for key, values := range capture.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.WriteHeader(capture.status)
+	w.Write(raw)
+}
+
+// extraAuthMethods are the enabled client authentication methods that the
+// library does not advertise itself.
+func (f *features) extraAuthMethods() []oidc.AuthMethod {
+	methods := []oidc.AuthMethod{data.AuthMethodClientSecretJWT}
+	if f.clientCertificates {
+		methods = append(methods, data.AuthMethodTLSClientAuth, data.AuthMethodSelfSignedTLSClientAuth)
+	}
+	return slices.DeleteFunc(methods, func(method oidc.AuthMethod) bool {
+		return !f.cfg.AuthMethodEnabled(method)
+	})
+}
+
+func (f *features) clientAssertionAlgorithms() []jose.SignatureAlgorithm {
+	var algorithms []jose.SignatureAlgorithm
+	if f.cfg.AuthMethodEnabled(oidc.AuthMethodPrivateKeyJWT) {
+		algorithms = append(algorithms, requestObjectAlgorithms...)
+	}
+	if f.cfg.AuthMethodEnabled(data.AuthMethodClientSecretJWT) {
+		algorithms = append(algorithms, secretAlgorithms...)
+	}
+	return algorithms
+}
+
+func writeOAuthError(w http.ResponseWriter, err *oidc.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(err)
+}
+
+// responseCapture buffers a response so that it can be rewritten.
+type responseCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseCapture() *responseCapture {
+	return &responseCapture{header: make(http.Header), status: http.StatusOK}
+}
+
+func (c *responseCapture) Header() http.Header {
+	return c.header
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	return c.body.Write(p)
+}
+
+func (c *responseCapture) flush(w http.ResponseWriter) {
+	for key, values := range c.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body.Bytes())
+}
@@ -0,0 +1,60 @@
+package op
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"idp/internal/storage"
+)
+
+type frontchannelClient interface {
+	FrontchannelLogoutURI() string
+}
+
+// frontchannelURIs returns the front-channel logout URI of every client of
+// the session that has one, with iss and sid added as in OpenID Connect
+// Front-Channel Logout 1.0.
+func frontchannelURIs(store *storage.Storage, issuer string, session *storage.Session) []string {
+	var uris []string
+	for _, clientID := range session.Clients {
+		client, err := store.GetClientByClientID(context.Background(), clientID)
+		if err != nil {
+			continue
+		}
+		receiver, ok := client.(frontchannelClient)
+		if !ok || receiver.FrontchannelLogoutURI() == "" {
+			continue
+		}
+		u, err := url.Parse(receiver.FrontchannelLogoutURI())
+		if err != nil {
+			continue
+		}
+		query := u.Query()
+		query.Set("iss", issuer)
+		query.Set("sid", session.ID)
+		u.RawQuery = query.Encode()
+		uris = append(uris, u.String())
+	}
+	return uris
+}
+
+// renderFrontchannelLogout loads the logout URIs in hidden iframes and
+// continues to next once they have loaded or a timeout passed.
+func renderFrontchannelLogout(w http.ResponseWriter, next string, uris []string) {
+	data := struct {
+		Next string
+		URIs []string
+	}{
+		Next: next,
+		URIs: uris,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := templates.ExecuteTemplate(w, "frontchannel_logout", data); err != nil {
+		slog.Error("failed to render front-channel logout page", "error", err)
+	}
+}
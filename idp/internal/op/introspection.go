@@ -0,0 +1,84 @@
+package op
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+
+	"idp/internal/storage"
+)
+
+const introspectionJWTType = "token-introspection+jwt"
+
+// introspectionJWT answers introspection requests that accept
+// application/token-introspection+jwt with the provider's response signed
+// as a JWT, following RFC 9701. Other requests get plain JSON.
+type introspectionJWT struct {
+	storage *storage.Storage
+	issuer  string
+	path    string
+}
+
+func newIntrospectionJWT(storage *storage.Storage, issuer, path string) *introspectionJWT {
+	return &introspectionJWT{storage: storage, issuer: issuer, path: path}
+}
+
+func (i *introspectionJWT) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != i.path || !strings.Contains(r.Header.Get("Accept"), "application/"+introspectionJWTType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+
+		var introspection map[string]any
+		if capture.status != http.StatusOK || json.Unmarshal(capture.body.Bytes(), &introspection) != nil {
+			capture.flush(w)
+			return
+		}
+
+		// the provider only answers 200 to an authenticated client, so the
+		// caller named in the request is the one that was authenticated
+		claims := map[string]any{
+			"iss":                 i.issuer,
+			"aud":                 introspectionCaller(r),
+			"iat":                 time.Now().Unix(),
+			"token_introspection": introspection,
+		}
+		token, err := signJWT(r.Context(), i.storage, introspectionJWTType, claims)
+		if err != nil {
+			slog.Error("failed to sign introspection response", "error", err)
+			writeOAuthError(w, oidc.ErrServerError())
+			return
+		}
+		w.Header().Set("Content-Type", "application/"+introspectionJWTType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(token))
+	})
+}
+
+// introspectionCaller finds the client id the same way the provider does:
+// from a client assertion, HTTP Basic credentials or the form.
+func introspectionCaller(r *http.Request) string {
+	if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+		// the provider has verified the assertion by now
+		var claims oidc.JWTTokenRequest
+		if _, err := oidc.ParseToken(assertion, &claims); err == nil {
+			return claims.Issuer
+		}
+	}
+	if id, _, ok := r.BasicAuth(); ok {
+		if unescaped, err := url.QueryUnescape(id); err == nil {
+			return unescaped
+		}
+		return id
+	}
+	return r.PostForm.Get("client_id")
+}
@@ -0,0 +1,268 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+
+	"idp/internal/storage"
+)
+
+const (
+	requestObjectFetchTimeout = 5 * time.Second
+	requestObjectMaxSize      = 64 << 10
+)
+
+// requestObjectAlgorithms are the asymmetric algorithms a request object may
+// be signed with; unsigned and HMAC request objects are refused.
+var requestObjectAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// requestObjectClaims are the JWT claims of a request object that are not
+// authorization parameters.
+var requestObjectClaims = []string{"iss", "aud", "exp", "iat", "nbf", "jti"}
+
+type requestObjectClient interface {
+	RequestURIs() []string
+}
+
+// requestObjects implements JWT-secured authorization requests (RFC 9101):
+// the authorization parameters come in a request object signed with one of
+// the client's registered keys, either inline in request or published at a
+// request_uri that the client registered.
+type requestObjects struct {
+	storage       *storage.Storage
+	issuer        string
+	enabled       bool
+	authorizePath string
+	client        *http.Client
+}
+
+func newRequestObjects(storage *storage.Storage, issuer string, enabled bool, authorizePath string) *requestObjects {
+	return &requestObjects{
+		storage:       storage,
+		issuer:        issuer,
+		enabled:       enabled,
+		authorizePath: authorizePath,
+		client:        &http.Client{Timeout: requestObjectFetchTimeout},
+	}
+}
+
+// Handler replaces the parameters of an authorization request that carries
+// a request object with the ones it was signed with. Request URIs from the
+// PAR endpoint are left to pushedAuthorization.
+func (j *requestObjects) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != j.authorizePath || r.ParseForm() != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		request := r.Form.Get("request")
+		requestURI := r.Form.Get("request_uri")
+		if request == "" && (requestURI == "" || strings.HasPrefix(requestURI, requestURIPrefix)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientID := r.Form.Get("client_id")
+		if clientID == "" {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("client_id is required with a request object"))
+			return
+		}
+		if request != "" && requestURI != "" {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("request and request_uri must not be used together"))
+			return
+		}
+		if request == "" {
+			var err *oidc.Error
+			if request, err = j.fetch(r.Context(), clientID, requestURI); err != nil {
+				writeOAuthError(w, err)
+				return
+			}
+		}
+
+		params, err := j.verify(r.Context(), clientID, request)
+		if err != nil {
+			writeOAuthError(w, err)
+			return
+		}
+		if responseType := r.Form.Get("response_type"); responseType != "" && responseType != params.Get("response_type") {
+			writeOAuthError(w, errInvalidRequestObject("response_type does not match the request object"))
+			return
+		}
+		next.ServeHTTP(w, withAuthorizeParams(r, params))
+	})
+}
+
+// verify checks the request object's signature against the client's keys
+// and its iss, aud, exp and nbf claims, and returns the authorization
+// parameters it carries.
+func (j *requestObjects) verify(ctx context.Context, clientID, request string) (url.Values, *oidc.Error) {
+	if !j.enabled {
+		return nil, oidc.ErrRequestNotSupported()
+	}
+
+	token, err := jwt.ParseSigned(request, requestObjectAlgorithms)
+	if err != nil {
+		return nil, errInvalidRequestObject("request object must be a JWT signed with one of %s", joinAlgorithms(requestObjectAlgorithms))
+	}
+	header := token.Headers[0]
+	key, err := j.storage.GetKeyByIDAndClientID(ctx, header.KeyID, clientID)
+	if err != nil {
+		return nil, errInvalidRequestObject("no key to verify the request object: %v", err)
+	}
+	if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+		return nil, errInvalidRequestObject("request object is signed with %s, but key %q is for %s", header.Algorithm, key.KeyID, key.Algorithm)
+	}
+
+	var claims jwt.Claims
+	var params map[string]any
+	if err := token.Claims(key, &claims, &params); err != nil {
+		return nil, errInvalidRequestObject("request object signature is invalid")
+	}
+	if claims.Issuer != clientID {
+		return nil, errInvalidRequestObject("request object iss must be the client_id %s", clientID)
+	}
+	if !claims.Audience.Contains(j.issuer) {
+		return nil, errInvalidRequestObject("request object aud must contain %s", j.issuer)
+	}
+	if claims.Expiry == nil {
+		return nil, errInvalidRequestObject("request object must have an exp claim")
+	}
+	switch err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, jwt.DefaultLeeway); {
+	case errors.Is(err, jwt.ErrExpired):
+		return nil, errInvalidRequestObject("request object expired at %s", claims.Expiry.Time().UTC().Format(time.RFC3339))
+	case errors.Is(err, jwt.ErrNotValidYet):
+		return nil, errInvalidRequestObject("request object is not valid before %s", claims.NotBefore.Time().UTC().Format(time.RFC3339))
+	case err != nil:
+		return nil, errInvalidRequestObject("request object is invalid: %v", err)
+	}
+	if id, ok := params["client_id"]; ok && id != clientID {
+		return nil, errInvalidRequestObject("request object client_id does not match the request")
+	}
+	if _, ok := params["request"]; ok {
+		return nil, errInvalidRequestObject("request object must not contain request")
+	}
+	if _, ok := params["request_uri"]; ok {
+		return nil, errInvalidRequestObject("request object must not contain request_uri")
+	}
+
+	values := url.Values{}
+	for name, value := range params {
+		if slices.Contains(requestObjectClaims, name) {
+			continue
+		}
+		values.Set(name, paramValue(value))
+	}
+	values.Set("client_id", clientID)
+	return values, nil
+}
+
+// fetch loads a request object from one of the client's registered request
+// URIs.
+func (j *requestObjects) fetch(ctx context.Context, clientID, requestURI string) (string, *oidc.Error) {
+	if !j.enabled {
+		return "", &oidc.Error{ErrorType: "request_uri_not_supported", Description: "request_uri is not supported"}
+	}
+	client, err := j.storage.GetClientByClientID(ctx, clientID)
+	if err != nil {
+		return "", oidc.ErrInvalidRequest().WithDescription("unknown client_id")
+	}
+	registered, ok := client.(requestObjectClient)
+	location, _, _ := strings.Cut(requestURI, "#")
+	if !ok || !slices.Contains(registered.RequestURIs(), location) {
+		return "", errInvalidRequestURI("request_uri is not registered for client %s", clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return "", errInvalidRequestURI("request_uri is invalid")
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt")
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return "", errInvalidRequestURI("failed to fetch request_uri")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errInvalidRequestURI("failed to fetch request_uri: status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, requestObjectMaxSize))
+	if err != nil {
+		return "", errInvalidRequestURI("failed to fetch request_uri")
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// paramValue encodes a request object claim as an authorization parameter:
+// lists of strings are space separated and objects, such as claims, stay
+// JSON.
+func paramValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		words := make([]string, 0, len(v))
+		for _, item := range v {
+			word, ok := item.(string)
+			if !ok {
+				raw, _ := json.Marshal(v)
+				return string(raw)
+			}
+			words = append(words, word)
+		}
+		return strings.Join(words, " ")
+	default:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+}
+
+// withAuthorizeParams returns r as a GET to the authorization endpoint with
+// params as its query.
+func withAuthorizeParams(r *http.Request, params url.Values) *http.Request {
+	expanded := r.Clone(r.Context())
+	expanded.Method = http.MethodGet
+	expanded.Body = http.NoBody
+	expanded.ContentLength = 0
+	expanded.URL.RawQuery = params.Encode()
+	expanded.Form = nil
+	expanded.PostForm = nil
+	return expanded
+}
+
+func joinAlgorithms(algorithms []jose.SignatureAlgorithm) string {
+	names := make([]string, len(algorithms))
+	for i, alg := range algorithms {
+		names[i] = string(alg)
+	}
+	return strings.Join(names, ", ")
+}
+
+func errInvalidRequestObject(format string, args ...any) *oidc.Error {
+	return &oidc.Error{ErrorType: "invalid_request_object", Description: fmt.Sprintf(format, args...)}
+}
+
+func errInvalidRequestURI(format string, args ...any) *oidc.Error {
+	return &oidc.Error{ErrorType: "invalid_request_uri", Description: fmt.Sprintf(format, args...)}
+}
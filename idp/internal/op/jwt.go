@@ -0,0 +1,36 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"idp/internal/storage"
+)
+
+// signJWT signs claims with the provider's current signing key, setting typ
+// in the header so the token cannot be mistaken for an ID token.
+func signJWT(ctx context.Context, storage *storage.Storage, typ string, claims any) (string, error) {
+	key, err := storage.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: key.SignatureAlgorithm(),
+		Key:       &jose.JSONWebKey{Key: key.Key(), KeyID: key.ID()},
+	}, (&jose.SignerOptions{}).WithType(jose.ContentType(typ)))
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
@@ -3,29 +3,60 @@ package op
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/zitadel/oidc/v3/example/server/storage"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
 	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/storage"
+	"idp/internal/webauthn"
+)
+
+const (
+	pathLogin = "/login/username"
+	pathOTP   = "/login/otp"
 )
 
+func loginURL(id string) string {
+	return pathLogin + "?authRequestID=" + url.QueryEscape(id)
+}
+
+func otpURL(id string) string {
+	return pathOTP + "?authRequestID=" + url.QueryEscape(id)
+}
+
 type authenticate interface {
 	CheckUsernamePassword(username, password, id string) error
 }
 
 type Login struct {
-	router   chi.Router
-	storage  *storage.Storage
-	callback func(context.Context, string) string
+	router     chi.Router
+	storage    *storage.Storage
+	sessions   *sessions
+	callback   func(context.Context, string) string
+	authorizer op.Authorizer
+	rp         *webauthn.RelyingParty
+	throttle   *loginThrottle
+	csrf       *loginCSRF
 }
 
-func NewLogin(storage *storage.Storage, issuerInterceptor *op.IssuerInterceptor, callback func(context.Context, string) string) *Login {
+func NewLogin(storage *storage.Storage, sessions *sessions, issuerInterceptor *op.IssuerInterceptor, callback func(context.Context, string) string, authorizer op.Authorizer, rp *webauthn.RelyingParty, throttle *loginThrottle, csrf *loginCSRF) *Login {
 	l := &Login{
-		storage:  storage,
-		callback: callback,
+		storage:    storage,
+		sessions:   sessions,
+		callback:   callback,
+		authorizer: authorizer,
+		rp:         rp,
+		throttle:   throttle,
+		csrf:       csrf,
 	}
 	l.router = l.newRouter(issuerInterceptor)
 	return l
@@ -35,6 +66,16 @@ func (l *Login) newRouter(issuerInterceptor *op.IssuerInterceptor) chi.Router {
 	router := chi.NewRouter()
 	router.Post("/username", issuerInterceptor.HandlerFunc(l.handler))
 	router.Get("/username", l.renderLoginPage)
+	router.Get("/otp", l.renderOTPPage)
+	router.Post("/otp", issuerInterceptor.HandlerFunc(l.otpHandler))
+	router.Post("/passkey/options", l.passkeyOptionsHandler)
+	router.Post("/passkey", issuerInterceptor.HandlerFunc(l.passkeyHandler))
+	router.Get("/passkeys", l.renderPasskeysPage)
+	router.Post("/passkeys/options", l.passkeyCreationOptionsHandler)
+	router.Post("/passkeys", l.registerPasskeyHandler)
+	router.Post("/passkeys/delete", l.deletePasskeyHandler)
+	router.Get("/consent", l.renderConsentPage)
+	router.Post("/consent", issuerInterceptor.HandlerFunc(l.consentHandler))
 	return router
 }
 
@@ -44,9 +85,10 @@ func (l *Login) Router() chi.Router {
 
 func (l *Login) handler(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		ID       string `json:"id"`
-		Username string `json:"username"`
-		Password string `json:"password"`
+		ID        string `json:"id"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		CSRFToken string `json:"csrf_token"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -59,18 +101,148 @@ func (l *Login) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !l.verifyCSRF(w, r, payload.ID, payload.CSRFToken) {
+		return
+	}
+
 	if payload.Username == "" || payload.Password == "" {
 		writeJSONError(w, http.StatusBadRequest, "username and password are required")
 		return
 	}
 
-	if err := l.storage.CheckUsernamePassword(payload.Username, payload.Password, payload.ID); err != nil {
-		slog.Error("login failed", "error", err)
-		writeJSONError(w, http.StatusUnauthorized, "invalid credentials")
+	wait, err := l.throttle.begin(r, payload.Username)
+	if err != nil {
+		slog.Error("failed to throttle login", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to check credentials")
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		writeJSONErrorCode(w, http.StatusTooManyRequests, "too_many_attempts", fmt.Sprintf("too many sign-in attempts, try again in %d seconds", retryAfterSeconds(wait)))
+		return
+	}
+
+	// a user without the second factor the client demands is turned away
+	// like a wrong password, so that the answer does not confirm the password
+	err = l.storage.CheckUsernamePassword(payload.Username, payload.Password, payload.ID)
+	if err != nil {
+		slog.Warn("login failed", "error", err)
+		writeJSONErrorCode(w, http.StatusUnauthorized, "invalid_credentials", "invalid credentials")
+		return
+	}
+
+	authReq, err := l.storage.AuthRequestByID(r.Context(), payload.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "auth request not found")
+		return
+	}
+	if !authReq.(*storage.AuthRequest).SecondFactorPending() {
+		l.throttle.succeeded(r, payload.Username)
+	}
+	l.finish(w, r, payload.ID)
+}
+
+func (l *Login) otpHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID        string `json:"id"`
+		Code      string `json:"code"`
+		CSRFToken string `json:"csrf_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if payload.ID == "" || payload.Code == "" {
+		writeJSONError(w, http.StatusBadRequest, "auth request id and code are required")
+		return
+	}
+	if !l.verifyCSRF(w, r, payload.ID, payload.CSRFToken) {
 		return
 	}
 
-	next := l.callback(r.Context(), payload.ID)
+	authReq, err := l.storage.AuthRequestByID(r.Context(), payload.ID)
+	if err != nil || !authReq.(*storage.AuthRequest).SecondFactorPending() {
+		writeJSONError(w, http.StatusBadRequest, "auth request is not waiting for a code")
+		return
+	}
+	user := l.storage.UserByID(authReq.GetSubject())
+	if user == nil {
+		writeJSONError(w, http.StatusBadRequest, "auth request is not waiting for a code")
+		return
+	}
+
+	// wrong codes count against the username like wrong passwords, a new
+	// auth request does not start over
+	wait, err := l.throttle.beginSecondFactor(r, user.Username)
+	if err != nil {
+		slog.Error("failed to throttle otp", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to check the code")
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		writeJSONErrorCode(w, http.StatusTooManyRequests, "too_many_attempts", fmt.Sprintf("too many sign-in attempts, try again in %d seconds", retryAfterSeconds(wait)))
+		return
+	}
+
+	err = l.storage.CheckTOTP(r.Context(), payload.ID, strings.TrimSpace(payload.Code))
+	switch {
+	case errors.Is(err, storage.ErrTooManyOTPAttempts):
+		writeJSONErrorCode(w, http.StatusUnauthorized, "too_many_otp_attempts", "too many invalid codes, start the sign-in again")
+		return
+	case errors.Is(err, storage.ErrInvalidOTP):
+		writeJSONErrorCode(w, http.StatusUnauthorized, "invalid_otp", "invalid code")
+		return
+	case err != nil:
+		slog.Error("otp check failed", "error", err)
+		writeJSONError(w, http.StatusBadRequest, "auth request is not waiting for a code")
+		return
+	}
+
+	l.throttle.succeeded(r, user.Username)
+	l.finish(w, r, payload.ID)
+}
+
+// verifyCSRF runs l.csrf.verify for a JSON post of the login pages and
+// writes the error if it fails.
+func (l *Login) verifyCSRF(w http.ResponseWriter, r *http.Request, id, token string) bool {
+	switch err := l.csrf.verify(r, id, token); {
+	case errors.Is(err, errCrossSite):
+		slog.Warn("cross-site login rejected", "path", r.URL.Path, "origin", r.Header.Get("Origin"), "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+		writeJSONErrorCode(w, http.StatusForbidden, "cross_site_request", "request was sent from another site")
+		return false
+	case err != nil:
+		writeJSONErrorCode(w, http.StatusForbidden, "invalid_csrf_token", "csrf token is missing or invalid")
+		return false
+	}
+	return true
+}
+
+// finish tells the login page where to go after a successful step: to the
+// second factor while it is pending, otherwise on to consent or the client.
+func (l *Login) finish(w http.ResponseWriter, r *http.Request, id string) {
+	authReq, err := l.storage.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "auth request not found")
+		return
+	}
+
+	var next string
+	switch {
+	case authReq.(*storage.AuthRequest).SecondFactorPending():
+		next = otpURL(id)
+	default:
+		if err := l.sessions.start(w, r, id); err != nil {
+			// the login itself succeeded, the browser just won't be remembered
+			slog.Error("failed to start session", "error", err)
+		}
+		next = consentURL(id)
+		if authReq.Done() {
+			next = l.callback(r.Context(), id)
+		}
+	}
 	response := struct {
 		Next string `json:"next"`
 	}{
@@ -91,6 +263,16 @@ func writeJSONError(w http.ResponseWriter, status int, message string) {
 	})
 }
 
+// writeJSONErrorCode adds a code the page can tell the error apart by.
+func writeJSONErrorCode(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+		"code":  code,
+	})
+}
+
 func (l *Login) renderLoginPage(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -98,14 +280,92 @@ func (l *Login) renderLoginPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	id := r.FormValue("authRequestID")
+	if l.resumeSession(w, r, id) {
+		return
+	}
+
 	data := &struct {
-		ID string
+		ID        string
+		CSRFToken string
 	}{
-		ID: r.FormValue("authRequestID"),
+		ID:        id,
+		CSRFToken: l.csrf.token(w, r, id),
 	}
 
+	w.Header().Set("Cache-Control", "no-store")
 	err = templates.ExecuteTemplate(w, "login", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+func (l *Login) renderOTPPage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("authRequestID")
+	authReq, err := l.storage.AuthRequestByID(r.Context(), id)
+	if err != nil || !authReq.(*storage.AuthRequest).SecondFactorPending() {
+		http.Redirect(w, r, loginURL(id), http.StatusFound)
+		return
+	}
+
+	data := &struct {
+		ID        string
+		CSRFToken string
+	}{
+		ID:        id,
+		CSRFToken: l.csrf.token(w, r, id),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = templates.ExecuteTemplate(w, "otp", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// resumeSession completes the auth request with the browser's session when
+// the request allows it and reports whether a response was written. With
+// prompt=none the request fails instead of showing a page.
+func (l *Login) resumeSession(w http.ResponseWriter, r *http.Request, id string) bool {
+	authReq, err := l.storage.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		return false
+	}
+	request := authReq.(*storage.AuthRequest)
+	promptNone := slices.Contains(request.Prompt, oidc.PromptNone)
+
+	session, ok := l.sessions.current(r)
+	if !ok || !request.AcceptsSession(session, time.Now()) {
+		if promptNone {
+			l.failPromptNone(w, r, request, oidc.ErrLoginRequired())
+			return true
+		}
+		return false
+	}
+
+	if err := l.storage.ResumeSession(r.Context(), id, session); err != nil {
+		slog.Error("failed to resume session", "error", err)
+		return false
+	}
+	authReq, err = l.storage.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case authReq.Done():
+		http.Redirect(w, r, l.callback(r.Context(), id), http.StatusFound)
+	case promptNone:
+		l.failPromptNone(w, r, authReq, oidc.ErrInteractionRequired().WithDescription("consent required"))
+	default:
+		http.Redirect(w, r, consentURL(id), http.StatusFound)
+	}
+	return true
+}
+
+func (l *Login) failPromptNone(w http.ResponseWriter, r *http.Request, authReq op.AuthRequest, err *oidc.Error) {
+	op.AuthRequestError(w, r, authReq, err, l.authorizer)
+	if err := l.storage.DeleteAuthRequest(r.Context(), authReq.GetID()); err != nil {
+		slog.Error("failed to delete auth request", "error", err)
+	}
+}
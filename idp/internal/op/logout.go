@@ -0,0 +1,18 @@
+package op
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// pathLoggedOut is where end_session sends the browser when the request
+// names no valid post_logout_redirect_uri.
+const pathLoggedOut = "/logged-out"
+
+func loggedOutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := templates.ExecuteTemplate(w, "logged_out", nil); err != nil {
+		slog.Error("failed to render logged out page", "error", err)
+	}
+}
@@ -0,0 +1,239 @@
+package op
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/storage"
+)
+
+type tlsClient interface {
+	VerifiedAuthMethod() oidc.AuthMethod
+	TLSClientAuthSubject() data.TLSClientAuthSubject
+	CertificateBoundAccessTokens() bool
+}
+
+// mutualTLS implements mutual-TLS client authentication and certificate-bound
+// access tokens (RFC 8705). The client certificate of every request is
+// passed on in the context, where the storage binds tokens to it and checks
+// the binding at the userinfo endpoint. At the endpoints where clients
+// authenticate, tls_client_auth and self_signed_tls_client_auth clients are
+// verified here and continue as if they had used client_secret_basic.
+type mutualTLS struct {
+	storage   *storage.Storage
+	cfg       config.ProviderConfig
+	roots     *x509.CertPool
+	header    string
+	proxies   proxies
+	paths     []string
+	tokenPath string
+}
+
+func newMutualTLS(storage *storage.Storage, cfg config.Config, provider op.OpenIDProvider) (*mutualTLS, error) {
+	roots, err := cfg.TLS.ClientCAs()
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseProxies(cfg.TLS.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	return &mutualTLS{
+		storage: storage,
+		cfg:     cfg.Provider,
+		roots:   roots,
+		header:  cfg.TLS.ClientCertHeader,
+		proxies: proxies,
+		paths: []string{
+			provider.TokenEndpoint().Relative(),
+			provider.IntrospectionEndpoint().Relative(),
+			provider.RevocationEndpoint().Relative(),
+			provider.DeviceAuthorizationEndpoint().Relative(),
+			pathPAR,
+		},
+		tokenPath: provider.TokenEndpoint().Relative(),
+	}, nil
+}
+
+func (m *mutualTLS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert, chain, err := m.certificate(r)
+		if err != nil {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("client certificate is invalid"))
+			return
+		}
+		if cert != nil {
+			r = r.WithContext(storage.WithClientCertificate(r.Context(), cert))
+		}
+		if r.Method != http.MethodPost || !slices.Contains(m.paths, r.URL.Path) || r.ParseForm() != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		basicID, _, basic := r.BasicAuth()
+		clientID := r.PostForm.Get("client_id")
+		if basic {
+			clientID, _ = url.QueryUnescape(basicID)
+		}
+		client, err := m.storage.GetClientByClientID(r.Context(), clientID)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tc, ok := client.(tlsClient)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Path == m.tokenPath && tc.CertificateBoundAccessTokens() && cert == nil {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("client %s must present a certificate to get certificate-bound tokens", clientID))
+			return
+		}
+
+		switch method := tc.VerifiedAuthMethod(); method {
+		case data.AuthMethodTLSClientAuth, data.AuthMethodSelfSignedTLSClientAuth:
+			if basic || r.PostForm.Has("client_secret") {
+				writeClientError(w, oidc.ErrInvalidClient().WithDescription("only one client authentication method may be used"))
+				return
+			}
+			if err := m.authenticate(r, clientID, method, tc, cert, chain); err != nil {
+				writeClientError(w, err)
+				return
+			}
+			r = asAuthenticatedClient(r, clientID)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certificate returns the client certificate of the TLS connection, with
+// the intermediates the client sent, or the one forwarded by a trusted
+// proxy.
+func (m *mutualTLS) certificate(r *http.Request) (*x509.Certificate, []*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], r.TLS.PeerCertificates[1:], nil
+	}
+	if m.header == "" || r.Header.Get(m.header) == "" || !m.fromTrustedProxy(r) {
+		return nil, nil, nil
+	}
+	cert, err := parseForwardedCertificate(r.Header.Get(m.header))
+	return cert, nil, err
+}
+
+func (m *mutualTLS) fromTrustedProxy(r *http.Request) bool {
+	addr, ok := remoteAddr(r)
+	return ok && m.proxies.contains(addr)
+}
+
+// parseForwardedCertificate accepts a URL-escaped PEM certificate, as nginx
+// forwards it, or base64 encoded DER.
+func parseForwardedCertificate(value string) (*x509.Certificate, error) {
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		value = unescaped
+	}
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// authenticate checks the certificate against the client's registration:
+// for tls_client_auth it must chain to a client CA and name the registered
+// subject, for self_signed_tls_client_auth its key must be one of the
+// client's registered keys.
+func (m *mutualTLS) authenticate(r *http.Request, clientID string, method oidc.AuthMethod, client tlsClient, cert *x509.Certificate, chain []*x509.Certificate) *oidc.Error {
+	if !m.cfg.AuthMethodEnabled(method) {
+		return oidc.ErrInvalidClient().WithDescription("%s is not supported", method)
+	}
+	if cert == nil {
+		return oidc.ErrInvalidClient().WithDescription("client %s must present a certificate", clientID)
+	}
+
+	switch method {
+	case data.AuthMethodTLSClientAuth:
+		if m.roots == nil {
+			return oidc.ErrInvalidClient().WithDescription("%s is not supported without client CAs", method)
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         m.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return oidc.ErrInvalidClient().WithDescription("client certificate is not trusted")
+		}
+		if !subjectMatches(client.TLSClientAuthSubject(), cert) {
+			return oidc.ErrInvalidClient().WithDescription("client certificate does not match client %s", clientID)
+		}
+	case data.AuthMethodSelfSignedTLSClientAuth:
+		now := time.Now()
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return oidc.ErrInvalidClient().WithDescription("client certificate is expired or not yet valid")
+		}
+		registered, err := m.storage.MatchClientKey(r.Context(), clientID, cert.PublicKey)
+		if err != nil {
+			return oidc.ErrInvalidClient().WithDescription("no keys to match the client certificate: %v", err)
+		}
+		if !registered {
+			return oidc.ErrInvalidClient().WithDescription("client certificate is not registered for client %s", clientID)
+		}
+	default:
+		return oidc.ErrInvalidClient().WithParent(errors.New("unexpected authentication method"))
+	}
+	return nil
+}
+
+// subjectMatches compares the certificate with the one registered subject
+// field (RFC 8705 2.1.2).
+func subjectMatches(subject data.TLSClientAuthSubject, cert *x509.Certificate) bool {
+	switch {
+	case subject.SubjectDN != "":
+		return strings.EqualFold(subjectDN(cert), subject.SubjectDN)
+	case subject.SANDNS != "":
+		return slices.Contains(cert.DNSNames, subject.SANDNS)
+	case subject.SANURI != "":
+		return slices.ContainsFunc(cert.URIs, func(u *url.URL) bool { return u.String() == subject.SANURI })
+	case subject.SANIP != "":
+		ip := net.ParseIP(subject.SANIP)
+		return slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+	case subject.SANEmail != "":
+		return slices.Contains(cert.EmailAddresses, subject.SANEmail)
+	}
+	return false
+}
+
+// subjectDN formats the certificate's subject as RFC 4514 does, in the
+// order of its encoding, which pkix.Name.String does not keep.
+func subjectDN(cert *x509.Certificate) string {
+	var subject pkix.RDNSequence
+	if _, err := asn1.Unmarshal(cert.RawSubject, &subject); err != nil {
+		return cert.Subject.String()
+	}
+	return subject.String()
+}
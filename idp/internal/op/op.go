@@ -1,27 +1,73 @@
 package op
 
 import (
+	"fmt"
 	"log/slog"
 
+	"github.com/zitadel/oidc/v3/pkg/oidc"
 	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
 )
 
 func NewOpenIDProvider(
 	logger *slog.Logger,
 	storage op.Storage,
-	issuer string,
+	cfg config.Config,
+	cryptoKey [32]byte,
 ) (op.OpenIDProvider, error) {
-	config := &op.Config{}
+	device, err := deviceAuthorizationConfig(cfg.Device)
+	if err != nil {
+		return nil, err
+	}
 
-	options := append([]op.Option{
+	provider := cfg.Provider
+	config := &op.Config{
+		CryptoKey:                         cryptoKey,
+		DefaultLogoutRedirectURI:          pathLoggedOut,
+		CodeMethodS256:                    provider.CodeChallengeMethodEnabled(oidc.CodeChallengeMethodS256),
+		AuthMethodPost:                    provider.AuthMethodEnabled(oidc.AuthMethodPost),
+		AuthMethodPrivateKeyJWT:           provider.AuthMethodEnabled(oidc.AuthMethodPrivateKeyJWT),
+		GrantTypeRefreshToken:             provider.GrantTypeEnabled(oidc.GrantTypeRefreshToken),
+		RequestObjectSupported:            provider.RequestObjectSupported,
+		SupportedUILocales:                provider.Locales(),
+		DeviceAuthorization:               device,
+		BackChannelLogoutSupported:        true,
+		BackChannelLogoutSessionSupported: true,
+	}
+
+	options := []op.Option{
 		op.WithAllowInsecure(),
 		op.WithLogger(logger.WithGroup("op")),
-	})
+	}
 
-	handler, err := op.NewProvider(config, storage, op.StaticIssuer(issuer), options...)
+	handler, err := op.NewProvider(config, storage, op.StaticIssuer(cfg.Issuer), options...)
 	if err != nil {
 		return nil, err
 	}
 
 	return handler, nil
 }
+
+func deviceAuthorizationConfig(cfg config.DeviceConfig) (op.DeviceAuthorizationConfig, error) {
+	if cfg.Lifetime <= 0 || cfg.PollInterval <= 0 {
+		return op.DeviceAuthorizationConfig{}, fmt.Errorf("device code lifetime and poll interval must be positive")
+	}
+
+	var userCode op.UserCodeConfig
+	switch cfg.UserCodeCharset {
+	case "base20":
+		userCode = op.UserCodeBase20
+	case "digits":
+		userCode = op.UserCodeDigits
+	default:
+		return op.DeviceAuthorizationConfig{}, fmt.Errorf("unsupported device user code charset %q", cfg.UserCodeCharset)
+	}
+
+	return op.DeviceAuthorizationConfig{
+		Lifetime:     cfg.Lifetime,
+		PollInterval: cfg.PollInterval,
+		UserFormPath: pathDevice,
+		UserCode:     userCode,
+	}, nil
+}
@@ -0,0 +1,171 @@
+package op
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/storage"
+)
+
+const (
+	pathPAR          = "/par"
+	requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+)
+
+type parClient interface {
+	RequirePushedAuthorizationRequests() bool
+}
+
+// clientAuthParams authenticate the client at the PAR endpoint and are not
+// part of the authorization request.
+var clientAuthParams = []string{"client_secret", "client_assertion", "client_assertion_type"}
+
+// pushedAuthorization implements RFC 9126: clients push the authorization
+// parameters to the PAR endpoint and send the browser to the authorization
+// endpoint with the request_uri they got back.
+type pushedAuthorization struct {
+	storage        *storage.Storage
+	provider       op.OpenIDProvider
+	requestObjects *requestObjects
+	authorizePath  string
+}
+
+func newPushedAuthorization(storage *storage.Storage, provider op.OpenIDProvider, requestObjects *requestObjects) *pushedAuthorization {
+	return &pushedAuthorization{
+		storage:        storage,
+		provider:       provider,
+		requestObjects: requestObjects,
+		authorizePath:  provider.AuthorizationEndpoint().Relative(),
+	}
+}
+
+// ServeHTTP handles the PAR endpoint. The request is validated like one sent
+// to the authorization endpoint, so errors reach the client and not the
+// browser. A pushed request object is verified and stored as the parameters
+// it carries.
+func (p *pushedAuthorization) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clientID, authenticated, err := op.ClientIDFromRequest(r, p.provider)
+	if err != nil {
+		writeClientError(w, oidc.ErrInvalidClient().WithParent(err))
+		return
+	}
+	if secret := r.PostForm.Get("client_secret"); !authenticated && secret != "" {
+		if err := p.storage.AuthorizeClientIDSecret(r.Context(), clientID, secret); err != nil {
+			writeClientError(w, oidc.ErrInvalidClient().WithParent(err))
+			return
+		}
+		authenticated = true
+	}
+	client, err := p.storage.GetClientByClientID(r.Context(), clientID)
+	if err != nil {
+		writeClientError(w, oidc.ErrInvalidClient().WithParent(err))
+		return
+	}
+	if !authenticated && client.AuthMethod() != oidc.AuthMethodNone {
+		writeClientError(w, oidc.ErrInvalidClient().WithDescription("client authentication is required"))
+		return
+	}
+
+	params := url.Values{}
+	for key, values := range r.PostForm {
+		params[key] = values
+	}
+	for _, key := range clientAuthParams {
+		params.Del(key)
+	}
+	if params.Has("request_uri") {
+		writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("request_uri must not be pushed"))
+		return
+	}
+	if params.Get("client_id") != "" && params.Get("client_id") != clientID {
+		writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("client_id does not match the authenticated client"))
+		return
+	}
+	if request := params.Get("request"); request != "" {
+		var oidcErr *oidc.Error
+		if params, oidcErr = p.requestObjects.verify(r.Context(), clientID, request); oidcErr != nil {
+			writeOAuthError(w, oidcErr)
+			return
+		}
+	}
+	params.Set("client_id", clientID)
+
+	authReq := new(oidc.AuthRequest)
+	if err := p.provider.Decoder().Decode(authReq, params); err != nil {
+		writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("cannot parse auth request"))
+		return
+	}
+	if _, err := op.ValidateAuthRequestClient(r.Context(), authReq, client, p.provider.IDTokenHintVerifier(r.Context())); err != nil {
+		writeOAuthError(w, oidc.DefaultToServerError(err, err.Error()))
+		return
+	}
+
+	pushed, err := p.storage.SavePushedAuthRequest(r.Context(), clientID, params)
+	if err != nil {
+		slog.Error("failed to save pushed auth request", "error", err)
+		writeOAuthError(w, oidc.ErrServerError())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(struct {
+		RequestURI string `json:"request_uri"`
+		ExpiresIn  int64  `json:"expires_in"`
+	}{
+		RequestURI: requestURIPrefix + pushed.ID,
+		ExpiresIn:  int64(time.Until(pushed.Expiration).Round(time.Second).Seconds()),
+	})
+}
+
+// Handler replaces the parameters of an authorization request that carries
+// a request_uri with the ones pushed for it, and turns away clients that
+// must push but did not.
+func (p *pushedAuthorization) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != p.authorizePath || r.ParseForm() != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientID := r.Form.Get("client_id")
+		requestURI := r.Form.Get("request_uri")
+		if requestURI == "" {
+			if client, err := p.storage.GetClientByClientID(r.Context(), clientID); err == nil {
+				if c, ok := client.(parClient); ok && c.RequirePushedAuthorizationRequests() {
+					writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("client %s must use pushed authorization requests", clientID))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, ok := strings.CutPrefix(requestURI, requestURIPrefix)
+		if !ok {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("request_uri is not supported"))
+			return
+		}
+		pushed, err := p.storage.ConsumePushedAuthRequest(r.Context(), id, clientID)
+		if err != nil {
+			writeOAuthError(w, oidc.ErrInvalidRequest().WithDescription("request_uri is invalid or has expired"))
+			return
+		}
+
+		next.ServeHTTP(w, withAuthorizeParams(r, pushed.Params))
+	})
+}
+
+func writeClientError(w http.ResponseWriter, err *oidc.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,272 @@
+package op
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"idp/internal/storage"
+	"idp/internal/webauthn"
+)
+
+const pathPasskeys = "/login/passkeys"
+
+// passkeyView is a registered passkey as the passkeys page lists it.
+type passkeyView struct {
+	ID         string
+	CreatedAt  string
+	LastUsedAt string
+	Synced     bool
+}
+
+// passkeyOptionsHandler starts a passkey sign-in for the auth request.
+func (l *Login) passkeyOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "auth request id is required")
+		return
+	}
+
+	authReq, err := l.storage.AuthRequestByID(r.Context(), payload.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "auth request not found")
+		return
+	}
+	requireUV := authReq.(*storage.AuthRequest).RequireMFA
+
+	challenge, err := l.startCeremony(r, &storage.WebAuthnChallenge{AuthRequestID: payload.ID, RequireUserVerification: requireUV})
+	if err != nil {
+		slog.Error("failed to start passkey sign-in", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to start passkey sign-in")
+		return
+	}
+	writeJSON(w, http.StatusOK, l.rp.RequestOptions(challenge, requireUV))
+}
+
+// passkeyHandler verifies the assertion of a passkey and signs its user in
+// to the auth request.
+func (l *Login) passkeyHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID         string                     `json:"id"`
+		Credential webauthn.AssertionResponse `json:"credential"`
+		CSRFToken  string                     `json:"csrf_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !l.verifyCSRF(w, r, payload.ID, payload.CSRFToken) {
+		return
+	}
+
+	credential := &payload.Credential
+	stored, challenge, ok := l.takeCeremony(r, credential.Response.ClientDataJSON)
+	if !ok || stored.AuthRequestID != payload.ID {
+		writeJSONErrorCode(w, http.StatusBadRequest, "passkey_expired", "passkey sign-in has expired")
+		return
+	}
+	passkey, err := l.storage.PasskeyByID(r.Context(), base64.RawURLEncoding.EncodeToString(credential.RawID))
+	if err != nil {
+		writeJSONErrorCode(w, http.StatusUnauthorized, "unknown_passkey", "passkey is not registered")
+		return
+	}
+	if len(credential.Response.UserHandle) > 0 && string(credential.Response.UserHandle) != passkey.UserID {
+		writeJSONErrorCode(w, http.StatusUnauthorized, "unknown_passkey", "passkey is not registered")
+		return
+	}
+
+	result, err := l.rp.VerifyAssertion(credential, challenge, passkey.PublicKey, stored.RequireUserVerification)
+	if err != nil {
+		slog.Error("passkey sign-in failed", "passkey", passkey.ID, "error", err)
+		writeJSONErrorCode(w, http.StatusUnauthorized, "invalid_passkey", "passkey could not be verified")
+		return
+	}
+	err = l.storage.CheckPasskey(r.Context(), payload.ID, passkey.ID, result.SignCount, result.UserVerified)
+	if err != nil {
+		slog.Error("passkey sign-in failed", "passkey", passkey.ID, "error", err)
+		writeJSONErrorCode(w, http.StatusUnauthorized, "invalid_passkey", "passkey could not be verified")
+		return
+	}
+
+	l.finish(w, r, payload.ID)
+}
+
+// renderPasskeysPage lists the passkeys of the user signed in to the
+// browser's session, who can register new ones and delete old ones there.
+func (l *Login) renderPasskeysPage(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		SignedIn bool
+		Username string
+		Passkeys []passkeyView
+	}{}
+
+	session, ok := l.sessions.current(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if user := l.storage.UserByID(session.UserID); user != nil {
+		passkeys, err := l.storage.Passkeys(r.Context(), session.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.SignedIn = true
+		data.Username = user.Username
+		for _, passkey := range passkeys {
+			view := passkeyView{
+				ID:        passkey.ID,
+				CreatedAt: passkey.CreatedAt.Local().Format(time.DateTime),
+				Synced:    passkey.BackupEligible,
+			}
+			if !passkey.LastUsedAt.IsZero() {
+				view.LastUsedAt = passkey.LastUsedAt.Local().Format(time.DateTime)
+			}
+			data.Passkeys = append(data.Passkeys, view)
+		}
+	}
+
+	if err := templates.ExecuteTemplate(w, "passkeys", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// passkeyCreationOptionsHandler starts registering a passkey for the user of
+// the browser's session.
+func (l *Login) passkeyCreationOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := l.sessions.current(r)
+	if !ok {
+		writeJSONErrorCode(w, http.StatusUnauthorized, "login_required", "sign-in is required")
+		return
+	}
+	user := l.storage.UserByID(session.UserID)
+	if user == nil {
+		writeJSONErrorCode(w, http.StatusUnauthorized, "login_required", "sign-in is required")
+		return
+	}
+	passkeys, err := l.storage.Passkeys(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load passkeys")
+		return
+	}
+	exclude := make([][]byte, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		if id, err := base64.RawURLEncoding.DecodeString(passkey.ID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	challenge, err := l.startCeremony(r, &storage.WebAuthnChallenge{UserID: user.ID})
+	if err != nil {
+		slog.Error("failed to start passkey registration", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to start passkey registration")
+		return
+	}
+	writeJSON(w, http.StatusOK, l.rp.CreationOptions(challenge, webauthn.User{
+		ID:          user.ID,
+		Name:        user.Username,
+		DisplayName: user.FirstName + " " + user.LastName,
+	}, exclude, false))
+}
+
+// registerPasskeyHandler verifies a new credential and stores it as a
+// passkey of the session's user.
+func (l *Login) registerPasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := l.sessions.current(r)
+	if !ok {
+		writeJSONErrorCode(w, http.StatusUnauthorized, "login_required", "sign-in is required")
+		return
+	}
+	var credential webauthn.RegistrationResponse
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	stored, challenge, ok := l.takeCeremony(r, credential.Response.ClientDataJSON)
+	if !ok || stored.UserID != session.UserID {
+		writeJSONErrorCode(w, http.StatusBadRequest, "passkey_expired", "passkey registration has expired")
+		return
+	}
+	created, err := l.rp.VerifyRegistration(&credential, challenge, stored.RequireUserVerification)
+	if err != nil {
+		slog.Error("passkey registration failed", "user", session.UserID, "error", err)
+		writeJSONErrorCode(w, http.StatusBadRequest, "invalid_passkey", "passkey could not be verified")
+		return
+	}
+
+	err = l.storage.AddPasskey(r.Context(), &storage.Passkey{
+		ID:             base64.RawURLEncoding.EncodeToString(created.ID),
+		UserID:         session.UserID,
+		PublicKey:      created.PublicKey,
+		SignCount:      created.SignCount,
+		BackupEligible: created.BackupEligible,
+		Transports:     created.Transports,
+		CreatedAt:      time.Now(),
+	})
+	switch {
+	case errors.Is(err, storage.ErrPasskeyExists):
+		writeJSONErrorCode(w, http.StatusConflict, "passkey_exists", "passkey is already registered")
+		return
+	case err != nil:
+		slog.Error("failed to store passkey", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to store passkey")
+		return
+	}
+	slog.Info("passkey registered", "user", session.UserID)
+	writeJSON(w, http.StatusCreated, struct {
+		Next string `json:"next"`
+	}{Next: pathPasskeys})
+}
+
+// deletePasskeyHandler removes one of the session user's passkeys.
+func (l *Login) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := l.sessions.current(r)
+	if !ok {
+		http.Redirect(w, r, pathPasskeys, http.StatusSeeOther)
+		return
+	}
+	if err := l.storage.DeletePasskey(r.Context(), session.UserID, r.PostFormValue("id")); err != nil {
+		slog.Error("failed to delete passkey", "error", err)
+	}
+	http.Redirect(w, r, pathPasskeys, http.StatusSeeOther)
+}
+
+// startCeremony stores a new challenge for the ceremony and returns it.
+func (l *Login) startCeremony(r *http.Request, ceremony *storage.WebAuthnChallenge) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	ceremony.Challenge = challenge
+	ceremony.Expiration = time.Now().Add(webauthn.Timeout)
+	if err := l.storage.SaveWebAuthnChallenge(r.Context(), ceremony); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// takeCeremony looks up the ceremony by the challenge the browser signed
+// and consumes it.
+func (l *Login) takeCeremony(r *http.Request, clientDataJSON []byte) (*storage.WebAuthnChallenge, string, bool) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return nil, "", false
+	}
+	stored, err := l.storage.TakeWebAuthnChallenge(r.Context(), challenge)
+	if err != nil {
+		return nil, "", false
+	}
+	return stored, challenge, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
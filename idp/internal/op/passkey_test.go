@@ -0,0 +1,465 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/password"
+	"idp/internal/storage"
+	"idp/internal/webauthn"
+	"idp/internal/webauthn/webauthntest"
+)
+
+const testClients = `[
+  {
+    "id": "web-app",
+    "type": "web",
+    "secret": "web-secret",
+    "redirect_uris": ["https://app.example/callback"],
+    "first_party": true
+  },
+  {
+    "id": "mfa-app",
+    "type": "web",
+    "secret": "mfa-secret",
+    "redirect_uris": ["https://mfa.example/callback"],
+    "first_party": true,
+    "require_mfa": true
+  }
+]`
+
+const testPassword = "user1-password"
+
+// newTestStorage returns a storage on the memory backend with the clients
+// above and user1 with testPassword.
+func newTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	dir := t.TempDir()
+	hasher, err := password.NewHasher(config.PasswordsConfig{Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := json.Marshal([]data.UserRecord{{ID: "user-1", Username: "user1", Password: hash, FirstName: "User", LastName: "One"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), users, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "clients.json"), []byte(testClients), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	userStore, err := data.LoadUserStore(filepath.Join(dir, "users.json"), hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := data.LoadClients(filepath.Join(dir, "clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return storage.New(storage.NewMemoryBackend(), clients, userStore, nil, config.Default().Provider.Lifetimes, logger)
+}
+
+// passkeyTest serves the login pages and holds a software authenticator
+// with a passkey registered for user1.
+type passkeyTest struct {
+	t             *testing.T
+	storage       *storage.Storage
+	server        *httptest.Server
+	authenticator *webauthntest.Authenticator
+}
+
+func newPasskeyTest(t *testing.T) *passkeyTest {
+	t.Helper()
+	s := newTestStorage(t)
+	var cryptoKey [32]byte
+	rp := &webauthn.RelyingParty{ID: "localhost", Name: "IdP"}
+	throttle, err := newLoginThrottle(s, config.Default().Login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt := &passkeyTest{t: t, storage: s}
+	issuer := func(*http.Request) string { return pt.server.URL }
+	l := NewLogin(
+		s,
+		newSessions(s, nil, cryptoKey, "http://localhost", time.Hour),
+		op.NewIssuerInterceptor(issuer),
+		func(_ context.Context, id string) string { return "/authorize/callback?id=" + id },
+		nil,
+		rp,
+		throttle,
+		newLoginCSRF(cryptoKey, "http://localhost"),
+	)
+	router := chi.NewRouter()
+	router.Mount("/login", l.Router())
+	pt.server = httptest.NewServer(router)
+	t.Cleanup(pt.server.Close)
+
+	rp.Origins = []string{pt.server.URL}
+	pt.authenticator = webauthntest.New(rp.ID, pt.server.URL)
+	if status, body := pt.register(pt.signInWithPassword(), pt.authenticator); status != http.StatusCreated {
+		t.Fatalf("registration: %d %v", status, body)
+	}
+	return pt
+}
+
+// browser returns a client with its own cookies that does not follow
+// redirects.
+func (pt *passkeyTest) browser() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// authRequest starts an auth request of the client.
+func (pt *passkeyTest) authRequest(clientID, redirectURI string) string {
+	pt.t.Helper()
+	request, err := pt.storage.CreateAuthRequest(context.Background(), &oidc.AuthRequest{
+		ClientID:     clientID,
+		RedirectURI:  redirectURI,
+		Scopes:       oidc.SpaceDelimitedArray{oidc.ScopeOpenID},
+		ResponseType: oidc.ResponseTypeCode,
+	}, "")
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return request.GetID()
+}
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// csrfToken renders the sign-in page for the auth request in the browser
+// and returns the token of its form.
+func (pt *passkeyTest) csrfToken(browser *http.Client, id string) string {
+	pt.t.Helper()
+	response, err := browser.Get(pt.server.URL + loginURL(id))
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	page, err := io.ReadAll(response.Body)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	match := csrfTokenPattern.FindSubmatch(page)
+	if match == nil {
+		pt.t.Fatalf("sign-in page has no csrf token: status %d", response.StatusCode)
+	}
+	return string(match[1])
+}
+
+// post sends the payload as JSON, or as is if it is already encoded, and
+// decodes the JSON response.
+func (pt *passkeyTest) post(browser *http.Client, path string, payload any) (int, map[string]any) {
+	pt.t.Helper()
+	body, ok := payload.([]byte)
+	if !ok {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			pt.t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(http.MethodPost, pt.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := browser.Do(request)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var decoded map[string]any
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		pt.t.Fatalf("POST %s: status %d, invalid JSON: %v", path, response.StatusCode, err)
+	}
+	return response.StatusCode, decoded
+}
+
+// signInWithPassword returns a browser with a session of user1.
+func (pt *passkeyTest) signInWithPassword() *http.Client {
+	pt.t.Helper()
+	browser := pt.browser()
+	id := pt.authRequest("web-app", "https://app.example/callback")
+	status, body := pt.post(browser, pathLogin, map[string]string{
+		"id":         id,
+		"username":   "user1",
+		"password":   testPassword,
+		"csrf_token": pt.csrfToken(browser, id),
+	})
+	if status != http.StatusOK {
+		pt.t.Fatalf("password sign-in: %d %v", status, body)
+	}
+	return browser
+}
+
+// register runs the registration ceremony in the signed in browser.
+func (pt *passkeyTest) register(browser *http.Client, authenticator *webauthntest.Authenticator) (int, map[string]any) {
+	pt.t.Helper()
+	status, options := pt.post(browser, "/login/passkeys/options", struct{}{})
+	if status != http.StatusOK {
+		return status, options
+	}
+	challenge := options["challenge"].(string)
+	userID, err := base64.RawURLEncoding.DecodeString(options["user"].(map[string]any)["id"].(string))
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return pt.post(browser, pathPasskeys, authenticator.Create(challenge, userID))
+}
+
+type passkeySignIn struct {
+	browser *http.Client
+	id      string
+	payload []byte
+	status  int
+	body    map[string]any
+}
+
+// signIn runs a passkey sign-in for the client in a new browser. prepare
+// may change the authenticator and the payload before it is sent.
+func (pt *passkeyTest) signIn(clientID, redirectURI string, prepare func(*webauthntest.Authenticator, map[string]any)) *passkeySignIn {
+	pt.t.Helper()
+	browser := pt.browser()
+	id := pt.authRequest(clientID, redirectURI)
+	token := pt.csrfToken(browser, id)
+	status, options := pt.post(browser, "/login/passkey/options", map[string]string{"id": id})
+	if status != http.StatusOK {
+		pt.t.Fatalf("passkey options: %d %v", status, options)
+	}
+
+	payload := map[string]any{"id": id, "csrf_token": token}
+	authenticator := *pt.authenticator
+	if prepare != nil {
+		prepare(&authenticator, payload)
+	}
+	payload["credential"] = json.RawMessage(authenticator.Get(options["challenge"].(string)))
+	pt.authenticator.SignCount = authenticator.SignCount
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	status, body := pt.post(browser, "/login/passkey", raw)
+	return &passkeySignIn{browser: browser, id: id, payload: raw, status: status, body: body}
+}
+
+func (pt *passkeyTest) authenticated(id string) *storage.AuthRequest {
+	pt.t.Helper()
+	request, err := pt.storage.AuthRequestByID(context.Background(), id)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return request.(*storage.AuthRequest)
+}
+
+func TestPasskeySignIn(t *testing.T) {
+	pt := newPasskeyTest(t)
+
+	result := pt.signIn("web-app", "https://app.example/callback", nil)
+	if result.status != http.StatusOK {
+		t.Fatalf("sign-in: %d %v", result.status, result.body)
+	}
+	if next, _ := result.body["next"].(string); !strings.HasPrefix(next, "/authorize/callback?id=") {
+		t.Errorf("next = %q, want the authorize callback", next)
+	}
+	request := pt.authenticated(result.id)
+	if !request.Authenticated || request.UserID != "user-1" {
+		t.Errorf("auth request = %+v, want authenticated for user-1", request)
+	}
+	if want := []string{"hwk", "user", "mfa"}; strings.Join(request.AMR, " ") != strings.Join(want, " ") {
+		t.Errorf("amr = %v, want %v", request.AMR, want)
+	}
+
+	passkey, err := pt.storage.PasskeyByID(context.Background(), base64.RawURLEncoding.EncodeToString(pt.authenticator.CredentialID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passkey.SignCount != 1 || passkey.LastUsedAt.IsZero() {
+		t.Errorf("passkey = %+v, want sign count 1 and last use recorded", passkey)
+	}
+}
+
+func TestPasskeySignInRejectsReplay(t *testing.T) {
+	pt := newPasskeyTest(t)
+	result := pt.signIn("web-app", "https://app.example/callback", nil)
+	if result.status != http.StatusOK {
+		t.Fatalf("sign-in: %d %v", result.status, result.body)
+	}
+
+	// the challenge was consumed by the first sign-in
+	status, body := pt.post(result.browser, "/login/passkey", result.payload)
+	if status != http.StatusBadRequest || body["code"] != "passkey_expired" {
+		t.Fatalf("replay = %d %v, want 400 passkey_expired", status, body)
+	}
+}
+
+func TestPasskeySignInRejectsCounterGoingBackwards(t *testing.T) {
+	pt := newPasskeyTest(t)
+	for range 2 {
+		if result := pt.signIn("web-app", "https://app.example/callback", nil); result.status != http.StatusOK {
+			t.Fatalf("sign-in: %d %v", result.status, result.body)
+		}
+	}
+
+	// a clone of the authenticator that lags behind the original
+	result := pt.signIn("web-app", "https://app.example/callback", func(a *webauthntest.Authenticator, _ map[string]any) {
+		a.SignCount = 0
+	})
+	if result.status != http.StatusUnauthorized || result.body["code"] != "invalid_passkey" {
+		t.Fatalf("sign-in = %d %v, want 401 invalid_passkey", result.status, result.body)
+	}
+	if pt.authenticated(result.id).Authenticated {
+		t.Fatal("auth request was authenticated")
+	}
+}
+
+func TestPasskeySignInRequiresUserVerification(t *testing.T) {
+	pt := newPasskeyTest(t)
+
+	result := pt.signIn("mfa-app", "https://mfa.example/callback", func(a *webauthntest.Authenticator, _ map[string]any) {
+		a.UserVerified = false
+	})
+	if result.status != http.StatusUnauthorized || result.body["code"] != "invalid_passkey" {
+		t.Fatalf("sign-in without user verification = %d %v, want 401 invalid_passkey", result.status, result.body)
+	}
+	if pt.authenticated(result.id).Authenticated {
+		t.Fatal("auth request was authenticated")
+	}
+
+	result = pt.signIn("mfa-app", "https://mfa.example/callback", nil)
+	if result.status != http.StatusOK {
+		t.Fatalf("sign-in with user verification = %d %v", result.status, result.body)
+	}
+
+	// clients without the requirement take a passkey that only saw the user
+	result = pt.signIn("web-app", "https://app.example/callback", func(a *webauthntest.Authenticator, _ map[string]any) {
+		a.UserVerified = false
+	})
+	if result.status != http.StatusOK {
+		t.Fatalf("sign-in without user verification = %d %v", result.status, result.body)
+	}
+	if amr := pt.authenticated(result.id).AMR; strings.Join(amr, " ") != "hwk user" {
+		t.Errorf("amr = %v, want [hwk user]", amr)
+	}
+}
+
+func TestPasskeySignInRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(*webauthntest.Authenticator, map[string]any)
+		status  int
+		code    string
+	}{
+		{
+			name:    "bad origin",
+			prepare: func(a *webauthntest.Authenticator, _ map[string]any) { a.Origin = "https://evil.example" },
+			status:  http.StatusUnauthorized,
+			code:    "invalid_passkey",
+		},
+		{
+			name:    "wrong rpIdHash",
+			prepare: func(a *webauthntest.Authenticator, _ map[string]any) { a.RPID = "evil.example" },
+			status:  http.StatusUnauthorized,
+			code:    "invalid_passkey",
+		},
+		{
+			name: "unregistered credential",
+			prepare: func(a *webauthntest.Authenticator, _ map[string]any) {
+				*a = *webauthntest.New(a.RPID, a.Origin)
+			},
+			status: http.StatusUnauthorized,
+			code:   "unknown_passkey",
+		},
+		{
+			name:    "user handle of another user",
+			prepare: func(a *webauthntest.Authenticator, _ map[string]any) { a.UserHandle = []byte("user-2") },
+			status:  http.StatusUnauthorized,
+			code:    "unknown_passkey",
+		},
+		{
+			name:    "missing csrf token",
+			prepare: func(_ *webauthntest.Authenticator, payload map[string]any) { delete(payload, "csrf_token") },
+			status:  http.StatusForbidden,
+			code:    "invalid_csrf_token",
+		},
+		{
+			name:    "registration client data",
+			prepare: func(a *webauthntest.Authenticator, _ map[string]any) { a.Type = "webauthn.create" },
+			status:  http.StatusUnauthorized,
+			code:    "invalid_passkey",
+		},
+	}
+	pt := newPasskeyTest(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := pt.signIn("web-app", "https://app.example/callback", test.prepare)
+			if result.status != test.status || result.body["code"] != test.code {
+				t.Fatalf("sign-in = %d %v, want %d %s", result.status, result.body, test.status, test.code)
+			}
+			if pt.authenticated(result.id).Authenticated {
+				t.Fatal("auth request was authenticated")
+			}
+		})
+	}
+}
+
+func TestPasskeyRegistrationRejects(t *testing.T) {
+	pt := newPasskeyTest(t)
+	browser := pt.signInWithPassword()
+
+	if status, body := pt.register(browser, pt.authenticator); status != http.StatusConflict || body["code"] != "passkey_exists" {
+		t.Errorf("registering again = %d %v, want 409 passkey_exists", status, body)
+	}
+
+	other := webauthntest.New("localhost", "https://evil.example")
+	if status, body := pt.register(browser, other); status != http.StatusBadRequest || body["code"] != "invalid_passkey" {
+		t.Errorf("registering from another origin = %d %v, want 400 invalid_passkey", status, body)
+	}
+
+	other = webauthntest.New("localhost", pt.server.URL)
+	if status, body := pt.register(pt.browser(), other); status != http.StatusUnauthorized || body["code"] != "login_required" {
+		t.Errorf("registering without a session = %d %v, want 401 login_required", status, body)
+	}
+
+	passkeys, err := pt.storage.Passkeys(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 {
+		t.Fatalf("user has %d passkeys, want 1", len(passkeys))
+	}
+}
@@ -8,12 +8,17 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/zitadel/logging"
-	"github.com/zitadel/oidc/v3/example/server/storage"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
 	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/storage"
+	"idp/internal/webauthn"
 )
 
 func NewRouter(
-	issuer string,
+	cfg config.Config,
+	cryptoKey [32]byte,
 	storage *storage.Storage,
 	logger *slog.Logger,
 ) chi.Router {
@@ -28,17 +33,57 @@ func NewRouter(
 	provider, err := NewOpenIDProvider(
 		logger,
 		storage,
-		issuer,
+		cfg,
+		cryptoKey,
 	)
 	if err != nil {
 		slog.Error("failed to create openid provider", "error", err)
 		os.Exit(1)
 	}
 
-	l := NewLogin(storage, op.NewIssuerInterceptor(provider.IssuerFromRequest), op.AuthCallbackURL(provider))
+	router.Get(pathLoggedOut, loggedOutHandler)
+
+	logout := newBackchannelLogout(storage, cfg.Issuer, logger)
+	sessions := newSessions(storage, logout, cryptoKey, cfg.Issuer, cfg.Provider.Lifetimes.Session)
+
+	issuerInterceptor := op.NewIssuerInterceptor(provider.IssuerFromRequest)
+	rp := &webauthn.RelyingParty{ID: cfg.WebAuthn.RPID, Name: cfg.WebAuthn.RPName, Origins: cfg.WebAuthn.Origins}
+	throttle, err := newLoginThrottle(storage, cfg.Login)
+	if err != nil {
+		slog.Error("failed to set up login throttling", "error", err)
+		os.Exit(1)
+	}
+	csrf := newLoginCSRF(cryptoKey, cfg.Issuer)
+	l := NewLogin(storage, sessions, issuerInterceptor, op.AuthCallbackURL(provider), provider, rp, throttle, csrf)
 	router.Mount("/login", http.StripPrefix("/login", l.Router()))
 
-	handler := http.Handler(provider)
+	if cfg.Provider.GrantTypeEnabled(oidc.GrantTypeDeviceCode) {
+		d := NewDeviceLogin(storage, provider.DeviceAuthorization(), cryptoKey, cfg.Issuer, throttle, csrf.forPath(pathDevice))
+		router.Mount(pathDevice, http.StripPrefix(pathDevice, d.Router()))
+	}
+
+	admin := NewAdmin(storage, provider)
+	router.Mount(pathAdmin, http.StripPrefix(pathAdmin, issuerInterceptor.Handler(admin.Router())))
+
+	features := newFeatures(cfg.Provider, cfg.TLS.ClientCertificates(), provider)
+	requestObjects := newRequestObjects(storage, cfg.Issuer, cfg.Provider.RequestObjectSupported, provider.AuthorizationEndpoint().Relative())
+	par := newPushedAuthorization(storage, provider, requestObjects)
+	assertions := newClientAssertions(storage, cfg.Provider, cfg.Issuer, provider)
+	mtls, err := newMutualTLS(storage, cfg, provider)
+	if err != nil {
+		slog.Error("failed to set up mutual TLS", "error", err)
+		os.Exit(1)
+	}
+	router.Post(pathPAR, issuerInterceptor.Handler(assertions.Handler(mtls.Handler(features.Handler(par)))).ServeHTTP)
+
+	handler := features.Handler(provider)
+	handler = par.Handler(handler)
+	handler = requestObjects.Handler(handler)
+	handler = newIntrospectionJWT(storage, cfg.Issuer, provider.IntrospectionEndpoint().Relative()).Handler(handler)
+	handler = newDPoPProofs(storage, cfg.Issuer, cfg.Provider.DPoPNonceRequired, cryptoKey, provider).Handler(handler)
+	handler = mtls.Handler(handler)
+	handler = assertions.Handler(handler)
+	handler = sessions.EndSessionHandler(provider.EndSessionEndpoint().Relative(), handler)
 	router.Mount("/", handler)
 
 	return router
@@ -0,0 +1,173 @@
+package op
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	"idp/internal/storage"
+)
+
+const sessionCookieName = "idp_session"
+
+// sessions ties the SSO session records in storage to the browser through an
+// authenticated and encrypted cookie that holds only the session id.
+type sessions struct {
+	storage *storage.Storage
+	logout  *backchannelLogout
+	codec   *securecookie.SecureCookie
+	issuer  string
+	secure  bool
+}
+
+// newSessions derives the cookie keys from the provider's crypto key, so
+// sessions survive restarts but not a key change.
+func newSessions(storage *storage.Storage, logout *backchannelLogout, cryptoKey [32]byte, issuer string, lifetime time.Duration) *sessions {
+	hashKey := sha256.Sum256(append([]byte("idp session cookie\x00"), cryptoKey[:]...))
+	codec := securecookie.New(hashKey[:], cryptoKey[:])
+	codec.MaxAge(int(lifetime.Seconds()))
+
+	return &sessions{
+		storage: storage,
+		logout:  logout,
+		codec:   codec,
+		issuer:  issuer,
+		secure:  strings.HasPrefix(issuer, "https://"),
+	}
+}
+
+// current returns the browser's session if it is still valid.
+func (s *sessions) current(r *http.Request) (*storage.Session, bool) {
+	id, ok := s.sessionID(r)
+	if !ok {
+		return nil, false
+	}
+	session, err := s.storage.SessionByID(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("failed to load session", "error", err)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+// start records the sign-in through the auth request in the browser's
+// session. Signing in as another user ends the previous session.
+func (s *sessions) start(w http.ResponseWriter, r *http.Request, authRequestID string) error {
+	previousID, _ := s.sessionID(r)
+	session, ended, err := s.storage.CreateSession(r.Context(), authRequestID, previousID)
+	if err != nil {
+		return err
+	}
+	if ended != nil {
+		s.logout.notify(ended)
+	}
+
+	encoded, err := s.codec.Encode(sessionCookieName, session.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    encoded,
+		Path:     "/",
+		Expires:  session.Expiration,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// end deletes the browser's session and its cookie, notifies the clients
+// that took part in it over the back-channel and returns it, or nil if the
+// browser had none.
+func (s *sessions) end(w http.ResponseWriter, r *http.Request) *storage.Session {
+	var session *storage.Session
+	if id, ok := s.sessionID(r); ok {
+		var err error
+		session, err = s.storage.EndSession(r.Context(), id)
+		if err != nil {
+			slog.Error("failed to delete session", "error", err)
+		}
+		if session != nil {
+			s.logout.notify(session)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session
+}
+
+func (s *sessions) sessionID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	var id string
+	if err := s.codec.Decode(sessionCookieName, cookie.Value, &id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// EndSessionHandler ends the browser's session once the provider accepted
+// an end_session request, which it signals by redirecting. When clients of
+// the session take front-channel notifications, the redirect is replaced by
+// a page that loads them first.
+func (s *sessions) EndSessionHandler(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&endSessionWriter{ResponseWriter: w, r: r, sessions: s}, r)
+	})
+}
+
+type endSessionWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	sessions *sessions
+	replaced bool
+}
+
+func (w *endSessionWriter) WriteHeader(status int) {
+	if status != http.StatusFound {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	session := w.sessions.end(w.ResponseWriter, w.r)
+	if session != nil {
+		if uris := frontchannelURIs(w.sessions.storage, w.sessions.issuer, session); len(uris) > 0 {
+			next := w.Header().Get("Location")
+			w.Header().Del("Location")
+			w.replaced = true
+			renderFrontchannelLogout(w.ResponseWriter, next, uris)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write drops the body of the redirect that the logout page replaced.
+func (w *endSessionWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,146 @@
+package op
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"idp/internal/config"
+	"idp/internal/storage"
+)
+
+// proxies are the reverse proxies whose forwarded headers are trusted.
+type proxies []netip.Prefix
+
+func parseProxies(list []string) (proxies, error) {
+	prefixes := make(proxies, 0, len(list))
+	for _, proxy := range list {
+		prefix, err := config.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (p proxies) contains(addr netip.Addr) bool {
+	return slices.ContainsFunc(p, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// remoteAddr is the address the request came from, which may be a proxy.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// clientAddr is the address of the client that sent the request. Behind
+// trusted proxies it is the rightmost X-Forwarded-For hop that is not a
+// proxy itself; the hops left of it are whatever the client claimed.
+func (p proxies) clientAddr(r *http.Request) netip.Addr {
+	addr, ok := remoteAddr(r)
+	if !ok || !p.contains(addr) {
+		return addr
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for _, hop := range slices.Backward(hops) {
+		forwarded, err := netip.ParseAddr(strings.TrimSpace(hop))
+		if err != nil {
+			break
+		}
+		addr = forwarded.Unmap()
+		if !p.contains(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// loginThrottle slows down password guessing against a username or from a
+// client address, see config.LoginConfig.
+type loginThrottle struct {
+	storage *storage.Storage
+	cfg     config.LoginConfig
+	proxies proxies
+}
+
+func newLoginThrottle(storage *storage.Storage, cfg config.LoginConfig) (*loginThrottle, error) {
+	proxies, err := parseProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	return &loginThrottle{
+		storage: storage,
+		cfg:     cfg,
+		proxies: proxies,
+	}, nil
+}
+
+// begin counts a password attempt for username and returns how long the
+// client has to wait before it may try, zero if it may go ahead.
+func (t *loginThrottle) begin(r *http.Request, username string) (time.Duration, error) {
+	return t.storage.BeginLogin(r.Context(), username, t.addrKey(r), t.cfg)
+}
+
+// beginSecondFactor counts a one-time password for username the way begin
+// counts a password.
+func (t *loginThrottle) beginSecondFactor(r *http.Request, username string) (time.Duration, error) {
+	return t.storage.BeginSecondFactor(r.Context(), username, t.cfg)
+}
+
+// succeeded takes the attempts back once the whole sign-in completed, with
+// the second factor if the user has one.
+func (t *loginThrottle) succeeded(r *http.Request, username string) {
+	if err := t.storage.LoginSucceeded(r.Context(), username, t.addrKey(r), t.cfg); err != nil {
+		slog.Error("failed to reset login failures", "error", err)
+	}
+}
+
+// beginUserCode counts a device user code entered by the client the way
+// begin counts a password.
+func (t *loginThrottle) beginUserCode(r *http.Request) (time.Duration, error) {
+	return t.storage.BeginUserCodeLookup(r.Context(), t.addrKey(r), t.cfg)
+}
+
+// userCodeFound takes the attempt back once the code matched a pending
+// authorization.
+func (t *loginThrottle) userCodeFound(r *http.Request) {
+	if err := t.storage.UserCodeFound(r.Context(), t.addrKey(r), t.cfg); err != nil {
+		slog.Error("failed to reset user code failures", "error", err)
+	}
+}
+
+// addrKey counts IPv6 clients by their /64, which usually belongs to one
+// host or network.
+func (t *loginThrottle) addrKey(r *http.Request) string {
+	addr := t.proxies.clientAddr(r)
+	if addr.Is6() {
+		return netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	return addr.String()
+}
+
+// setRetryAfter sets the Retry-After header of a 429 response.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+}
+
+// retryAfterSeconds rounds wait up to whole seconds.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
@@ -0,0 +1,105 @@
+package op
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := parseProxies([]string{"10.1.2.3/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.200.0.1": true, "192.0.2.1": true, "192.0.2.2": false} {
+		if got := proxies.contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("contains(%s) = %t, want %t", addr, got, want)
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.example", ""} {
+		if _, err := parseProxies([]string{invalid}); err == nil {
+			t.Errorf("parseProxies accepted %q", invalid)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"forwarded header of an untrusted peer is ignored", "198.51.100.7:1234", []string{"203.0.113.5"}, "198.51.100.7"},
+		{"proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"proxy", "10.0.0.1:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"hops claimed by the client are skipped", "10.0.0.1:1234", []string{"192.0.2.66, 203.0.113.5"}, "203.0.113.5"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"192.0.2.66, 203.0.113.5, 10.0.0.2"}, "203.0.113.5"},
+		{"chain across headers", "10.0.0.1:1234", []string{"192.0.2.66", "203.0.113.5, 10.0.0.2"}, "203.0.113.5"},
+		{"spoofed proxy address left of the client", "10.0.0.1:1234", []string{"10.0.0.3, 203.0.113.5"}, "203.0.113.5"},
+		{"garbage claimed by the client", "10.0.0.1:1234", []string{"garbage, 203.0.113.5"}, "203.0.113.5"},
+		{"unparsable hop stops the walk", "10.0.0.1:1234", []string{"203.0.113.5, unknown"}, "10.0.0.1"},
+		{"empty hop stops the walk", "10.0.0.1:1234", []string{"203.0.113.5, "}, "10.0.0.1"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"spaces around hops", "10.0.0.1:1234", []string{" 203.0.113.5 ,10.0.0.2"}, "203.0.113.5"},
+		{"IPv4-mapped addresses", "[::ffff:10.0.0.1]:1234", []string{"::ffff:203.0.113.5"}, "203.0.113.5"},
+		{"IPv6 proxy and client", "[fd00::1]:1234", []string{"2001:db8::5, fd00::2"}, "2001:db8::5"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login/username", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := proxies.clientAddr(r).String(); got != test.want {
+			t.Errorf("%s: clientAddr = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientAddrWithoutProxies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/login/username", nil)
+	r.RemoteAddr = "198.51.100.7:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if got := proxies(nil).clientAddr(r).String(); got != "198.51.100.7" {
+		t.Fatalf("clientAddr = %s, want the peer address", got)
+	}
+}
+
+func TestAddrKey(t *testing.T) {
+	throttle := &loginThrottle{}
+	tests := map[string]string{
+		"198.51.100.7:1234":           "198.51.100.7",
+		"[2001:db8:1:2:3:4:5:6]:1234": "2001:db8:1:2::/64",
+		"[::ffff:198.51.100.7]:1234":  "198.51.100.7",
+	}
+	for remoteAddr, want := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login/username", nil)
+		r.RemoteAddr = remoteAddr
+		if got := throttle.addrKey(r); got != want {
+			t.Errorf("addrKey(%s) = %s, want %s", remoteAddr, got, want)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := map[time.Duration]int{
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		time.Millisecond:        1,
+		time.Minute:             60,
+	}
+	for wait, want := range tests {
+		if got := retryAfterSeconds(wait); got != want {
+			t.Errorf("retryAfterSeconds(%v) = %d, want %d", wait, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package password hashes and verifies user passwords stored in PHC string
+// format. New hashes use argon2id; bcrypt hashes are accepted for
+// verification and upgraded on the next successful login.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"idp/internal/config"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+var (
+	// ErrPlaintext is returned for passwords that are not hashed while
+	// plaintext passwords are not allowed.
+	ErrPlaintext = errors.New("plaintext passwords are not allowed, set IDP_ALLOW_PLAINTEXT_PASSWORDS=true for development")
+
+	errMismatch = errors.New("password mismatch")
+
+	b64 = base64.RawStdEncoding
+)
+
+// Hasher creates argon2id hashes with the configured parameters and verifies
+// argon2id, bcrypt and, when allowed, plaintext passwords.
+type Hasher struct {
+	params         argon2Params
+	allowPlaintext bool
+	// dummy is verified when the user does not exist so that unknown and
+	// known usernames take the same time to reject
+	dummy string
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+func NewHasher(cfg config.PasswordsConfig) (*Hasher, error) {
+	if cfg.Argon2Memory < 8*uint32(cfg.Argon2Parallelism) || cfg.Argon2Iterations == 0 || cfg.Argon2Parallelism == 0 {
+		return nil, fmt.Errorf("invalid argon2 parameters: memory=%d iterations=%d parallelism=%d",
+			cfg.Argon2Memory, cfg.Argon2Iterations, cfg.Argon2Parallelism)
+	}
+
+	h := &Hasher{
+		params: argon2Params{
+			memory:      cfg.Argon2Memory,
+			iterations:  cfg.Argon2Iterations,
+			parallelism: cfg.Argon2Parallelism,
+			saltLength:  saltLength,
+			keyLength:   keyLength,
+		},
+		allowPlaintext: cfg.AllowPlaintext,
+	}
+
+	dummy, err := h.Hash("")
+	if err != nil {
+		return nil, err
+	}
+	h.dummy = dummy
+	return h, nil
+}
+
+// Hash returns the argon2id PHC string for the password.
+func (h *Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	p := h.params
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.iterations, p.parallelism, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Check reports whether the stored value can be verified by this hasher.
+func (h *Hasher) Check(encoded string) error {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		_, _, _, err := decodeArgon2id(encoded)
+		return err
+	case isBcrypt(encoded):
+		_, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return nil
+	case strings.HasPrefix(encoded, "$"):
+		return fmt.Errorf("unsupported password hash %q", phcID(encoded))
+	case !h.allowPlaintext:
+		return ErrPlaintext
+	default:
+		return nil
+	}
+}
+
+// Verify compares the password against the stored value. rehash is true when
+// the password matched but the stored value should be replaced by a fresh
+// hash, i.e. it is a bcrypt hash or uses weaker argon2id parameters.
+func (h *Hasher) Verify(encoded, password string) (rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		actual := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, params.keyLength)
+		if subtle.ConstantTimeCompare(key, actual) != 1 {
+			return false, errMismatch
+		}
+		return h.weaker(params), nil
+	case isBcrypt(encoded):
+		if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)); err != nil {
+			return false, errMismatch
+		}
+		return true, nil
+	case strings.HasPrefix(encoded, "$"):
+		return false, fmt.Errorf("unsupported password hash %q", phcID(encoded))
+	case !h.allowPlaintext:
+		return false, ErrPlaintext
+	default:
+		if subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) != 1 {
+			return false, errMismatch
+		}
+		return false, nil
+	}
+}
+
+// VerifyDummy burns the time of a regular verification.
+func (h *Hasher) VerifyDummy(password string) {
+	_, _ = h.Verify(h.dummy, password)
+}
+
+func (h *Hasher) weaker(p argon2Params) bool {
+	return p.memory < h.params.memory ||
+		p.iterations < h.params.iterations ||
+		p.parallelism < h.params.parallelism ||
+		p.keyLength < h.params.keyLength ||
+		p.saltLength < h.params.saltLength
+}
+
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return argon2Params{}, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return argon2Params{}, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	if p.iterations == 0 || p.parallelism == 0 {
+		return argon2Params{}, nil, nil, errors.New("invalid argon2id parameters")
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if len(key) == 0 {
+		return argon2Params{}, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	p.saltLength = len(salt)
+	p.keyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+func isBcrypt(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func phcID(encoded string) string {
+	id, _, _ := strings.Cut(strings.TrimPrefix(encoded, "$"), "$")
+	return id
+}
@@ -0,0 +1,185 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"idp/internal/config"
+)
+
+func newTestHasher(t *testing.T, memory, iterations uint32, allowPlaintext bool) *Hasher {
+	t.Helper()
+	h, err := NewHasher(config.PasswordsConfig{
+		Argon2Memory:      memory,
+		Argon2Iterations:  iterations,
+		Argon2Parallelism: 1,
+		AllowPlaintext:    allowPlaintext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestNewHasherRejectsInvalidParameters(t *testing.T) {
+	for _, cfg := range []config.PasswordsConfig{
+		{Argon2Memory: 64, Argon2Iterations: 0, Argon2Parallelism: 1},
+		{Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 0},
+		{Argon2Memory: 15, Argon2Iterations: 1, Argon2Parallelism: 2},
+	} {
+		if _, err := NewHasher(cfg); err == nil {
+			t.Errorf("NewHasher(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	h := newTestHasher(t, 64, 2, false)
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=2,p=1$") {
+		t.Errorf("hash = %s, want argon2id with the configured parameters", hash)
+	}
+	if other, _ := h.Hash("correct horse"); other == hash {
+		t.Error("two hashes of the same password share a salt")
+	}
+	if err := h.Check(hash); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	if rehash, err := h.Verify(hash, "correct horse"); err != nil || rehash {
+		t.Errorf("Verify = %t, %v, want a match without rehash", rehash, err)
+	}
+	if _, err := h.Verify(hash, "correct horse "); !errors.Is(err, errMismatch) {
+		t.Errorf("Verify(wrong password) = %v, want %v", err, errMismatch)
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	h := newTestHasher(t, 64, 1, false)
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the prefixes of other bcrypt implementations
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		encoded := prefix + string(hash[4:])
+		if err := h.Check(encoded); err != nil {
+			t.Errorf("%s: Check: %v", prefix, err)
+		}
+		// a matching bcrypt hash is always replaced by argon2id
+		if rehash, err := h.Verify(encoded, "correct horse"); err != nil || !rehash {
+			t.Errorf("%s: Verify = %t, %v, want a match with rehash", prefix, rehash, err)
+		}
+		if _, err := h.Verify(encoded, "wrong"); !errors.Is(err, errMismatch) {
+			t.Errorf("%s: Verify(wrong password) = %v, want %v", prefix, err, errMismatch)
+		}
+	}
+	if err := h.Check("$2a$04$short"); err == nil {
+		t.Error("Check accepted a truncated bcrypt hash")
+	}
+}
+
+func TestRehashWeakerArgon2id(t *testing.T) {
+	h := newTestHasher(t, 64, 2, false)
+	hash := func(memory, iterations uint32) string {
+		t.Helper()
+		encoded, err := newTestHasher(t, memory, iterations, false).Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	// hashes of other implementations may use shorter salts and keys
+	short := func(salt, key int) string {
+		derived := argon2.IDKey([]byte("correct horse"), make([]byte, salt), 2, 64, 1, uint32(key))
+		return "$argon2id$v=19$m=64,t=2,p=1$" + b64.EncodeToString(make([]byte, salt)) + "$" + b64.EncodeToString(derived)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		rehash  bool
+	}{
+		{"same parameters", hash(64, 2), false},
+		{"less memory", hash(32, 2), true},
+		{"fewer iterations", hash(64, 1), true},
+		{"stronger parameters", hash(128, 3), false},
+		{"shorter salt", short(8, keyLength), true},
+		{"shorter key", short(saltLength, 16), true},
+	}
+	for _, test := range tests {
+		rehash, err := h.Verify(test.encoded, "correct horse")
+		if err != nil {
+			t.Errorf("%s: Verify: %v", test.name, err)
+			continue
+		}
+		if rehash != test.rehash {
+			t.Errorf("%s: rehash = %t, want %t", test.name, rehash, test.rehash)
+		}
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	strict := newTestHasher(t, 64, 1, false)
+	if err := strict.Check("secret"); !errors.Is(err, ErrPlaintext) {
+		t.Errorf("Check = %v, want %v", err, ErrPlaintext)
+	}
+	if _, err := strict.Verify("secret", "secret"); !errors.Is(err, ErrPlaintext) {
+		t.Errorf("Verify = %v, want %v", err, ErrPlaintext)
+	}
+
+	dev := newTestHasher(t, 64, 1, true)
+	if err := dev.Check("secret"); err != nil {
+		t.Errorf("Check with plaintext allowed: %v", err)
+	}
+	if rehash, err := dev.Verify("secret", "secret"); err != nil || rehash {
+		t.Errorf("Verify = %t, %v, want a match without rehash", rehash, err)
+	}
+	if _, err := dev.Verify("secret", "Secret"); !errors.Is(err, errMismatch) {
+		t.Errorf("Verify(wrong password) = %v, want %v", err, errMismatch)
+	}
+}
+
+func TestRejectsMalformedHashes(t *testing.T) {
+	h := newTestHasher(t, 64, 1, true)
+	valid, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+
+	tests := map[string]string{
+		"unsupported scheme": "$scrypt$ln=16,r=8,p=1$c2FsdA$aGFzaA",
+		"argon2i":            strings.Replace(valid, "$argon2id$", "$argon2i$", 1),
+		"other version":      strings.Replace(valid, "$v=19$", "$v=16$", 1),
+		"missing part":       strings.Join(parts[:5], "$"),
+		"zero iterations":    strings.Replace(valid, ",t=1,", ",t=0,", 1),
+		"bad parameters":     strings.Replace(valid, "m=64", "m=lots", 1),
+		"salt not base64":    strings.Replace(valid, parts[4], "!!!", 1),
+		"empty key":          strings.Join(append(parts[:5:5], ""), "$"),
+	}
+	for name, encoded := range tests {
+		if err := h.Check(encoded); err == nil {
+			t.Errorf("%s: Check accepted %s", name, encoded)
+		}
+		// plaintext is allowed here, so none of them may be taken as a password
+		if _, err := h.Verify(encoded, encoded); err == nil {
+			t.Errorf("%s: Verify accepted %s", name, encoded)
+		}
+	}
+}
+
+func TestVerifyDummy(t *testing.T) {
+	h := newTestHasher(t, 64, 1, false)
+	if rehash, err := h.Verify(h.dummy, ""); err != nil || rehash {
+		t.Fatalf("dummy hash does not verify: %t, %v", rehash, err)
+	}
+	h.VerifyDummy("guess")
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrClientAssertionReplayed is returned when the jti of a client assertion
+// was already used by the same client.
+var ErrClientAssertionReplayed = errors.New("client assertion was already used")
+
+type authenticatedClientKey struct{}
+
+// WithAuthenticatedClient marks a request as authenticated by a verified
+// client assertion or certificate, which AuthorizeClientIDSecret then accepts
+// in place of the client's secret.
+func WithAuthenticatedClient(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, authenticatedClientKey{}, clientID)
+}
+
+func authenticatedClient(ctx context.Context) string {
+	clientID, _ := ctx.Value(authenticatedClientKey{}).(string)
+	return clientID
+}
+
+// UseClientAssertion records the jti of a client assertion until it expires
+// and fails if the client already used it.
+func (s *Storage) UseClientAssertion(ctx context.Context, clientID, jti string, expiration time.Time) error {
+	key := clientID + "\x00" + jti
+	err := s.db.Update(func(tx Tx) error {
+		var used ClientAssertion
+		err := tx.Get(bucketClientAssertions, key, &used)
+		switch {
+		case err == nil && time.Now().Before(used.Expiration):
+			return ErrClientAssertionReplayed
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return err
+		}
+		return tx.Put(bucketClientAssertions, key, &ClientAssertion{ClientID: clientID, JTI: jti, Expiration: expiration})
+	})
+	if err != nil && !errors.Is(err, ErrClientAssertionReplayed) {
+		return fmt.Errorf("failed to record client assertion: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	errReadOnly = errors.New("write in read-only transaction")
+)
+
+const (
+	bucketAuthRequests       = "auth_requests"
+	bucketAuthCodes          = "auth_codes"
+	bucketAccessTokens       = "access_tokens"
+	bucketRefreshTokens      = "refresh_tokens"
+	bucketDeviceCodes        = "device_codes"
+	bucketUserCodes          = "user_codes"
+	bucketGrants             = "grants"
+	bucketSessions           = "sessions"
+	bucketPushedAuthRequests = "pushed_auth_requests"
+	bucketClientAssertions   = "client_assertions"
+	bucketDPoPProofs         = "dpop_proofs"
+	bucketTOTPSteps          = "totp_steps"
+	bucketPasskeys           = "passkeys"
+	bucketWebAuthnChallenges = "webauthn_challenges"
+	bucketLoginFailures      = "login_failures"
+)
+
+var buckets = []string{
+	bucketAuthRequests,
+	bucketAuthCodes,
+	bucketAccessTokens,
+	bucketRefreshTokens,
+	bucketDeviceCodes,
+	bucketUserCodes,
+	bucketGrants,
+	bucketSessions,
+	bucketPushedAuthRequests,
+	bucketClientAssertions,
+	bucketDPoPProofs,
+	bucketTOTPSteps,
+	bucketPasskeys,
+	bucketWebAuthnChallenges,
+	bucketLoginFailures,
+}
+
+// Backend is the key/value store the Storage keeps its state in. Values are
+// JSON encoded by the transaction.
+type Backend interface {
+	View(fn func(Tx) error) error
+	Update(fn func(Tx) error) error
+	Close() error
+}
+
+// Tx is a single read or read/write transaction on a Backend. Get returns
+// ErrNotFound for missing keys.
+type Tx interface {
+	Get(bucket, key string, v any) error
+	Put(bucket, key string, v any) error
+	Delete(bucket, key string) error
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+}
+
+const (
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+// OpenBackend opens the backend selected by kind. path is only used by the
+// file based backends.
+func OpenBackend(kind, path string) (Backend, error) {
+	switch kind {
+	case BackendMemory:
+		return NewMemoryBackend(), nil
+	case BackendBolt:
+		return OpenBoltBackend(path)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %q", kind)
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// forEachBackend runs fn against a fresh memory and a fresh bolt backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, db Backend)) {
+	t.Run(BackendMemory, func(t *testing.T) {
+		fn(t, NewMemoryBackend())
+	})
+	t.Run(BackendBolt, func(t *testing.T) {
+		db, err := OpenBoltBackend(filepath.Join(t.TempDir(), "idp.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		fn(t, db)
+	})
+}
+
+type testRecord struct {
+	Name string `json:"name"`
+}
+
+func TestBackendGetPutDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		err := db.Update(func(tx Tx) error {
+			for _, name := range []string{"b", "c", "a"} {
+				if err := tx.Put(bucketGrants, name, &testRecord{Name: name}); err != nil {
+					return err
+				}
+			}
+			return tx.Put(bucketSessions, "a", &testRecord{Name: "session"})
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		err = db.View(func(tx Tx) error {
+			var record testRecord
+			if err := tx.Get(bucketGrants, "a", &record); err != nil || record.Name != "a" {
+				t.Errorf("Get(a) = %+v, %v, want a", record, err)
+			}
+			if err := tx.Get(bucketGrants, "missing", &record); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(missing) = %v, want %v", err, ErrNotFound)
+			}
+			var keys []string
+			err := tx.ForEach(bucketGrants, func(key string, _ []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil || !slices.Equal(keys, []string{"a", "b", "c"}) {
+				t.Errorf("ForEach keys = %v, %v, want [a b c] in order", keys, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+
+		err = db.Update(func(tx Tx) error {
+			return tx.Delete(bucketGrants, "b")
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		err = db.View(func(tx Tx) error {
+			var record testRecord
+			if err := tx.Get(bucketGrants, "b", &record); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(b) after Delete = %v, want %v", err, ErrNotFound)
+			}
+			if err := tx.Get(bucketSessions, "a", &record); err != nil || record.Name != "session" {
+				t.Errorf("Get(a) in another bucket = %+v, %v, want session", record, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+	})
+}
+
+func TestBackendViewIsReadOnly(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		err := db.View(func(tx Tx) error {
+			if err := tx.Put(bucketGrants, "a", &testRecord{}); !errors.Is(err, errReadOnly) {
+				t.Errorf("Put = %v, want %v", err, errReadOnly)
+			}
+			if err := tx.Delete(bucketGrants, "a"); !errors.Is(err, errReadOnly) {
+				t.Errorf("Delete = %v, want %v", err, errReadOnly)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+	})
+}
+
+func TestBackendUpdateRollsBackOnError(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		err := db.Update(func(tx Tx) error {
+			return tx.Put(bucketGrants, "kept", &testRecord{Name: "kept"})
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		failure := errors.New("failure")
+		err = db.Update(func(tx Tx) error {
+			if err := tx.Put(bucketGrants, "new", &testRecord{Name: "new"}); err != nil {
+				return err
+			}
+			if err := tx.Delete(bucketGrants, "kept"); err != nil {
+				return err
+			}
+			// writes are visible within the transaction
+			var record testRecord
+			if err := tx.Get(bucketGrants, "new", &record); err != nil {
+				t.Errorf("Get(new) within the transaction: %v", err)
+			}
+			return failure
+		})
+		if !errors.Is(err, failure) {
+			t.Fatalf("Update = %v, want %v", err, failure)
+		}
+
+		err = db.View(func(tx Tx) error {
+			var record testRecord
+			if err := tx.Get(bucketGrants, "new", &record); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(new) = %v, want %v", err, ErrNotFound)
+			}
+			if err := tx.Get(bucketGrants, "kept", &record); err != nil {
+				t.Errorf("Get(kept) = %v, want the record", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+	})
+}
+
+func TestBoltBackendPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idp.db")
+	db, err := OpenBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx Tx) error {
+		return tx.Put(bucketGrants, "a", &testRecord{Name: "a"})
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var record testRecord
+	err = db.View(func(tx Tx) error {
+		return tx.Get(bucketGrants, "a", &record)
+	})
+	if err != nil || record.Name != "a" {
+		t.Fatalf("Get after reopening = %+v, %v, want a", record, err)
+	}
+}
+
+func TestOpenBackend(t *testing.T) {
+	if _, err := OpenBackend("redis", ""); err == nil {
+		t.Error("OpenBackend accepted an unsupported backend")
+	}
+	db, err := OpenBackend(BackendBolt, filepath.Join(t.TempDir(), "data", "idp.db"))
+	if err != nil {
+		t.Fatalf("OpenBackend(bolt): %v", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltBackend persists state in a single bbolt database file.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func OpenBoltBackend(path string) (*BoltBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage file: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise storage buckets: %w", err)
+	}
+
+	return &BoltBackend{db: db}, nil
+}
+
+func (b *BoltBackend) View(fn func(Tx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *BoltBackend) Update(fn func(Tx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) bucket(name string) (*bolt.Bucket, error) {
+	bucket := t.tx.Bucket([]byte(name))
+	if bucket == nil {
+		if !t.tx.Writable() {
+			return nil, nil
+		}
+		return t.tx.CreateBucket([]byte(name))
+	}
+	return bucket, nil
+}
+
+func (t boltTx) Get(bucket, key string, v any) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return ErrNotFound
+	}
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (t boltTx) Put(bucket, key string, v any) error {
+	if !t.tx.Writable() {
+		return errReadOnly
+	}
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), raw)
+}
+
+func (t boltTx) Delete(bucket, key string) error {
+	if !t.tx.Writable() {
+		return errReadOnly
+	}
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Delete([]byte(key))
+}
+
+// ForEach must not be used to modify the bucket it iterates; collect the keys
+// and delete them afterwards instead.
+func (t boltTx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	b, err := t.bucket(bucket)
+	if err != nil || b == nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
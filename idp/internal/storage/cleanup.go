@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const cleanupInterval = 10 * time.Minute
+
+// Run periodically purges expired auth requests, pushed requests, tokens,
+// sessions and device codes until the context is cancelled.
+func (s *Storage) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.purgeExpired(time.Now()); err != nil {
+				s.logger.Error("failed to purge expired entries", "error", err)
+			}
+		}
+	}
+}
+
+func (s *Storage) purgeExpired(now time.Time) error {
+	return s.db.Update(func(tx Tx) error {
+		var requests []string
+		err := tx.ForEach(bucketAuthRequests, func(key string, raw []byte) error {
+			var request AuthRequest
+			if err := json.Unmarshal(raw, &request); err != nil {
+				return err
+			}
+			if now.After(request.CreatedAt.Add(s.lifetimes.AuthRequest)) {
+				requests = append(requests, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range requests {
+			if err := deleteAuthRequest(tx, id); err != nil {
+				return err
+			}
+		}
+
+		if err := purgeBucket(tx, bucketAccessTokens, now, func(t *AccessToken) time.Time { return t.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketRefreshTokens, now, (*RefreshToken).purgeAt); err != nil {
+			return err
+		}
+
+		if err := purgeBucket(tx, bucketSessions, now, func(s *Session) time.Time { return s.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketPushedAuthRequests, now, func(r *PushedAuthRequest) time.Time { return r.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketClientAssertions, now, func(a *ClientAssertion) time.Time { return a.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketDPoPProofs, now, func(p *DPoPProof) time.Time { return p.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketTOTPSteps, now, func(s *TOTPStep) time.Time { return s.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketWebAuthnChallenges, now, func(c *WebAuthnChallenge) time.Time { return c.Expiration }); err != nil {
+			return err
+		}
+		if err := purgeBucket(tx, bucketLoginFailures, now, func(f *LoginFailures) time.Time { return f.Expiration }); err != nil {
+			return err
+		}
+
+		var userCodes []string
+		err = tx.ForEach(bucketDeviceCodes, func(_ string, raw []byte) error {
+			var authorization DeviceAuthorization
+			if err := json.Unmarshal(raw, &authorization); err != nil {
+				return err
+			}
+			if now.After(authorization.Expires) {
+				userCodes = append(userCodes, authorization.UserCode)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, userCode := range userCodes {
+			if err := tx.Delete(bucketUserCodes, userCode); err != nil {
+				return err
+			}
+		}
+		return purgeBucket(tx, bucketDeviceCodes, now, func(d *DeviceAuthorization) time.Time { return d.Expires })
+	})
+}
+
+// purgeBucket deletes every entry of bucket whose expiry lies before now.
+func purgeBucket[T any](tx Tx, bucket string, now time.Time, expiry func(*T) time.Time) error {
+	var expired []string
+	err := tx.ForEach(bucket, func(key string, raw []byte) error {
+		entry := new(T)
+		if err := json.Unmarshal(raw, entry); err != nil {
+			return err
+		}
+		if now.After(expiry(entry)) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := tx.Delete(bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
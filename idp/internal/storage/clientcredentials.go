@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"slices"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+var _ op.ClientCredentialsStorage = (*Storage)(nil)
+
+type requestedAudienceKey struct{}
+
+// WithRequestedAudience passes the audience parameter of a client_credentials
+// request to ClientCredentialsTokenRequest, which the provider calls with
+// the scopes only.
+func WithRequestedAudience(ctx context.Context, audience []string) context.Context {
+	return context.WithValue(ctx, requestedAudienceKey{}, audience)
+}
+
+func (s *Storage) ClientCredentials(ctx context.Context, clientID, clientSecret string) (op.Client, error) {
+	if err := s.AuthorizeClientIDSecret(ctx, clientID, clientSecret); err != nil {
+		return nil, err
+	}
+	client, _ := s.client(clientID)
+	return client, nil
+}
+
+// ClientCredentialsTokenRequest grants the requested scopes and audiences
+// when the client's allow-lists contain all of them, and everything the
+// client is allowed when it requests nothing.
+func (s *Storage) ClientCredentialsTokenRequest(ctx context.Context, clientID string, scopes []string) (op.TokenRequest, error) {
+	client, ok := s.client(clientID)
+	if !ok {
+		return nil, oidc.ErrInvalidClient()
+	}
+
+	if len(scopes) == 0 {
+		scopes = slices.Clone(client.AllowedScopes())
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.AllowedScopes(), scope) {
+			return nil, oidc.ErrInvalidScope().WithDescription("scope %s is not allowed for client %s", scope, clientID)
+		}
+	}
+
+	audience, _ := ctx.Value(requestedAudienceKey{}).([]string)
+	if len(audience) == 0 {
+		audience = slices.Clone(client.AllowedAudiences())
+	}
+	for _, aud := range audience {
+		if !slices.Contains(client.AllowedAudiences(), aud) {
+			return nil, oidc.ErrInvalidTarget().WithDescription("audience %s is not allowed for client %s", aud, clientID)
+		}
+	}
+
+	return &ClientCredentialsRequest{
+		ClientID: clientID,
+		Scopes:   scopes,
+		Audience: audience,
+	}, nil
+}
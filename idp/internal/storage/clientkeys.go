@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+const (
+	// jwksCacheLifetime is how long a key set fetched from a jwks_uri is used.
+	// A key id that is not in the cached set refetches it early, at most once
+	// per jwksRefetchInterval, so that clients can rotate their keys.
+	jwksCacheLifetime   = 5 * time.Minute
+	jwksRefetchInterval = 30 * time.Second
+	jwksFetchTimeout    = 5 * time.Second
+	jwksMaxSize         = 1 << 20
+)
+
+// remoteKeySets caches the key sets that clients publish at their jwks_uri.
+type remoteKeySets struct {
+	client *http.Client
+	mu     sync.Mutex
+	sets   map[string]*remoteKeySet
+}
+
+// remoteKeySet is the cached set of one jwks_uri. Its mu is held during the
+// fetch, so that requests for the same uri wait for one fetch while other
+// clients' keys stay available.
+type remoteKeySet struct {
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func newRemoteKeySets() *remoteKeySets {
+	return &remoteKeySets{
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		sets:   make(map[string]*remoteKeySet),
+	}
+}
+
+// get returns the key set published at uri. With refresh, a cached set is
+// only kept if it was fetched very recently.
+func (r *remoteKeySets) get(ctx context.Context, uri string, refresh bool) (*jose.JSONWebKeySet, error) {
+	r.mu.Lock()
+	set, ok := r.sets[uri]
+	if !ok {
+		set = &remoteKeySet{}
+		r.sets[uri] = set
+	}
+	r.mu.Unlock()
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	maxAge := jwksCacheLifetime
+	if refresh {
+		maxAge = jwksRefetchInterval
+	}
+	if set.keys != nil && time.Since(set.fetched) < maxAge {
+		return set.keys, nil
+	}
+
+	keys, err := r.fetch(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	set.keys, set.fetched = keys, time.Now()
+	return keys, nil
+}
+
+func (r *remoteKeySets) fetch(ctx context.Context, uri string) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks_uri: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks_uri: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks_uri: status %d", resp.StatusCode)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxSize)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks_uri: %w", err)
+	}
+	return &keys, nil
+}
+
+// GetKeyByIDAndClientID returns the public key that verifies a JWT signed
+// by the client, from its jwks or jwks_uri. Without a key id the client must
+// have exactly one signing key.
+func (s *Storage) GetKeyByIDAndClientID(ctx context.Context, keyID, clientID string) (*jose.JSONWebKey, error) {
+	client, ok := s.client(clientID)
+	if !ok {
+		return nil, fmt.Errorf("client %s not found", clientID)
+	}
+	if keys := client.JWKS(); keys != nil {
+		return signingKey(keys, keyID, clientID)
+	}
+	uri := client.JWKSURI()
+	if uri == "" {
+		return nil, fmt.Errorf("no keys registered for client %s", clientID)
+	}
+
+	keys, err := s.remoteKeys.get(ctx, uri, false)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := signingKey(keys, keyID, clientID); err == nil {
+		return key, nil
+	}
+	if keys, err = s.remoteKeys.get(ctx, uri, true); err != nil {
+		return nil, err
+	}
+	return signingKey(keys, keyID, clientID)
+}
+
+func signingKey(keys *jose.JSONWebKeySet, keyID, clientID string) (*jose.JSONWebKey, error) {
+	var found []jose.JSONWebKey
+	for _, key := range keys.Keys {
+		if (key.Use != "" && key.Use != "sig") || !key.IsPublic() {
+			continue
+		}
+		if keyID == "" || key.KeyID == keyID {
+			found = append(found, key)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return &found[0], nil
+	case keyID == "" && len(found) > 1:
+		return nil, fmt.Errorf("client %s has several signing keys, a key id is required", clientID)
+	default:
+		return nil, fmt.Errorf("client %s has no signing key %q", clientID, keyID)
+	}
+}
+
+// MatchClientKey reports whether key is one of the client's registered
+// public keys, as self_signed_tls_client_auth requires of the certificate it
+// presents.
+func (s *Storage) MatchClientKey(ctx context.Context, clientID string, key crypto.PublicKey) (bool, error) {
+	client, ok := s.client(clientID)
+	if !ok {
+		return false, fmt.Errorf("client %s not found", clientID)
+	}
+	if keys := client.JWKS(); keys != nil {
+		return containsKey(keys, key), nil
+	}
+	uri := client.JWKSURI()
+	if uri == "" {
+		return false, fmt.Errorf("no keys registered for client %s", clientID)
+	}
+
+	keys, err := s.remoteKeys.get(ctx, uri, false)
+	if err != nil {
+		return false, err
+	}
+	if containsKey(keys, key) {
+		return true, nil
+	}
+	if keys, err = s.remoteKeys.get(ctx, uri, true); err != nil {
+		return false, err
+	}
+	return containsKey(keys, key), nil
+}
+
+func containsKey(keys *jose.JSONWebKeySet, key crypto.PublicKey) bool {
+	for _, jwk := range keys.Keys {
+		if public, ok := jwk.Key.(interface{ Equal(crypto.PublicKey) bool }); ok && public.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
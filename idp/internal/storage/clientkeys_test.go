@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteKeySetsFetchDoesNotBlockOtherURIs(t *testing.T) {
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			fetches.Add(1)
+			<-release
+		}
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer server.Close()
+	// a failing test must not leave the server waiting
+	var unblock sync.Once
+	defer unblock.Do(func() { close(release) })
+	r := newRemoteKeySets()
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.get(context.Background(), server.URL+"/slow", false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// wait until the slow fetch has started
+	for deadline := time.Now().Add(time.Second); fetches.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("slow jwks_uri was not fetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.get(context.Background(), server.URL+"/fast", false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetching one jwks_uri waits for another")
+	}
+
+	unblock.Do(func() { close(release) })
+	wg.Wait()
+	// the requests for the slow uri waited for the first fetch
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("slow jwks_uri fetched %d times, want once", got)
+	}
+}
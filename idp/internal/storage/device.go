@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+func (s *Storage) StoreDeviceAuthorization(ctx context.Context, clientID, deviceCode, userCode string, expires time.Time, scopes []string) error {
+	if _, ok := s.client(clientID); !ok {
+		return errors.New("client not found")
+	}
+
+	return s.db.Update(func(tx Tx) error {
+		var existing string
+		err := tx.Get(bucketUserCodes, userCode, &existing)
+		if err == nil {
+			return op.ErrDuplicateUserCode
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		authorization := &DeviceAuthorization{
+			DeviceCode: deviceCode,
+			UserCode:   userCode,
+			ClientID:   clientID,
+			Scopes:     scopes,
+			Expires:    expires,
+		}
+		if err := tx.Put(bucketDeviceCodes, deviceCode, authorization); err != nil {
+			return err
+		}
+		return tx.Put(bucketUserCodes, userCode, deviceCode)
+	})
+}
+
+func (s *Storage) GetDeviceAuthorizatonState(ctx context.Context, clientID, deviceCode string) (*op.DeviceAuthorizationState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var authorization DeviceAuthorization
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketDeviceCodes, deviceCode, &authorization)
+	})
+	if err != nil || authorization.ClientID != clientID {
+		return nil, errors.New("device code not found for client")
+	}
+	return authorization.state(), nil
+}
+
+func (s *Storage) GetDeviceAuthorizationByUserCode(ctx context.Context, userCode string) (*op.DeviceAuthorizationState, error) {
+	var authorization DeviceAuthorization
+	err := s.db.View(func(tx Tx) error {
+		return deviceAuthorizationByUserCode(tx, userCode, &authorization)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return authorization.state(), nil
+}
+
+// CompleteDeviceAuthorization approves the authorization for the user, who
+// signed in with a one-time password after the password when otp is set.
+func (s *Storage) CompleteDeviceAuthorization(ctx context.Context, userCode, subject string, otp bool) error {
+	amr := []string{amrPassword}
+	if otp {
+		amr = multiFactorAMR()
+	}
+	return s.updateDeviceAuthorization(userCode, func(authorization *DeviceAuthorization) {
+		authorization.Subject = subject
+		authorization.AMR = amr
+		authorization.AuthTime = time.Now()
+		authorization.Done = true
+	})
+}
+
+func (s *Storage) DenyDeviceAuthorization(ctx context.Context, userCode string) error {
+	return s.updateDeviceAuthorization(userCode, func(authorization *DeviceAuthorization) {
+		authorization.Denied = true
+	})
+}
+
+func (s *Storage) updateDeviceAuthorization(userCode string, update func(*DeviceAuthorization)) error {
+	return s.db.Update(func(tx Tx) error {
+		var authorization DeviceAuthorization
+		if err := deviceAuthorizationByUserCode(tx, userCode, &authorization); err != nil {
+			return err
+		}
+		update(&authorization)
+		return tx.Put(bucketDeviceCodes, authorization.DeviceCode, &authorization)
+	})
+}
+
+func deviceAuthorizationByUserCode(tx Tx, userCode string, authorization *DeviceAuthorization) error {
+	var deviceCode string
+	if err := tx.Get(bucketUserCodes, userCode, &deviceCode); err != nil {
+		return fmt.Errorf("user code not found: %w", err)
+	}
+	if err := tx.Get(bucketDeviceCodes, deviceCode, authorization); err != nil {
+		return fmt.Errorf("user code not found: %w", err)
+	}
+	return nil
+}
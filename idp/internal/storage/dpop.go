@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// DPoPTokenType is the token_type of DPoP-bound access tokens.
+const DPoPTokenType = "DPoP"
+
+// ErrDPoPProofReplayed is returned when the jti of a DPoP proof was already
+// used with the same key.
+var ErrDPoPProofReplayed = errors.New("DPoP proof was already used")
+
+type dpopKeyKey struct{}
+
+// WithDPoPKey passes the thumbprint of the key a verified DPoP proof was
+// signed with to the storage, which binds new tokens to it and checks it
+// against bound ones.
+func WithDPoPKey(ctx context.Context, thumbprint string) context.Context {
+	return context.WithValue(ctx, dpopKeyKey{}, thumbprint)
+}
+
+// DPoPKey returns the thumbprint of the request's DPoP key, or "".
+func DPoPKey(ctx context.Context) string {
+	thumbprint, _ := ctx.Value(dpopKeyKey{}).(string)
+	return thumbprint
+}
+
+// UseDPoPProof records the jti of a DPoP proof until it expires and fails if
+// a proof with the same key already used it.
+func (s *Storage) UseDPoPProof(ctx context.Context, thumbprint, jti string, expiration time.Time) error {
+	key := thumbprint + "\x00" + jti
+	err := s.db.Update(func(tx Tx) error {
+		var used DPoPProof
+		err := tx.Get(bucketDPoPProofs, key, &used)
+		switch {
+		case err == nil && time.Now().Before(used.Expiration):
+			return ErrDPoPProofReplayed
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return err
+		}
+		return tx.Put(bucketDPoPProofs, key, &DPoPProof{KeyThumbprint: thumbprint, JTI: jti, Expiration: expiration})
+	})
+	if err != nil && !errors.Is(err, ErrDPoPProofReplayed) {
+		return fmt.Errorf("failed to record DPoP proof: %w", err)
+	}
+	return err
+}
+
+// refreshTokenBinding returns the DPoP key that refresh tokens issued to the
+// client are bound to. Only public clients bind them; confidential clients
+// already have to authenticate to use theirs (RFC 9449 5).
+func (s *Storage) refreshTokenBinding(ctx context.Context, clientID string) string {
+	client, ok := s.client(clientID)
+	if !ok || client.AuthMethod() != oidc.AuthMethodNone {
+		return ""
+	}
+	return DPoPKey(ctx)
+}
+
+// checkBinding fails when the request does not present what the access
+// token is bound to: the client certificate or the DPoP key.
+func checkBinding(ctx context.Context, token *AccessToken) error {
+	if token.CertificateThumbprint != "" {
+		cert := ClientCertificate(ctx)
+		if cert == nil || CertificateThumbprint(cert) != token.CertificateThumbprint {
+			return errors.New("token is bound to another client certificate")
+		}
+	}
+	if token.DPoPKeyThumbprint != "" && DPoPKey(ctx) != token.DPoPKeyThumbprint {
+		return errors.New("token is bound to another DPoP key")
+	}
+	return nil
+}
+
+// confirmation is the cnf claim of a token bound to a client certificate, a
+// DPoP key or both, or nil for a bearer token.
+func confirmation(certificateThumbprint, dpopKeyThumbprint string) map[string]any {
+	cnf := make(map[string]any)
+	if certificateThumbprint != "" {
+		cnf["x5t#S256"] = certificateThumbprint
+	}
+	if dpopKeyThumbprint != "" {
+		cnf["jkt"] = dpopKeyThumbprint
+	}
+	if len(cnf) == 0 {
+		return nil
+	}
+	return cnf
+}
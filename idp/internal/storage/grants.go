@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+func grantKey(userID, clientID string) string {
+	return userID + "|" + clientID
+}
+
+// consentRequired reports whether the user has to approve the request.
+// First-party clients never ask unless prompt=consent is given; other clients
+// ask until a grant covers every requested scope.
+func (s *Storage) consentRequired(tx Tx, request *AuthRequest) (bool, error) {
+	if slices.Contains(request.Prompt, oidc.PromptConsent) {
+		return true, nil
+	}
+
+	client, ok := s.client(request.ClientID)
+	if !ok {
+		return false, errors.New("client not found")
+	}
+	if client.FirstParty() {
+		return false, nil
+	}
+
+	var grant Grant
+	err := tx.Get(bucketGrants, grantKey(request.UserID, request.ClientID), &grant)
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, scope := range request.Scopes {
+		if !slices.Contains(grant.Scopes, scope) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GrantConsent records the user's approval of the scopes of the auth request
+// and completes it. Scopes granted earlier are kept.
+func (s *Storage) GrantConsent(ctx context.Context, id string) error {
+	return s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, id, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		if !request.Authenticated {
+			return errors.New("request is not authenticated")
+		}
+
+		now := time.Now()
+		key := grantKey(request.UserID, request.ClientID)
+
+		var grant Grant
+		err := tx.Get(bucketGrants, key, &grant)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			grant = Grant{
+				UserID:    request.UserID,
+				ClientID:  request.ClientID,
+				CreatedAt: now,
+			}
+		case err != nil:
+			return err
+		}
+		for _, scope := range request.Scopes {
+			if !slices.Contains(grant.Scopes, scope) {
+				grant.Scopes = append(grant.Scopes, scope)
+			}
+		}
+		grant.UpdatedAt = now
+
+		if err := tx.Put(bucketGrants, key, &grant); err != nil {
+			return err
+		}
+
+		request.Consented = true
+		return tx.Put(bucketAuthRequests, id, &request)
+	})
+}
+
+// RevokeGrant removes the user's grant for the client together with the
+// tokens issued under it, so the next login asks for consent again.
+func (s *Storage) RevokeGrant(ctx context.Context, userID, clientID string) error {
+	return s.db.Update(func(tx Tx) error {
+		key := grantKey(userID, clientID)
+
+		var grant Grant
+		if err := tx.Get(bucketGrants, key, &grant); err != nil {
+			return fmt.Errorf("grant not found: %w", err)
+		}
+		if err := tx.Delete(bucketGrants, key); err != nil {
+			return err
+		}
+		return revokeTokens(tx, userID, clientID)
+	})
+}
+
+// Grants returns every stored grant of the user.
+func (s *Storage) Grants(ctx context.Context, userID string) ([]Grant, error) {
+	var grants []Grant
+	err := s.db.View(func(tx Tx) error {
+		return tx.ForEach(bucketGrants, func(_ string, raw []byte) error {
+			var grant Grant
+			if err := json.Unmarshal(raw, &grant); err != nil {
+				return err
+			}
+			if grant.UserID == userID {
+				grants = append(grants, grant)
+			}
+			return nil
+		})
+	})
+	return grants, err
+}
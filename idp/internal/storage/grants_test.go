@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// getRecord reads the record stored under id in bucket.
+func getRecord(t *testing.T, s *Storage, bucket, id string, v any) error {
+	t.Helper()
+	return s.db.View(func(tx Tx) error {
+		return tx.Get(bucket, id, v)
+	})
+}
+
+// consent stores an authenticated request for the scopes and grants it.
+func consent(t *testing.T, s *Storage, userID, clientID string, scopes ...string) {
+	t.Helper()
+	request := &AuthRequest{ID: userID + "-" + clientID, ClientID: clientID, UserID: userID, Scopes: scopes, Authenticated: true}
+	err := s.db.Update(func(tx Tx) error {
+		return tx.Put(bucketAuthRequests, request.ID, request)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.GrantConsent(context.Background(), request.ID); err != nil {
+		t.Fatalf("GrantConsent: %v", err)
+	}
+}
+
+func TestConsentRequired(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		consent(t, s, "user-1", "third-party", "openid", "profile")
+		consent(t, s, "user-1", "third-party", "email")
+
+		tests := []struct {
+			name    string
+			request AuthRequest
+			want    bool
+		}{
+			{"granted scopes", AuthRequest{ClientID: "third-party", UserID: "user-1", Scopes: []string{"openid", "email"}}, false},
+			{"scope not granted", AuthRequest{ClientID: "third-party", UserID: "user-1", Scopes: []string{"openid", "offline_access"}}, true},
+			{"grant of another user", AuthRequest{ClientID: "third-party", UserID: "user-2", Scopes: []string{"openid"}}, true},
+			{"prompt=consent", AuthRequest{ClientID: "third-party", UserID: "user-1", Scopes: []string{"openid"}, Prompt: []string{"consent"}}, true},
+			{"first party", AuthRequest{ClientID: "first-party", UserID: "user-1", Scopes: []string{"openid"}}, false},
+			{"first party with prompt=consent", AuthRequest{ClientID: "first-party", UserID: "user-1", Scopes: []string{"openid"}, Prompt: []string{"consent"}}, true},
+		}
+		for _, test := range tests {
+			var got bool
+			err := s.db.View(func(tx Tx) (err error) {
+				got, err = s.consentRequired(tx, &test.request)
+				return err
+			})
+			if err != nil || got != test.want {
+				t.Errorf("%s: consentRequired = %t, %v, want %t", test.name, got, err, test.want)
+			}
+		}
+
+		var request AuthRequest
+		if err := getRecord(t, s, bucketAuthRequests, "user-1-third-party", &request); err != nil || !request.Consented {
+			t.Errorf("granted request = %+v, %v, want it consented", request, err)
+		}
+		err := s.db.View(func(tx Tx) error {
+			_, err := s.consentRequired(tx, &AuthRequest{ClientID: "unknown", UserID: "user-1"})
+			return err
+		})
+		if err == nil {
+			t.Error("consentRequired accepted an unknown client")
+		}
+	})
+}
+
+func TestGrantConsentRequiresAuthentication(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		err := s.db.Update(func(tx Tx) error {
+			return tx.Put(bucketAuthRequests, "pending", &AuthRequest{ID: "pending", ClientID: "third-party", Scopes: []string{"openid"}})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.GrantConsent(context.Background(), "pending"); err == nil {
+			t.Error("GrantConsent accepted a request that is not authenticated")
+		}
+		if err := s.GrantConsent(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GrantConsent(missing) = %v, want %v", err, ErrNotFound)
+		}
+	})
+}
+
+func TestGrantsAndRevokeGrant(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		consent(t, s, "user-1", "third-party", "openid", "profile")
+		consent(t, s, "user-1", "third-party", "profile", "email")
+		consent(t, s, "user-2", "third-party", "openid")
+		accessToken, refreshToken, _, err := s.CreateAccessAndRefreshTokens(context.Background(), &AuthRequest{ClientID: "third-party", UserID: "user-1"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		grants, err := s.Grants(context.Background(), "user-1")
+		if err != nil {
+			t.Fatalf("Grants: %v", err)
+		}
+		if len(grants) != 1 || grants[0].ClientID != "third-party" || !slices.Equal(grants[0].Scopes, []string{"openid", "profile", "email"}) {
+			t.Fatalf("Grants = %+v, want one grant for third-party with openid, profile and email", grants)
+		}
+
+		if err := s.RevokeGrant(context.Background(), "user-1", "third-party"); err != nil {
+			t.Fatalf("RevokeGrant: %v", err)
+		}
+		if err := s.RevokeGrant(context.Background(), "user-1", "third-party"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RevokeGrant again = %v, want %v", err, ErrNotFound)
+		}
+		if grants, err := s.Grants(context.Background(), "user-1"); err != nil || len(grants) != 0 {
+			t.Errorf("Grants after RevokeGrant = %+v, %v, want none", grants, err)
+		}
+		if grants, err := s.Grants(context.Background(), "user-2"); err != nil || len(grants) != 1 {
+			t.Errorf("Grants of user-2 = %+v, %v, want one", grants, err)
+		}
+
+		// the tokens issued under the grant are revoked with it
+		if err := getRecord(t, s, bucketRefreshTokens, refreshToken, &RefreshToken{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("refresh token: %v, want %v", err, ErrNotFound)
+		}
+		if err := getRecord(t, s, bucketAccessTokens, accessToken, &AccessToken{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("access token: %v, want %v", err, ErrNotFound)
+		}
+	})
+}
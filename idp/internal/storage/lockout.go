@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"idp/internal/config"
+)
+
+const (
+	loginKeyUser     = "user:"
+	loginKeyAddr     = "ip:"
+	loginKeyUserCode = "code:"
+)
+
+// BeginLogin counts a password sign-in by username from the client address
+// addr as failed before the password is checked, so that parallel guesses
+// cannot slip past the limits; LoginSucceeded takes it back. While either is
+// backing off or locked nothing is counted and the time until the next
+// attempt is returned instead.
+func (s *Storage) BeginLogin(ctx context.Context, username, addr string, cfg config.LoginConfig) (time.Duration, error) {
+	return s.beginAttempt(cfg, map[string]loginLimit{
+		loginKeyUser + username: {cfg.FreeFailures, cfg.MaxFailures},
+		loginKeyAddr + addr:     {cfg.FreeFailuresPerIP, cfg.MaxFailuresPerIP},
+	})
+}
+
+// BeginSecondFactor counts a one-time password for username as failed
+// before it is checked, the way BeginLogin counts the password. The failure
+// of the password is only taken back by LoginSucceeded once the code was
+// right too, so knowing the password does not give endless guesses at the
+// code.
+func (s *Storage) BeginSecondFactor(ctx context.Context, username string, cfg config.LoginConfig) (time.Duration, error) {
+	return s.beginAttempt(cfg, map[string]loginLimit{
+		loginKeyUser + username: {cfg.FreeFailures, cfg.MaxFailures},
+	})
+}
+
+// BeginUserCodeLookup counts a device user code entered from the client
+// address addr as wrong before it is looked up, so that pending codes cannot
+// be guessed (RFC 8628 section 5.1); UserCodeFound takes it back. It has
+// the limits of an address, but its own count.
+func (s *Storage) BeginUserCodeLookup(ctx context.Context, addr string, cfg config.LoginConfig) (time.Duration, error) {
+	return s.beginAttempt(cfg, map[string]loginLimit{
+		loginKeyUserCode + addr: {cfg.FreeFailuresPerIP, cfg.MaxFailuresPerIP},
+	})
+}
+
+func (s *Storage) beginAttempt(cfg config.LoginConfig, limits map[string]loginLimit) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	err := s.db.Update(func(tx Tx) error {
+		entries := make([]*LoginFailures, 0, len(limits))
+		for key := range limits {
+			entry, err := loginFailures(tx, key, now)
+			if err != nil {
+				return err
+			}
+			wait = max(wait, entry.NextAttempt.Sub(now))
+			entries = append(entries, entry)
+		}
+		if wait > 0 {
+			return nil
+		}
+
+		for _, entry := range entries {
+			entry.Failures++
+			entry.LastFailure = now
+			entry.Expiration = now.Add(cfg.LockoutDuration)
+			entry.schedule(cfg, limits[entry.Key])
+			if err := tx.Put(bucketLoginFailures, entry.Key, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count login attempt: %w", err)
+	}
+	return wait, nil
+}
+
+// LoginSucceeded forgets the failures of the username and takes back the
+// attempt BeginLogin counted for the address. The other failures of the
+// address stay, so that signing in to one account does not reset the
+// guesses at others.
+func (s *Storage) LoginSucceeded(ctx context.Context, username, addr string, cfg config.LoginConfig) error {
+	err := s.db.Update(func(tx Tx) error {
+		if err := tx.Delete(bucketLoginFailures, loginKeyUser+username); err != nil {
+			return err
+		}
+		return refundAttempt(tx, loginKeyAddr+addr, cfg, loginLimit{cfg.FreeFailuresPerIP, cfg.MaxFailuresPerIP})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset login failures: %w", err)
+	}
+	return nil
+}
+
+// UserCodeFound takes back the lookup BeginUserCodeLookup counted for addr.
+func (s *Storage) UserCodeFound(ctx context.Context, addr string, cfg config.LoginConfig) error {
+	err := s.db.Update(func(tx Tx) error {
+		return refundAttempt(tx, loginKeyUserCode+addr, cfg, loginLimit{cfg.FreeFailuresPerIP, cfg.MaxFailuresPerIP})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset user code failures: %w", err)
+	}
+	return nil
+}
+
+// refundAttempt takes one failure back from key and reschedules the rest.
+func refundAttempt(tx Tx, key string, cfg config.LoginConfig, limit loginLimit) error {
+	entry, err := loginFailures(tx, key, time.Now())
+	if err != nil || entry.Failures == 0 {
+		return err
+	}
+	entry.Failures--
+	entry.schedule(cfg, limit)
+	if entry.Failures == 0 {
+		return tx.Delete(bucketLoginFailures, entry.Key)
+	}
+	return tx.Put(bucketLoginFailures, entry.Key, entry)
+}
+
+// LoginFailureEntries returns the usernames and addresses with recent
+// failures, locked ones first.
+func (s *Storage) LoginFailureEntries(ctx context.Context) ([]LoginFailures, error) {
+	now := time.Now()
+	var entries []LoginFailures
+	err := s.db.View(func(tx Tx) error {
+		return tx.ForEach(bucketLoginFailures, func(_ string, raw []byte) error {
+			var entry LoginFailures
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if now.Before(entry.Expiration) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list login failures: %w", err)
+	}
+	slices.SortFunc(entries, func(a, b LoginFailures) int {
+		if c := b.LockedUntil.Compare(a.LockedUntil); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries, nil
+}
+
+// ResetLoginFailures unlocks a username or address and forgets its failures.
+func (s *Storage) ResetLoginFailures(ctx context.Context, key string) error {
+	return s.db.Update(func(tx Tx) error {
+		if err := tx.Get(bucketLoginFailures, key, &LoginFailures{}); err != nil {
+			return err
+		}
+		return tx.Delete(bucketLoginFailures, key)
+	})
+}
+
+// loginFailures returns the failures of key, or a fresh entry when there are
+// none or they have expired.
+func loginFailures(tx Tx, key string, now time.Time) (*LoginFailures, error) {
+	var entry LoginFailures
+	err := tx.Get(bucketLoginFailures, key, &entry)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return &LoginFailures{Key: key}, nil
+	case err != nil:
+		return nil, err
+	case now.After(entry.Expiration):
+		return &LoginFailures{Key: key}, nil
+	}
+	return &entry, nil
+}
+
+// loginLimit is the number of failures that are free and the number that
+// locks a username or address.
+type loginLimit struct {
+	free, max uint32
+}
+
+// schedule sets when the next attempt is allowed after the last failure:
+// right away for the free failures, then after BaseDelay doubling up to
+// MaxDelay, and after LockoutDuration once the limit is reached.
+func (f *LoginFailures) schedule(cfg config.LoginConfig, limit loginLimit) {
+	f.NextAttempt, f.LockedUntil = time.Time{}, time.Time{}
+	switch {
+	case f.Failures >= limit.max:
+		f.LockedUntil = f.LastFailure.Add(cfg.LockoutDuration)
+		f.NextAttempt = f.LockedUntil
+	case f.Failures > limit.free:
+		delay := cfg.BaseDelay
+		for i := limit.free + 1; i < f.Failures && delay < cfg.MaxDelay; i++ {
+			delay *= 2
+		}
+		f.NextAttempt = f.LastFailure.Add(min(delay, cfg.MaxDelay))
+	}
+}
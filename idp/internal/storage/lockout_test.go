@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"idp/internal/config"
+)
+
+func testLoginConfig() config.LoginConfig {
+	return config.LoginConfig{
+		FreeFailures:      3,
+		FreeFailuresPerIP: 5,
+		BaseDelay:         time.Second,
+		MaxDelay:          8 * time.Second,
+		MaxFailures:       10,
+		MaxFailuresPerIP:  20,
+		LockoutDuration:   15 * time.Minute,
+	}
+}
+
+func TestLoginFailuresSchedule(t *testing.T) {
+	cfg := testLoginConfig()
+	limit := loginLimit{free: 3, max: 10}
+	last := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures uint32
+		delay    time.Duration
+		locked   bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		{3, 0, false},
+		{4, time.Second, false},
+		{5, 2 * time.Second, false},
+		{6, 4 * time.Second, false},
+		{7, 8 * time.Second, false},
+		{8, 8 * time.Second, false},
+		{9, 8 * time.Second, false},
+		{10, cfg.LockoutDuration, true},
+		{11, cfg.LockoutDuration, true},
+	}
+	for _, test := range tests {
+		// a previous schedule must not survive, as when a failure is taken back
+		f := &LoginFailures{Failures: test.failures, LastFailure: last, NextAttempt: last.Add(time.Hour), LockedUntil: last.Add(time.Hour)}
+		f.schedule(cfg, limit)
+
+		var wantNext, wantLocked time.Time
+		if test.delay > 0 {
+			wantNext = last.Add(test.delay)
+		}
+		if test.locked {
+			wantLocked = wantNext
+		}
+		if !f.NextAttempt.Equal(wantNext) || !f.LockedUntil.Equal(wantLocked) {
+			t.Errorf("%d failures: next attempt %v, locked until %v, want %v and %v", test.failures, f.NextAttempt, f.LockedUntil, wantNext, wantLocked)
+		}
+	}
+}
+
+func TestLoginFailuresScheduleLargeMaxDelay(t *testing.T) {
+	// the doubling stops at MaxDelay instead of overflowing
+	cfg := testLoginConfig()
+	cfg.MaxDelay = 24 * time.Hour
+	f := &LoginFailures{Failures: 1000, LastFailure: time.Unix(0, 0)}
+	f.schedule(cfg, loginLimit{free: 0, max: 2000})
+	if got := f.NextAttempt.Sub(f.LastFailure); got != cfg.MaxDelay {
+		t.Fatalf("delay = %v, want %v", got, cfg.MaxDelay)
+	}
+}
+
+func loginFailuresOf(t *testing.T, s *Storage, key string) *LoginFailures {
+	t.Helper()
+	var entry LoginFailures
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketLoginFailures, key, &entry)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &entry
+}
+
+func TestBeginLogin(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		ctx := context.Background()
+
+		// the free failures go ahead right away and are counted up front
+		for i := range cfg.FreeFailures + 1 {
+			wait, err := s.BeginLogin(ctx, "user1", "192.0.2.1", cfg)
+			if err != nil || wait != 0 {
+				t.Fatalf("attempt %d: wait %v, %v, want none", i+1, wait, err)
+			}
+		}
+		user := loginFailuresOf(t, s, loginKeyUser+"user1")
+		addr := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1")
+		if user == nil || user.Failures != cfg.FreeFailures+1 || addr == nil || addr.Failures != cfg.FreeFailures+1 {
+			t.Fatalf("failures = %+v and %+v, want %d each", user, addr, cfg.FreeFailures+1)
+		}
+
+		// backing off, the attempt is refused and not counted
+		wait, err := s.BeginLogin(ctx, "user1", "192.0.2.2", cfg)
+		if err != nil || wait <= 0 || wait > cfg.BaseDelay {
+			t.Fatalf("wait = %v, %v, want up to %v", wait, err, cfg.BaseDelay)
+		}
+		if got := loginFailuresOf(t, s, loginKeyUser+"user1").Failures; got != cfg.FreeFailures+1 {
+			t.Errorf("user failures after a refused attempt = %d, want %d", got, cfg.FreeFailures+1)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.2"); entry != nil {
+			t.Errorf("refused attempt counted for its address: %+v", entry)
+		}
+
+		// another username from the same address is not held back by user1
+		if wait, err := s.BeginLogin(ctx, "user2", "192.0.2.1", cfg); err != nil || wait != 0 {
+			t.Errorf("user2: wait %v, %v, want none", wait, err)
+		}
+	})
+}
+
+func TestBeginLoginLocksAddress(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		cfg.BaseDelay, cfg.MaxDelay = 0, 0
+		ctx := context.Background()
+
+		// one guess each at many usernames
+		for i := range cfg.MaxFailuresPerIP {
+			if wait, err := s.BeginLogin(ctx, string(rune('a'+i)), "192.0.2.1", cfg); err != nil || wait != 0 {
+				t.Fatalf("attempt %d: wait %v, %v, want none", i+1, wait, err)
+			}
+		}
+		wait, err := s.BeginLogin(ctx, "user1", "192.0.2.1", cfg)
+		if err != nil || wait <= cfg.LockoutDuration-time.Minute {
+			t.Fatalf("wait = %v, %v, want the address locked for %v", wait, err, cfg.LockoutDuration)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1"); entry.LockedUntil.IsZero() {
+			t.Errorf("address entry %+v is not locked", entry)
+		}
+		if wait, err := s.BeginLogin(ctx, "user1", "192.0.2.2", cfg); err != nil || wait != 0 {
+			t.Errorf("other address: wait %v, %v, want none", wait, err)
+		}
+	})
+}
+
+func TestLoginSucceeded(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		ctx := context.Background()
+
+		for _, username := range []string{"user1", "user1", "user2"} {
+			if _, err := s.BeginLogin(ctx, username, "192.0.2.1", cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.LoginSucceeded(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatalf("LoginSucceeded: %v", err)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyUser+"user1"); entry != nil {
+			t.Errorf("user1 failures = %+v, want them forgotten", entry)
+		}
+		// only the attempt that succeeded is taken back from the address
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1"); entry == nil || entry.Failures != 2 {
+			t.Errorf("address failures = %+v, want 2", entry)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyUser+"user2"); entry == nil || entry.Failures != 1 {
+			t.Errorf("user2 failures = %+v, want 1", entry)
+		}
+
+		if err := s.LoginSucceeded(ctx, "user2", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.LoginSucceeded(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1"); entry != nil {
+			t.Errorf("address failures = %+v, want the entry deleted at zero", entry)
+		}
+		// more successes than attempts do not go below zero
+		if err := s.LoginSucceeded(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1"); entry != nil {
+			t.Errorf("address failures = %+v, want none", entry)
+		}
+	})
+}
+
+func TestLoginSucceededLiftsBackoff(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		cfg.FreeFailuresPerIP = 0
+		ctx := context.Background()
+
+		if _, err := s.BeginLogin(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyAddr+"192.0.2.1"); entry.NextAttempt.IsZero() {
+			t.Fatalf("address entry %+v is not backing off", entry)
+		}
+		// the refund reschedules, so a right password does not leave a wait
+		if err := s.LoginSucceeded(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if wait, err := s.BeginLogin(ctx, "user2", "192.0.2.1", cfg); err != nil || wait != 0 {
+			t.Errorf("wait = %v, %v, want none", wait, err)
+		}
+	})
+}
+
+func TestLoginFailuresExpire(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		ctx := context.Background()
+
+		past := time.Now().Add(-time.Hour)
+		err := s.db.Update(func(tx Tx) error {
+			return tx.Put(bucketLoginFailures, loginKeyUser+"user1", &LoginFailures{
+				Key:         loginKeyUser + "user1",
+				Failures:    cfg.MaxFailures,
+				LastFailure: past,
+				NextAttempt: past.Add(cfg.LockoutDuration),
+				LockedUntil: past.Add(cfg.LockoutDuration),
+				Expiration:  past.Add(cfg.LockoutDuration),
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := s.LoginFailureEntries(ctx)
+		if err != nil || len(entries) != 0 {
+			t.Errorf("LoginFailureEntries = %+v, %v, want the expired entry left out", entries, err)
+		}
+		if wait, err := s.BeginLogin(ctx, "user1", "192.0.2.1", cfg); err != nil || wait != 0 {
+			t.Fatalf("wait = %v, %v, want none after the lockout expired", wait, err)
+		}
+		if entry := loginFailuresOf(t, s, loginKeyUser+"user1"); entry.Failures != 1 {
+			t.Errorf("failures = %d, want counting to start over", entry.Failures)
+		}
+	})
+}
+
+func TestLoginFailureEntriesAndReset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		cfg := testLoginConfig()
+		cfg.MaxFailures = 1
+		ctx := context.Background()
+
+		if _, err := s.BeginLogin(ctx, "user2", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := s.LoginFailureEntries(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// locked entries come first
+		var keys []string
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		if len(keys) != 2 || keys[0] != loginKeyUser+"user2" || keys[1] != loginKeyAddr+"192.0.2.1" {
+			t.Fatalf("entries = %v, want the locked username first", keys)
+		}
+
+		if err := s.ResetLoginFailures(ctx, loginKeyUser+"user2"); err != nil {
+			t.Fatalf("ResetLoginFailures: %v", err)
+		}
+		if err := s.ResetLoginFailures(ctx, loginKeyUser+"user2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ResetLoginFailures again = %v, want %v", err, ErrNotFound)
+		}
+		if wait, err := s.BeginLogin(ctx, "user2", "192.0.2.2", cfg); err != nil || wait != 0 {
+			t.Errorf("wait after reset = %v, %v, want none", wait, err)
+		}
+	})
+}
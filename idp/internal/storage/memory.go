@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// MemoryBackend keeps all state in process memory. It is meant for tests and
+// local experiments; everything is lost on restart.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{buckets: make(map[string]map[string][]byte)}
+}
+
+func (b *MemoryBackend) View(fn func(Tx) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return fn(&memoryTx{backend: b})
+}
+
+// Update runs fn against copies of the buckets it writes to and only swaps
+// them in when fn succeeds.
+func (b *MemoryBackend) Update(fn func(Tx) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tx := &memoryTx{backend: b, writable: true, dirty: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	maps.Copy(b.buckets, tx.dirty)
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	backend  *MemoryBackend
+	writable bool
+	dirty    map[string]map[string][]byte
+}
+
+func (tx *memoryTx) bucket(name string) map[string][]byte {
+	if bucket, ok := tx.dirty[name]; ok {
+		return bucket
+	}
+	return tx.backend.buckets[name]
+}
+
+func (tx *memoryTx) writableBucket(name string) map[string][]byte {
+	if bucket, ok := tx.dirty[name]; ok {
+		return bucket
+	}
+	bucket := maps.Clone(tx.backend.buckets[name])
+	if bucket == nil {
+		bucket = make(map[string][]byte)
+	}
+	tx.dirty[name] = bucket
+	return bucket
+}
+
+func (tx *memoryTx) Get(bucket, key string, v any) error {
+	raw, ok := tx.bucket(bucket)[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (tx *memoryTx) Put(bucket, key string, v any) error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tx.writableBucket(bucket)[key] = raw
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket, key string) error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	delete(tx.writableBucket(bucket), key)
+	return nil
+}
+
+func (tx *memoryTx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	b := tx.bucket(bucket)
+	for _, key := range slices.Sorted(maps.Keys(b)) {
+		raw, ok := b[key]
+		if !ok {
+			continue
+		}
+		if err := fn(key, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
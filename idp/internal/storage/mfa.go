@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"idp/internal/data"
+	"idp/internal/totp"
+)
+
+// Authentication methods (RFC 8176) and the authentication context classes
+// they reach.
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+	amrMFA      = "mfa"
+
+	ACRPassword    = "urn:idp:acr:pwd"
+	ACRMultiFactor = "urn:idp:acr:mfa"
+)
+
+// maxOTPAttempts is how many wrong codes an auth request or a device
+// authorization takes before it is given up.
+const maxOTPAttempts = 5
+
+var (
+	// ErrMFANotEnrolled is returned when the client or the request demands a
+	// second factor from a user who has none.
+	ErrMFANotEnrolled = errors.New("a second factor is required, but the user has none")
+	// ErrInvalidOTP is returned for a wrong one-time password or one that
+	// was already used.
+	ErrInvalidOTP = errors.New("one-time password is wrong or was already used")
+	// ErrTooManyOTPAttempts is returned when the auth request was dropped
+	// after too many wrong one-time passwords.
+	ErrTooManyOTPAttempts = errors.New("too many wrong one-time passwords")
+)
+
+// ACRValues are the acr_values that requests can ask for.
+var ACRValues = []string{ACRPassword, ACRMultiFactor}
+
+func acr(amr []string) string {
+	switch {
+	case slices.Contains(amr, amrMFA):
+		return ACRMultiFactor
+	case len(amr) > 0:
+		return ACRPassword
+	}
+	return ""
+}
+
+func multiFactorAMR() []string {
+	return []string{amrPassword, amrOTP, amrMFA}
+}
+
+// MFARequired reports whether users must sign in to the client with a second
+// factor, because of the client's registration or the acr_values it asked
+// for.
+func (s *Storage) MFARequired(clientID string, acrValues []string) bool {
+	if slices.Contains(acrValues, ACRMultiFactor) {
+		return true
+	}
+	client, ok := s.client(clientID)
+	return ok && client.RequireMFA()
+}
+
+// TOTPEnrolled reports whether the user signs in with a one-time password
+// after the password.
+func (s *Storage) TOTPEnrolled(userID string) bool {
+	user := s.users().GetUserByID(userID)
+	return user != nil && user.TOTPEnrolled()
+}
+
+// CheckTOTP completes the sign-in of an auth request whose password was
+// verified with the user's one-time password.
+func (s *Storage) CheckTOTP(ctx context.Context, id, code string) error {
+	var result error
+	err := s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, id, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		if !request.SecondFactorPending() {
+			return errors.New("request is not waiting for a second factor")
+		}
+		user := s.users().GetUserByID(request.UserID)
+		if user == nil || !user.TOTPEnrolled() {
+			return errors.New("user has no second factor")
+		}
+
+		if err := useTOTP(tx, user, code); err != nil {
+			result = err
+			request.OTPAttempts++
+			if request.OTPAttempts >= maxOTPAttempts {
+				result = ErrTooManyOTPAttempts
+				return tx.Delete(bucketAuthRequests, id)
+			}
+			return tx.Put(bucketAuthRequests, id, &request)
+		}
+
+		request.AMR = multiFactorAMR()
+		request.Authenticated = true
+		request.AuthTime = time.Now()
+		consent, err := s.consentRequired(tx, &request)
+		if err != nil {
+			return err
+		}
+		request.Consented = !consent
+		return tx.Put(bucketAuthRequests, id, &request)
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// CheckDeviceTOTP checks the one-time password of the user signing in to
+// approve a device authorization. Too many wrong codes deny the
+// authorization.
+func (s *Storage) CheckDeviceTOTP(ctx context.Context, userCode, userID, code string) error {
+	user := s.users().GetUserByID(userID)
+	if user == nil || !user.TOTPEnrolled() {
+		return errors.New("user has no second factor")
+	}
+	var result error
+	err := s.db.Update(func(tx Tx) error {
+		var authorization DeviceAuthorization
+		if err := deviceAuthorizationByUserCode(tx, userCode, &authorization); err != nil {
+			return err
+		}
+		if authorization.Done || authorization.Denied {
+			return errors.New("device authorization is already completed")
+		}
+		if result = useTOTP(tx, user, code); result == nil {
+			return nil
+		}
+		authorization.OTPAttempts++
+		if authorization.OTPAttempts >= maxOTPAttempts {
+			result = ErrTooManyOTPAttempts
+			authorization.Denied = true
+		}
+		return tx.Put(bucketDeviceCodes, authorization.DeviceCode, &authorization)
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// useTOTP verifies the code and remembers its step, so that a code seen over
+// the user's shoulder cannot be used a second time.
+func useTOTP(tx Tx, user *data.User, code string) error {
+	step, ok := totp.Verify(user.TOTPKey, code, time.Now())
+	if !ok {
+		return ErrInvalidOTP
+	}
+	var last TOTPStep
+	err := tx.Get(bucketTOTPSteps, user.ID, &last)
+	switch {
+	case err == nil && last.Step >= step:
+		return ErrInvalidOTP
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return err
+	}
+	return tx.Put(bucketTOTPSteps, user.ID, &TOTPStep{UserID: user.ID, Step: step, Expiration: totp.StepTime(step)})
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/password"
+	"idp/internal/totp"
+)
+
+const (
+	// testTOTPSecret is the seed of RFC 6238 appendix B in base32.
+	testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	testPassword   = "password"
+)
+
+const mfaTestClients = `[
+  {"id": "first-party", "type": "web", "secret": "secret", "redirect_uris": ["https://app.example/callback"], "first_party": true},
+  {"id": "mfa-app", "type": "web", "secret": "secret", "redirect_uris": ["https://mfa.example/callback"], "first_party": true, "require_mfa": true}
+]`
+
+// newMFATestStorage returns a storage with user1, who has a TOTP secret,
+// user2, who has none, and a client that requires a second factor.
+func newMFATestStorage(t *testing.T, db Backend) *Storage {
+	t.Helper()
+	dir := t.TempDir()
+	hasher, err := password.NewHasher(config.PasswordsConfig{Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := json.Marshal([]data.UserRecord{
+		{ID: "user-1", Username: "user1", Password: hash, TOTPSecret: testTOTPSecret},
+		{ID: "user-2", Username: "user2", Password: hash},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), users, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "clients.json"), []byte(mfaTestClients), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	userStore, err := data.LoadUserStore(filepath.Join(dir, "users.json"), hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := data.LoadClients(filepath.Join(dir, "clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t, db)
+	s.Replace(clients, userStore)
+	return s
+}
+
+func newTestAuthRequest(t *testing.T, s *Storage, clientID string) string {
+	t.Helper()
+	request, err := s.CreateAuthRequest(context.Background(), &oidc.AuthRequest{ClientID: clientID, Scopes: oidc.SpaceDelimitedArray{oidc.ScopeOpenID}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request.GetID()
+}
+
+func TestCheckUsernamePasswordWithoutRequiredSecondFactor(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newMFATestStorage(t, db)
+		id := newTestAuthRequest(t, s, "mfa-app")
+
+		if err := s.CheckUsernamePassword("user2", testPassword, id); !errors.Is(err, ErrMFANotEnrolled) {
+			t.Fatalf("CheckUsernamePassword = %v, want %v", err, ErrMFANotEnrolled)
+		}
+		var request AuthRequest
+		if err := getRecord(t, s, bucketAuthRequests, id, &request); err != nil {
+			t.Fatal(err)
+		}
+		if request.UserID != "" || request.Authenticated {
+			t.Errorf("auth request = %+v, want it untouched", request)
+		}
+	})
+}
+
+// Wrong codes count against the username, so that someone who knows the
+// password cannot get fresh guesses from new auth requests.
+func TestSecondFactorThrottledAcrossAuthRequests(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newMFATestStorage(t, db)
+		cfg := config.Default().Login
+		ctx := context.Background()
+
+		var attempts uint32
+		for attempts < cfg.MaxFailures {
+			if wait, err := s.BeginLogin(ctx, "user1", "192.0.2.1", cfg); err != nil || wait > 0 {
+				break
+			}
+			attempts++
+			id := newTestAuthRequest(t, s, "mfa-app")
+			if err := s.CheckUsernamePassword("user1", testPassword, id); err != nil {
+				t.Fatalf("CheckUsernamePassword: %v", err)
+			}
+
+			if wait, err := s.BeginSecondFactor(ctx, "user1", cfg); err != nil || wait > 0 {
+				break
+			}
+			attempts++
+			if err := s.CheckTOTP(ctx, id, "000000"); !errors.Is(err, ErrInvalidOTP) {
+				t.Fatalf("CheckTOTP = %v, want %v", err, ErrInvalidOTP)
+			}
+		}
+		if attempts != cfg.FreeFailures+1 {
+			t.Fatalf("got %d attempts before backing off, want %d", attempts, cfg.FreeFailures+1)
+		}
+		if wait, err := s.BeginSecondFactor(ctx, "user1", cfg); err != nil || wait <= 0 {
+			t.Errorf("BeginSecondFactor while backing off = %v, %v, want a wait", wait, err)
+		}
+
+		// the address only counts the password attempts
+		entries, err := s.LoginFailureEntries(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Key == loginKeyAddr+"192.0.2.1" && entry.Failures != (attempts+1)/2 {
+				t.Errorf("address failures = %d, want %d", entry.Failures, (attempts+1)/2)
+			}
+		}
+
+		if err := s.LoginSucceeded(ctx, "user1", "192.0.2.1", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if wait, err := s.BeginSecondFactor(ctx, "user1", cfg); err != nil || wait > 0 {
+			t.Errorf("BeginSecondFactor after a sign-in = %v, %v, want no wait", wait, err)
+		}
+	})
+}
+
+// totpCode computes the code of the step the way an authenticator app does.
+func totpCode(step int64) string {
+	mac := hmac.New(sha1.New, []byte("12345678901234567890"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1_000_000)
+}
+
+func TestUseTOTPRejectsUsedStep(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newMFATestStorage(t, db)
+		user := s.UserByID("user-1")
+		step := time.Now().Unix() / int64(totp.Period/time.Second)
+
+		use := func(code string) error {
+			return s.db.Update(func(tx Tx) error {
+				return useTOTP(tx, user, code)
+			})
+		}
+		if err := use(totpCode(step)); err != nil {
+			t.Fatalf("useTOTP: %v", err)
+		}
+		var used TOTPStep
+		if err := getRecord(t, s, bucketTOTPSteps, user.ID, &used); err != nil || used.Step != step || !used.Expiration.Equal(totp.StepTime(step)) {
+			t.Errorf("stored step = %+v, %v, want step %d expiring %v", used, err, step, totp.StepTime(step))
+		}
+
+		if err := use(totpCode(step)); !errors.Is(err, ErrInvalidOTP) {
+			t.Errorf("same code again = %v, want %v", err, ErrInvalidOTP)
+		}
+		// a code of an earlier step within the window is as used
+		if err := use(totpCode(step - 1)); !errors.Is(err, ErrInvalidOTP) {
+			t.Errorf("code of the step before = %v, want %v", err, ErrInvalidOTP)
+		}
+		if err := use(totpCode(step + 1)); err != nil {
+			t.Errorf("code of the next step: %v", err)
+		}
+	})
+}
+
+func TestCheckTOTPRejectsUsedCode(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newMFATestStorage(t, db)
+		ctx := context.Background()
+		code := totpCode(time.Now().Unix() / int64(totp.Period/time.Second))
+
+		first := newTestAuthRequest(t, s, "mfa-app")
+		if err := s.CheckUsernamePassword("user1", testPassword, first); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CheckTOTP(ctx, first, code); err != nil {
+			t.Fatalf("CheckTOTP: %v", err)
+		}
+		var request AuthRequest
+		if err := getRecord(t, s, bucketAuthRequests, first, &request); err != nil || !request.Authenticated {
+			t.Fatalf("auth request = %+v, %v, want it authenticated", request, err)
+		}
+
+		// a code seen over the user's shoulder does not work for another sign-in
+		second := newTestAuthRequest(t, s, "mfa-app")
+		if err := s.CheckUsernamePassword("user1", testPassword, second); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CheckTOTP(ctx, second, code); !errors.Is(err, ErrInvalidOTP) {
+			t.Fatalf("CheckTOTP with the used code = %v, want %v", err, ErrInvalidOTP)
+		}
+	})
+}
@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+	"golang.org/x/text/language"
+)
+
+var (
+	_ op.AuthRequest         = (*AuthRequest)(nil)
+	_ op.RefreshTokenRequest = (*RefreshTokenRequest)(nil)
+	_ op.TokenRequest        = (*ClientCredentialsRequest)(nil)
+)
+
+// AuthRequest is the persisted form of an authorization request.
+type AuthRequest struct {
+	ID            string              `json:"id"`
+	CreatedAt     time.Time           `json:"created_at"`
+	ClientID      string              `json:"client_id"`
+	RedirectURI   string              `json:"redirect_uri"`
+	State         string              `json:"state,omitempty"`
+	Prompt        []string            `json:"prompt,omitempty"`
+	UILocales     []language.Tag      `json:"ui_locales,omitempty"`
+	LoginHint     string              `json:"login_hint,omitempty"`
+	MaxAge        *time.Duration      `json:"max_age,omitempty"`
+	UserID        string              `json:"user_id,omitempty"`
+	Scopes        []string            `json:"scopes"`
+	ResponseType  oidc.ResponseType   `json:"response_type"`
+	ResponseMode  oidc.ResponseMode   `json:"response_mode,omitempty"`
+	Nonce         string              `json:"nonce,omitempty"`
+	CodeChallenge *oidc.CodeChallenge `json:"code_challenge,omitempty"`
+	Code          string              `json:"code,omitempty"`
+	Authenticated bool                `json:"authenticated"`
+	AuthTime      time.Time           `json:"auth_time,omitzero"`
+	// Consented is set once the user approved the requested scopes or no
+	// consent was needed.
+	Consented bool `json:"consented"`
+	// SessionID is the browser session the request was authenticated in.
+	SessionID string `json:"session_id,omitempty"`
+	// ACRValues are the authentication context classes the client asked
+	// for; RequireMFA is set when they or the client demand a second factor.
+	ACRValues  []string `json:"acr_values,omitempty"`
+	RequireMFA bool     `json:"require_mfa,omitempty"`
+	// AMR are the methods the user authenticated with so far. A request
+	// whose password was verified waits for the one-time password while
+	// Authenticated is still false.
+	AMR         []string `json:"amr,omitempty"`
+	OTPAttempts int      `json:"otp_attempts,omitempty"`
+}
+
+// LogValue implements slog.LogValuer.
+func (a *AuthRequest) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", a.ID),
+		slog.Time("created_at", a.CreatedAt),
+		slog.Any("scopes", a.Scopes),
+		slog.String("response_type", string(a.ResponseType)),
+		slog.String("client_id", a.ClientID),
+		slog.String("redirect_uri", a.RedirectURI),
+	)
+}
+
+func (a *AuthRequest) GetID() string {
+	return a.ID
+}
+
+func (a *AuthRequest) GetACR() string {
+	return acr(a.GetAMR())
+}
+
+func (a *AuthRequest) GetAMR() []string {
+	if a.Authenticated {
+		return a.AMR
+	}
+	return nil
+}
+
+// SecondFactorPending reports whether the user entered the password and
+// still has to enter the one-time password.
+func (a *AuthRequest) SecondFactorPending() bool {
+	return !a.Authenticated && slices.Contains(a.AMR, amrPassword)
+}
+
+func (a *AuthRequest) GetAudience() []string {
+	return []string{a.ClientID}
+}
+
+func (a *AuthRequest) GetAuthTime() time.Time {
+	return a.AuthTime
+}
+
+func (a *AuthRequest) GetClientID() string {
+	return a.ClientID
+}
+
+func (a *AuthRequest) GetCodeChallenge() *oidc.CodeChallenge {
+	return a.CodeChallenge
+}
+
+func (a *AuthRequest) GetNonce() string {
+	return a.Nonce
+}
+
+func (a *AuthRequest) GetRedirectURI() string {
+	return a.RedirectURI
+}
+
+func (a *AuthRequest) GetResponseType() oidc.ResponseType {
+	return a.ResponseType
+}
+
+func (a *AuthRequest) GetResponseMode() oidc.ResponseMode {
+	return a.ResponseMode
+}
+
+func (a *AuthRequest) GetScopes() []string {
+	return a.Scopes
+}
+
+func (a *AuthRequest) GetState() string {
+	return a.State
+}
+
+func (a *AuthRequest) GetSubject() string {
+	return a.UserID
+}
+
+func (a *AuthRequest) GetSessionID() string {
+	return a.SessionID
+}
+
+func (a *AuthRequest) Done() bool {
+	return a.Authenticated && a.Consented
+}
+
+func newAuthRequest(authReq *oidc.AuthRequest, userID string) *AuthRequest {
+	var codeChallenge *oidc.CodeChallenge
+	if authReq.CodeChallenge != "" {
+		method := oidc.CodeChallengeMethodPlain
+		if authReq.CodeChallengeMethod == oidc.CodeChallengeMethodS256 {
+			method = oidc.CodeChallengeMethodS256
+		}
+		codeChallenge = &oidc.CodeChallenge{
+			Challenge: authReq.CodeChallenge,
+			Method:    method,
+		}
+	}
+
+	var maxAge *time.Duration
+	if authReq.MaxAge != nil {
+		d := time.Duration(*authReq.MaxAge) * time.Second
+		maxAge = &d
+	}
+
+	return &AuthRequest{
+		CreatedAt:     time.Now(),
+		ClientID:      authReq.ClientID,
+		RedirectURI:   authReq.RedirectURI,
+		State:         authReq.State,
+		Prompt:        promptToInternal(authReq.Prompt),
+		UILocales:     authReq.UILocales,
+		LoginHint:     authReq.LoginHint,
+		MaxAge:        maxAge,
+		UserID:        userID,
+		Scopes:        authReq.Scopes,
+		ResponseType:  authReq.ResponseType,
+		ResponseMode:  authReq.ResponseMode,
+		Nonce:         authReq.Nonce,
+		CodeChallenge: codeChallenge,
+		ACRValues:     authReq.ACRValues,
+	}
+}
+
+func promptToInternal(prompts oidc.SpaceDelimitedArray) []string {
+	internal := make([]string, 0, len(prompts))
+	for _, prompt := range prompts {
+		switch prompt {
+		case oidc.PromptNone,
+			oidc.PromptLogin,
+			oidc.PromptConsent,
+			oidc.PromptSelectAccount:
+			internal = append(internal, prompt)
+		}
+	}
+	return internal
+}
+
+// Session is a browser's sign-in at the IdP. It lets later auth requests
+// from the same browser skip the password form. Clients lists the relying
+// parties that signed the user in through it.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	AuthTime   time.Time `json:"auth_time"`
+	AMR        []string  `json:"amr,omitempty"`
+	Clients    []string  `json:"clients,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Expiration time.Time `json:"expiration"`
+}
+
+func (s *Session) join(clientID string) {
+	if !slices.Contains(s.Clients, clientID) {
+		s.Clients = append(s.Clients, clientID)
+	}
+}
+
+// AcceptsSession reports whether the request may be completed with the
+// session instead of asking for credentials. prompt=login arrives here as a
+// max_age of zero.
+func (a *AuthRequest) AcceptsSession(session *Session, now time.Time) bool {
+	if a.UserID != "" && a.UserID != session.UserID {
+		return false
+	}
+	if a.MaxAge != nil && now.After(session.AuthTime.Add(*a.MaxAge)) {
+		return false
+	}
+	if a.RequireMFA && !slices.Contains(session.AMR, amrMFA) {
+		return false
+	}
+	return true
+}
+
+// Grant records the scopes a user has approved for a client.
+type Grant struct {
+	UserID    string    `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type AccessToken struct {
+	ID             string    `json:"id"`
+	ClientID       string    `json:"client_id"`
+	Subject        string    `json:"subject"`
+	RefreshTokenID string    `json:"refresh_token_id,omitempty"`
+	Audience       []string  `json:"audience"`
+	Scopes         []string  `json:"scopes"`
+	IssuedAt       time.Time `json:"issued_at,omitzero"`
+	Expiration     time.Time `json:"expiration"`
+	// Actor is the act claim of a token issued by token exchange.
+	Actor *oidc.ActorClaims `json:"actor,omitempty"`
+	// CertificateThumbprint is the x5t#S256 of the client certificate the
+	// token is bound to.
+	CertificateThumbprint string `json:"certificate_thumbprint,omitempty"`
+	// DPoPKeyThumbprint is the jkt of the DPoP key the token is bound to.
+	DPoPKeyThumbprint string `json:"dpop_key_thumbprint,omitempty"`
+}
+
+// RefreshToken is rotated on every use. All tokens rotated from the same
+// login form a family that shares FamilyExpiration; rotated tokens are kept
+// with RotatedAt set so that presenting one again can be detected.
+type RefreshToken struct {
+	ID               string    `json:"id"`
+	FamilyID         string    `json:"family_id"`
+	SessionID        string    `json:"session_id,omitempty"`
+	AuthTime         time.Time `json:"auth_time"`
+	AMR              []string  `json:"amr,omitempty"`
+	Audience         []string  `json:"audience"`
+	UserID           string    `json:"user_id"`
+	ClientID         string    `json:"client_id"`
+	Scopes           []string  `json:"scopes"`
+	AccessTokenID    string    `json:"access_token_id"`
+	Expiration       time.Time `json:"expiration"`
+	FamilyExpiration time.Time `json:"family_expiration"`
+	RotatedAt        time.Time `json:"rotated_at,omitzero"`
+	// DPoPKeyThumbprint binds the refresh tokens of a public client to the
+	// DPoP key it used when the family was issued.
+	DPoPKeyThumbprint string `json:"dpop_key_thumbprint,omitempty"`
+}
+
+func (r *RefreshToken) rotated() bool {
+	return !r.RotatedAt.IsZero()
+}
+
+// purgeAt keeps rotated tokens for as long as their family could still be
+// replayed.
+func (r *RefreshToken) purgeAt() time.Time {
+	if r.rotated() {
+		return r.FamilyExpiration
+	}
+	return r.Expiration
+}
+
+// RefreshTokenRequest wraps a RefreshToken to implement op.RefreshTokenRequest.
+type RefreshTokenRequest struct {
+	*RefreshToken
+}
+
+func (r *RefreshTokenRequest) GetAMR() []string {
+	return r.AMR
+}
+
+func (r *RefreshTokenRequest) GetAudience() []string {
+	return r.Audience
+}
+
+func (r *RefreshTokenRequest) GetAuthTime() time.Time {
+	return r.AuthTime
+}
+
+func (r *RefreshTokenRequest) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *RefreshTokenRequest) GetSessionID() string {
+	return r.SessionID
+}
+
+func (r *RefreshTokenRequest) GetScopes() []string {
+	return r.Scopes
+}
+
+func (r *RefreshTokenRequest) GetSubject() string {
+	return r.UserID
+}
+
+func (r *RefreshTokenRequest) SetCurrentScopes(scopes []string) {
+	r.Scopes = scopes
+}
+
+// ClientCredentialsRequest is the token request of a client acting on its
+// own behalf, so the client is also the subject.
+type ClientCredentialsRequest struct {
+	ClientID string
+	Scopes   []string
+	Audience []string
+}
+
+func (r *ClientCredentialsRequest) GetAudience() []string {
+	return r.Audience
+}
+
+func (r *ClientCredentialsRequest) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *ClientCredentialsRequest) GetScopes() []string {
+	return r.Scopes
+}
+
+func (r *ClientCredentialsRequest) GetSubject() string {
+	return r.ClientID
+}
+
+// PushedAuthRequest holds the parameters a client pushed to the PAR endpoint
+// until the browser brings the request_uri to the authorization endpoint.
+type PushedAuthRequest struct {
+	ID         string              `json:"id"`
+	ClientID   string              `json:"client_id"`
+	Params     map[string][]string `json:"params"`
+	Expiration time.Time           `json:"expiration"`
+}
+
+// ClientAssertion records the jti of a client assertion until it expires, so
+// that the assertion cannot be replayed.
+type ClientAssertion struct {
+	ClientID   string    `json:"client_id"`
+	JTI        string    `json:"jti"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// TOTPStep records the last time step a user's one-time password was
+// accepted for, so that no code is accepted twice.
+type TOTPStep struct {
+	UserID     string    `json:"user_id"`
+	Step       int64     `json:"step"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// Passkey is a WebAuthn credential registered by a user, keyed by its
+// base64url credential id. PublicKey is the COSE key.
+type Passkey struct {
+	ID             string    `json:"id"`
+	UserID         string    `json:"user_id"`
+	PublicKey      []byte    `json:"public_key"`
+	SignCount      uint32    `json:"sign_count"`
+	BackupEligible bool      `json:"backup_eligible,omitempty"`
+	Transports     []string  `json:"transports,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at,omitzero"`
+}
+
+// WebAuthnChallenge is the challenge of a passkey ceremony in progress:
+// signing in to AuthRequestID, or registering a passkey for UserID.
+type WebAuthnChallenge struct {
+	Challenge               string    `json:"challenge"`
+	AuthRequestID           string    `json:"auth_request_id,omitempty"`
+	UserID                  string    `json:"user_id,omitempty"`
+	RequireUserVerification bool      `json:"require_user_verification,omitempty"`
+	Expiration              time.Time `json:"expiration"`
+}
+
+// LoginFailures counts the failed password sign-ins of a username or a
+// client address, keyed by "user:" or "ip:" and the name. Failed attempts
+// are refused until NextAttempt; LockedUntil is set once the limit is
+// reached.
+type LoginFailures struct {
+	Key         string    `json:"key"`
+	Failures    uint32    `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LockedUntil time.Time `json:"locked_until"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+// DPoPProof records the jti of a DPoP proof for as long as the proof would
+// be accepted, so that it cannot be replayed.
+type DPoPProof struct {
+	KeyThumbprint string    `json:"key_thumbprint"`
+	JTI           string    `json:"jti"`
+	Expiration    time.Time `json:"expiration"`
+}
+
+type DeviceAuthorization struct {
+	DeviceCode string    `json:"device_code"`
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	Scopes     []string  `json:"scopes"`
+	Expires    time.Time `json:"expires"`
+	Subject    string    `json:"subject,omitempty"`
+	AMR        []string  `json:"amr,omitempty"`
+	AuthTime   time.Time `json:"auth_time,omitzero"`
+	Done       bool      `json:"done"`
+	Denied     bool      `json:"denied"`
+	// OTPAttempts counts wrong one-time passwords entered for it.
+	OTPAttempts int `json:"otp_attempts,omitempty"`
+}
+
+func (d *DeviceAuthorization) state() *op.DeviceAuthorizationState {
+	return &op.DeviceAuthorizationState{
+		ClientID: d.ClientID,
+		Scopes:   d.Scopes,
+		Expires:  d.Expires,
+		Done:     d.Done,
+		Denied:   d.Denied,
+		Subject:  d.Subject,
+		AMR:      d.AMR,
+		AuthTime: d.AuthTime,
+	}
+}
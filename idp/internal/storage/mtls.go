@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+)
+
+type clientCertificateKey struct{}
+
+// WithClientCertificate passes the certificate the client presented, over
+// TLS or through a trusted proxy, to the storage.
+func WithClientCertificate(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, clientCertificateKey{}, cert)
+}
+
+// ClientCertificate returns the certificate the client presented, or nil.
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(clientCertificateKey{}).(*x509.Certificate)
+	return cert
+}
+
+// CertificateThumbprint is the x5t#S256 confirmation of a certificate
+// (RFC 8705 3.1).
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// certificateBinding returns the thumbprint that access tokens issued to the
+// client are bound to, or "" when the client does not bind its tokens.
+func (s *Storage) certificateBinding(ctx context.Context, clientID string) string {
+	client, ok := s.client(clientID)
+	if !ok || !client.CertificateBoundAccessTokens() {
+		return ""
+	}
+	cert := ClientCertificate(ctx)
+	if cert == nil {
+		return ""
+	}
+	return CertificateThumbprint(cert)
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SavePushedAuthRequest stores the parameters of a pushed authorization
+// request for the pushed auth request lifetime.
+func (s *Storage) SavePushedAuthRequest(ctx context.Context, clientID string, params url.Values) (*PushedAuthRequest, error) {
+	request := &PushedAuthRequest{
+		ID:         uuid.NewString(),
+		ClientID:   clientID,
+		Params:     params,
+		Expiration: time.Now().Add(s.lifetimes.PushedAuthRequest),
+	}
+	err := s.db.Update(func(tx Tx) error {
+		return tx.Put(bucketPushedAuthRequests, request.ID, request)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save pushed auth request: %w", err)
+	}
+	return request, nil
+}
+
+// ConsumePushedAuthRequest returns the request the client pushed and deletes
+// it, so that every request_uri is used once. Another client's request is
+// left in place.
+func (s *Storage) ConsumePushedAuthRequest(ctx context.Context, id, clientID string) (*PushedAuthRequest, error) {
+	var request PushedAuthRequest
+	err := s.db.Update(func(tx Tx) error {
+		if err := tx.Get(bucketPushedAuthRequests, id, &request); err != nil {
+			return err
+		}
+		if request.ClientID != clientID {
+			return fmt.Errorf("request was pushed by another client")
+		}
+		return tx.Delete(bucketPushedAuthRequests, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(request.Expiration) {
+		return nil, errors.New("pushed auth request has expired")
+	}
+	return &request, nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"idp/internal/data"
+)
+
+// Authentication methods (RFC 8176) of a passkey sign-in.
+const (
+	amrHardwareKey  = "hwk"
+	amrUserPresence = "user"
+)
+
+var (
+	// ErrPasskeyExists is returned when a credential id is registered again.
+	ErrPasskeyExists = errors.New("passkey is already registered")
+	// ErrPasskeyCounter is returned when the signature counter of a passkey
+	// went backwards, which means it was cloned.
+	ErrPasskeyCounter = errors.New("passkey signature counter did not increase")
+)
+
+// UserByID returns the user from users.json, or nil if there is none.
+func (s *Storage) UserByID(id string) *data.User {
+	return s.users().GetUserByID(id)
+}
+
+// SaveWebAuthnChallenge stores the challenge of a ceremony that was started.
+func (s *Storage) SaveWebAuthnChallenge(ctx context.Context, challenge *WebAuthnChallenge) error {
+	return s.db.Update(func(tx Tx) error {
+		return tx.Put(bucketWebAuthnChallenges, challenge.Challenge, challenge)
+	})
+}
+
+// TakeWebAuthnChallenge returns the stored challenge and deletes it, so that
+// every challenge completes one ceremony at most.
+func (s *Storage) TakeWebAuthnChallenge(ctx context.Context, challenge string) (*WebAuthnChallenge, error) {
+	var stored WebAuthnChallenge
+	err := s.db.Update(func(tx Tx) error {
+		if err := tx.Get(bucketWebAuthnChallenges, challenge, &stored); err != nil {
+			return err
+		}
+		return tx.Delete(bucketWebAuthnChallenges, challenge)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.Expiration) {
+		return nil, ErrNotFound
+	}
+	return &stored, nil
+}
+
+// AddPasskey registers a passkey for its user.
+func (s *Storage) AddPasskey(ctx context.Context, passkey *Passkey) error {
+	return s.db.Update(func(tx Tx) error {
+		err := tx.Get(bucketPasskeys, passkey.ID, &Passkey{})
+		switch {
+		case err == nil:
+			return ErrPasskeyExists
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+		return tx.Put(bucketPasskeys, passkey.ID, passkey)
+	})
+}
+
+// Passkeys returns the user's passkeys, oldest first.
+func (s *Storage) Passkeys(ctx context.Context, userID string) ([]Passkey, error) {
+	var passkeys []Passkey
+	err := s.db.View(func(tx Tx) error {
+		return tx.ForEach(bucketPasskeys, func(_ string, raw []byte) error {
+			var passkey Passkey
+			if err := json.Unmarshal(raw, &passkey); err != nil {
+				return err
+			}
+			if passkey.UserID == userID {
+				passkeys = append(passkeys, passkey)
+			}
+			return nil
+		})
+	})
+	slices.SortFunc(passkeys, func(a, b Passkey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return passkeys, err
+}
+
+// PasskeyByID returns the passkey with the base64url credential id.
+func (s *Storage) PasskeyByID(ctx context.Context, id string) (*Passkey, error) {
+	var passkey Passkey
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketPasskeys, id, &passkey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+// DeletePasskey removes one of the user's passkeys.
+func (s *Storage) DeletePasskey(ctx context.Context, userID, id string) error {
+	return s.db.Update(func(tx Tx) error {
+		var passkey Passkey
+		if err := tx.Get(bucketPasskeys, id, &passkey); err != nil {
+			return fmt.Errorf("passkey not found: %w", err)
+		}
+		if passkey.UserID != userID {
+			return fmt.Errorf("passkey not found: %w", ErrNotFound)
+		}
+		return tx.Delete(bucketPasskeys, id)
+	})
+}
+
+// CheckPasskey marks the auth request as authenticated by the user of the
+// passkey, whose assertion was verified with the given signature counter. A
+// passkey that verified the user counts as two factors.
+func (s *Storage) CheckPasskey(ctx context.Context, id, passkeyID string, signCount uint32, userVerified bool) error {
+	return s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, id, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		var passkey Passkey
+		if err := tx.Get(bucketPasskeys, passkeyID, &passkey); err != nil {
+			return fmt.Errorf("passkey not found: %w", err)
+		}
+		if s.users().GetUserByID(passkey.UserID) == nil {
+			return fmt.Errorf("user %s of passkey not found", passkey.UserID)
+		}
+		if request.RequireMFA && !userVerified {
+			return ErrMFANotEnrolled
+		}
+		// authenticators without a counter always report zero
+		if (signCount != 0 || passkey.SignCount != 0) && signCount <= passkey.SignCount {
+			return ErrPasskeyCounter
+		}
+
+		now := time.Now()
+		passkey.SignCount = signCount
+		passkey.LastUsedAt = now
+		if err := tx.Put(bucketPasskeys, passkeyID, &passkey); err != nil {
+			return err
+		}
+
+		request.UserID = passkey.UserID
+		request.AMR = []string{amrHardwareKey, amrUserPresence}
+		if userVerified {
+			request.AMR = append(request.AMR, amrMFA)
+		}
+		request.OTPAttempts = 0
+		request.Authenticated = true
+		request.AuthTime = now
+		consent, err := s.consentRequired(tx, &request)
+		if err != nil {
+			return err
+		}
+		request.Consented = !consent
+		return tx.Put(bucketAuthRequests, id, &request)
+	})
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. Its whole family has been revoked by then.
+var ErrRefreshTokenReused = errors.New("refresh token was already used")
+
+func (r *RefreshToken) family() string {
+	if r.FamilyID == "" {
+		return r.ID
+	}
+	return r.FamilyID
+}
+
+// withRefreshToken runs fn with the refresh token in a read/write
+// transaction. A rotated token means that it leaked or a client replayed it,
+// so its family is revoked, and that revocation is committed although the
+// caller gets an error.
+func (s *Storage) withRefreshToken(id string, fn func(tx Tx, token *RefreshToken) error) error {
+	var reused *RefreshToken
+	err := s.db.Update(func(tx Tx) error {
+		var token RefreshToken
+		if err := tx.Get(bucketRefreshTokens, id, &token); err != nil {
+			return fmt.Errorf("invalid refresh token: %w", err)
+		}
+		if token.rotated() {
+			reused = &token
+			return revokeFamily(tx, token.family())
+		}
+		if time.Now().After(token.Expiration) {
+			return errors.New("expired refresh token")
+		}
+		return fn(tx, &token)
+	})
+	if err != nil {
+		return err
+	}
+	if reused != nil {
+		s.logger.Warn("rotated refresh token presented again, revoked its family",
+			"client_id", reused.ClientID,
+			"user_id", reused.UserID,
+			"family_id", reused.family(),
+			"rotated_at", reused.RotatedAt,
+		)
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+// revokeFamily deletes every refresh token of the family together with the
+// access tokens issued alongside them.
+func revokeFamily(tx Tx, familyID string) error {
+	var refreshTokens, accessTokens []string
+	err := tx.ForEach(bucketRefreshTokens, func(key string, raw []byte) error {
+		var token RefreshToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return err
+		}
+		if token.family() == familyID {
+			refreshTokens = append(refreshTokens, key)
+			accessTokens = append(accessTokens, token.AccessTokenID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range accessTokens {
+		if err := tx.Delete(bucketAccessTokens, id); err != nil {
+			return err
+		}
+	}
+	for _, id := range refreshTokens {
+		if err := tx.Delete(bucketRefreshTokens, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
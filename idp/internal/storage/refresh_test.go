@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// issueRefreshTokens starts a refresh token family for user-1 at client and
+// rotates it n times. It returns the refresh and access token ids in order.
+func issueRefreshTokens(t *testing.T, s *Storage, client string, n int) (refreshTokens, accessTokens []string) {
+	t.Helper()
+	request := &AuthRequest{ClientID: client, UserID: "user-1", Scopes: []string{"openid", "offline_access"}}
+	var current string
+	for range n + 1 {
+		accessToken, refreshToken, _, err := s.CreateAccessAndRefreshTokens(context.Background(), request, current)
+		if err != nil {
+			t.Fatalf("CreateAccessAndRefreshTokens: %v", err)
+		}
+		refreshTokens = append(refreshTokens, refreshToken)
+		accessTokens = append(accessTokens, accessToken)
+		current = refreshToken
+	}
+	return refreshTokens, accessTokens
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		refreshTokens, accessTokens := issueRefreshTokens(t, s, "first-party", 2)
+
+		var first, last RefreshToken
+		if err := getRecord(t, s, bucketRefreshTokens, refreshTokens[0], &first); err != nil {
+			t.Fatal(err)
+		}
+		if err := getRecord(t, s, bucketRefreshTokens, refreshTokens[2], &last); err != nil {
+			t.Fatal(err)
+		}
+		if !first.rotated() || last.rotated() {
+			t.Errorf("rotated = %t and %t, want only the first token rotated", first.rotated(), last.rotated())
+		}
+		if last.FamilyID != first.ID || !last.FamilyExpiration.Equal(first.FamilyExpiration) {
+			t.Errorf("last token family %s expiring %v, want %s expiring %v", last.FamilyID, last.FamilyExpiration, first.ID, first.FamilyExpiration)
+		}
+		// the access token of a rotated refresh token is revoked with it
+		var accessToken AccessToken
+		if err := getRecord(t, s, bucketAccessTokens, accessTokens[0], &accessToken); !errors.Is(err, ErrNotFound) {
+			t.Errorf("access token of the rotated refresh token: %v, want %v", err, ErrNotFound)
+		}
+		if _, err := s.TokenRequestByRefreshToken(context.Background(), refreshTokens[2]); err != nil {
+			t.Errorf("TokenRequestByRefreshToken(current): %v", err)
+		}
+	})
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		family, familyAccess := issueRefreshTokens(t, s, "first-party", 2)
+		other, otherAccess := issueRefreshTokens(t, s, "first-party", 1)
+
+		_, err := s.TokenRequestByRefreshToken(context.Background(), family[1])
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("TokenRequestByRefreshToken(rotated) = %v, want %v", err, ErrRefreshTokenReused)
+		}
+
+		// the revocation is committed although the request failed
+		for i, id := range family {
+			var token RefreshToken
+			if err := getRecord(t, s, bucketRefreshTokens, id, &token); !errors.Is(err, ErrNotFound) {
+				t.Errorf("refresh token %d of the family: %v, want %v", i, err, ErrNotFound)
+			}
+			var accessToken AccessToken
+			if err := getRecord(t, s, bucketAccessTokens, familyAccess[i], &accessToken); !errors.Is(err, ErrNotFound) {
+				t.Errorf("access token %d of the family: %v, want %v", i, err, ErrNotFound)
+			}
+		}
+		_, _, _, err = s.CreateAccessAndRefreshTokens(context.Background(), &AuthRequest{ClientID: "first-party", UserID: "user-1"}, family[2])
+		if err == nil {
+			t.Error("the newest token of the revoked family could still be rotated")
+		}
+
+		// other families of the same user and client are left alone
+		if _, err := s.TokenRequestByRefreshToken(context.Background(), other[1]); err != nil {
+			t.Errorf("TokenRequestByRefreshToken(other family): %v", err)
+		}
+		var accessToken AccessToken
+		if err := getRecord(t, s, bucketAccessTokens, otherAccess[1], &accessToken); err != nil {
+			t.Errorf("access token of the other family: %v", err)
+		}
+	})
+}
+
+func TestRevokeRefreshTokenRevokesFamily(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		s := newTestStorage(t, db)
+		family, _ := issueRefreshTokens(t, s, "first-party", 1)
+
+		if err := s.RevokeToken(context.Background(), family[1], "user-1", "third-party"); err == nil {
+			t.Error("RevokeToken accepted a token of another client")
+		}
+		if err := s.RevokeToken(context.Background(), family[1], "user-1", "first-party"); err != nil {
+			t.Fatalf("RevokeToken: %v", err)
+		}
+		for i, id := range family {
+			var token RefreshToken
+			if err := getRecord(t, s, bucketRefreshTokens, id, &token); !errors.Is(err, ErrNotFound) {
+				t.Errorf("refresh token %d of the family: %v, want %v", i, err, ErrNotFound)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CreateSession records the sign-in through the auth request in the
+// browser's session. A valid previous session of the same user is kept with
+// the new auth_time; otherwise a new session replaces it and the previous one
+// is returned as ended.
+func (s *Storage) CreateSession(ctx context.Context, authRequestID, previousID string) (session, ended *Session, err error) {
+	err = s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, authRequestID, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		if !request.Authenticated {
+			return errors.New("request is not authenticated")
+		}
+
+		now := time.Now()
+		if previousID != "" {
+			var previous Session
+			err := tx.Get(bucketSessions, previousID, &previous)
+			switch {
+			case err == nil && previous.UserID == request.UserID && now.Before(previous.Expiration):
+				session = &previous
+			case err == nil:
+				ended = &previous
+				if err := tx.Delete(bucketSessions, previousID); err != nil {
+					return err
+				}
+			case !errors.Is(err, ErrNotFound):
+				return err
+			}
+		}
+		if session == nil {
+			session = &Session{
+				ID:         uuid.NewString(),
+				UserID:     request.UserID,
+				CreatedAt:  now,
+				Expiration: now.Add(s.lifetimes.Session),
+			}
+		}
+		session.AuthTime = request.AuthTime
+		session.AMR = request.GetAMR()
+		session.join(request.ClientID)
+
+		request.SessionID = session.ID
+		if err := tx.Put(bucketAuthRequests, authRequestID, &request); err != nil {
+			return err
+		}
+		return tx.Put(bucketSessions, session.ID, session)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, ended, nil
+}
+
+// SessionByID returns the session unless it has expired or its user no
+// longer exists.
+func (s *Storage) SessionByID(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketSessions, id, &session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expiration) {
+		return nil, ErrNotFound
+	}
+	if s.users().GetUserByID(session.UserID) == nil {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+// ResumeSession authenticates the auth request with an existing session. The
+// request keeps the session's auth_time, so max_age and the ID token refer to
+// when the user actually entered their password, and the factors they used.
+func (s *Storage) ResumeSession(ctx context.Context, authRequestID string, session *Session) error {
+	return s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, authRequestID, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		request.UserID = session.UserID
+		request.Authenticated = true
+		request.AuthTime = session.AuthTime
+		request.AMR = session.AMR
+		request.SessionID = session.ID
+
+		var stored Session
+		if err := tx.Get(bucketSessions, session.ID, &stored); err != nil {
+			return fmt.Errorf("session not found: %w", err)
+		}
+		stored.join(request.ClientID)
+		if err := tx.Put(bucketSessions, stored.ID, &stored); err != nil {
+			return err
+		}
+
+		consent, err := s.consentRequired(tx, &request)
+		if err != nil {
+			return err
+		}
+		request.Consented = !consent
+		return tx.Put(bucketAuthRequests, authRequestID, &request)
+	})
+}
+
+// EndSession deletes the session and returns it, or nil if it did not
+// exist.
+func (s *Storage) EndSession(ctx context.Context, id string) (*Session, error) {
+	var session *Session
+	err := s.db.Update(func(tx Tx) error {
+		var stored Session
+		err := tx.Get(bucketSessions, id, &stored)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session = &stored
+		return tx.Delete(bucketSessions, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
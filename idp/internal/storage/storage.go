@@ -0,0 +1,673 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/google/uuid"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+
+	"idp/internal/config"
+	"idp/internal/data"
+)
+
+var (
+	_ op.Storage                    = (*Storage)(nil)
+	_ op.CanSetUserinfoFromRequest  = (*Storage)(nil)
+	_ op.DeviceAuthorizationStorage = (*Storage)(nil)
+)
+
+// SigningKeys provides the keys used to sign and verify tokens.
+type SigningKeys interface {
+	SigningKey(context.Context) (op.SigningKey, error)
+	SignatureAlgorithms(context.Context) ([]jose.SignatureAlgorithm, error)
+	KeySet(context.Context) ([]op.Key, error)
+}
+
+// Storage implements op.Storage on top of a Backend. Clients and users are
+// read from the data package and can be replaced at runtime; everything
+// issued at runtime lives in the backend.
+type Storage struct {
+	db         Backend
+	dir        atomic.Pointer[directory]
+	keys       SigningKeys
+	remoteKeys *remoteKeySets
+	lifetimes  config.TokenLifetimes
+	logger     *slog.Logger
+}
+
+// directory is the client and user set that is swapped as a whole on reload.
+type directory struct {
+	clients map[string]*data.Client
+	users   *data.UserStore
+}
+
+func New(db Backend, clients []*data.Client, users *data.UserStore, keys SigningKeys, lifetimes config.TokenLifetimes, logger *slog.Logger) *Storage {
+	s := &Storage{
+		db:         db,
+		keys:       keys,
+		remoteKeys: newRemoteKeySets(),
+		lifetimes:  lifetimes,
+		logger:     logger.With("component", "storage"),
+	}
+	s.Replace(clients, users)
+	return s
+}
+
+// Replace swaps the client and user set. Requests already in flight finish
+// with the set they started with.
+func (s *Storage) Replace(clients []*data.Client, users *data.UserStore) {
+	byID := make(map[string]*data.Client, len(clients))
+	for _, client := range clients {
+		byID[client.GetID()] = client
+	}
+	s.dir.Store(&directory{clients: byID, users: users})
+}
+
+func (s *Storage) client(id string) (*data.Client, bool) {
+	client, ok := s.dir.Load().clients[id]
+	return client, ok
+}
+
+func (s *Storage) users() *data.UserStore {
+	return s.dir.Load().users
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// CheckUsernamePassword verifies the credentials and marks the auth request
+// as authenticated for the user.
+func (s *Storage) CheckUsernamePassword(username, password, id string) error {
+	user, err := s.users().Authenticate(username, password)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, id, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		if request.RequireMFA && !user.TOTPEnrolled() {
+			return ErrMFANotEnrolled
+		}
+		request.UserID = user.ID
+		request.AMR = []string{amrPassword}
+		request.OTPAttempts = 0
+		if user.TOTPEnrolled() {
+			// the second factor completes the request in CheckTOTP
+			request.Authenticated = false
+			return tx.Put(bucketAuthRequests, id, &request)
+		}
+		request.Authenticated = true
+		request.AuthTime = time.Now()
+
+		consent, err := s.consentRequired(tx, &request)
+		if err != nil {
+			return err
+		}
+		request.Consented = !consent
+		return tx.Put(bucketAuthRequests, id, &request)
+	})
+}
+
+// AuthenticateUser verifies the credentials and returns the subject of the
+// user. It is used by flows that are not bound to an auth request.
+func (s *Storage) AuthenticateUser(username, password string) (string, error) {
+	user, err := s.users().Authenticate(username, password)
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// CreateAuthRequest stores the request. prompt=none is answered by the login
+// UI, which is the one that knows about the browser's session.
+func (s *Storage) CreateAuthRequest(ctx context.Context, authReq *oidc.AuthRequest, userID string) (op.AuthRequest, error) {
+	request := newAuthRequest(authReq, userID)
+	request.ID = uuid.NewString()
+	request.RequireMFA = s.MFARequired(request.ClientID, request.ACRValues)
+
+	err := s.db.Update(func(tx Tx) error {
+		return tx.Put(bucketAuthRequests, request.ID, request)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (s *Storage) AuthRequestByID(ctx context.Context, id string) (op.AuthRequest, error) {
+	var request AuthRequest
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketAuthRequests, id, &request)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("request not found: %w", err)
+	}
+	return &request, nil
+}
+
+func (s *Storage) AuthRequestByCode(ctx context.Context, code string) (op.AuthRequest, error) {
+	var request AuthRequest
+	err := s.db.View(func(tx Tx) error {
+		var id string
+		if err := tx.Get(bucketAuthCodes, code, &id); err != nil {
+			return err
+		}
+		return tx.Get(bucketAuthRequests, id, &request)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("code invalid or expired: %w", err)
+	}
+	return &request, nil
+}
+
+func (s *Storage) SaveAuthCode(ctx context.Context, id string, code string) error {
+	return s.db.Update(func(tx Tx) error {
+		var request AuthRequest
+		if err := tx.Get(bucketAuthRequests, id, &request); err != nil {
+			return fmt.Errorf("request not found: %w", err)
+		}
+		request.Code = code
+		if err := tx.Put(bucketAuthRequests, id, &request); err != nil {
+			return err
+		}
+		return tx.Put(bucketAuthCodes, code, id)
+	})
+}
+
+func (s *Storage) DeleteAuthRequest(ctx context.Context, id string) error {
+	return s.db.Update(func(tx Tx) error {
+		return deleteAuthRequest(tx, id)
+	})
+}
+
+// revokeTokens deletes every access and refresh token issued to the client
+// for the user.
+func revokeTokens(tx Tx, userID, clientID string) error {
+	var accessTokens []string
+	err := tx.ForEach(bucketAccessTokens, func(key string, raw []byte) error {
+		var token AccessToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return err
+		}
+		if token.ClientID == clientID && token.Subject == userID {
+			accessTokens = append(accessTokens, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var refreshTokens []string
+	err = tx.ForEach(bucketRefreshTokens, func(key string, raw []byte) error {
+		var token RefreshToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return err
+		}
+		if token.ClientID == clientID && token.UserID == userID {
+			refreshTokens = append(refreshTokens, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range accessTokens {
+		if err := tx.Delete(bucketAccessTokens, id); err != nil {
+			return err
+		}
+	}
+	for _, id := range refreshTokens {
+		if err := tx.Delete(bucketRefreshTokens, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteAuthRequest(tx Tx, id string) error {
+	var request AuthRequest
+	err := tx.Get(bucketAuthRequests, id, &request)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if request.Code != "" {
+		if err := tx.Delete(bucketAuthCodes, request.Code); err != nil {
+			return err
+		}
+	}
+	return tx.Delete(bucketAuthRequests, id)
+}
+
+// clientIDOf returns the client a token request was made by, for the request
+// types that carry one.
+func clientIDOf(request op.TokenRequest) string {
+	if req, ok := request.(interface{ GetClientID() string }); ok {
+		return req.GetClientID()
+	}
+	return ""
+}
+
+// sessionIDOf returns the browser session a token request originates from.
+func sessionIDOf(request op.TokenRequest) string {
+	if req, ok := request.(interface{ GetSessionID() string }); ok {
+		return req.GetSessionID()
+	}
+	return ""
+}
+
+func (s *Storage) CreateAccessToken(ctx context.Context, request op.TokenRequest) (string, time.Time, error) {
+	token := s.newAccessToken(ctx, clientIDOf(request), "", request)
+	if exchange, ok := request.(op.TokenExchangeRequest); ok {
+		actor, err := s.exchangeActor(exchange)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		token.Actor = actor
+	}
+
+	err := s.db.Update(func(tx Tx) error {
+		return tx.Put(bucketAccessTokens, token.ID, token)
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.ID, token.Expiration, nil
+}
+
+func (s *Storage) newAccessToken(ctx context.Context, clientID, refreshTokenID string, request op.TokenRequest) *AccessToken {
+	now := time.Now()
+	return &AccessToken{
+		ID:                    uuid.NewString(),
+		ClientID:              clientID,
+		Subject:               request.GetSubject(),
+		RefreshTokenID:        refreshTokenID,
+		Audience:              request.GetAudience(),
+		Scopes:                request.GetScopes(),
+		IssuedAt:              now,
+		Expiration:            now.Add(s.lifetimes.AccessToken),
+		CertificateThumbprint: s.certificateBinding(ctx, clientID),
+		DPoPKeyThumbprint:     DPoPKey(ctx),
+	}
+}
+
+// CreateAccessAndRefreshTokens starts a new refresh token family, or rotates
+// currentRefreshToken within its family when it is given.
+func (s *Storage) CreateAccessAndRefreshTokens(ctx context.Context, request op.TokenRequest, currentRefreshToken string) (string, string, time.Time, error) {
+	clientID := clientIDOf(request)
+
+	var authTime time.Time
+	var amr []string
+	if req, ok := request.(op.IDTokenRequest); ok {
+		authTime = req.GetAuthTime()
+		amr = req.GetAMR()
+	}
+	sessionID := sessionIDOf(request)
+
+	now := time.Now()
+	refreshTokenID := uuid.NewString()
+	accessToken := s.newAccessToken(ctx, clientID, refreshTokenID, request)
+	refreshToken := &RefreshToken{
+		ID:                refreshTokenID,
+		FamilyID:          refreshTokenID,
+		SessionID:         sessionID,
+		AuthTime:          authTime,
+		AMR:               amr,
+		Audience:          accessToken.Audience,
+		UserID:            accessToken.Subject,
+		ClientID:          clientID,
+		Scopes:            accessToken.Scopes,
+		AccessTokenID:     accessToken.ID,
+		FamilyExpiration:  now.Add(s.lifetimes.RefreshTokenAbsolute),
+		DPoPKeyThumbprint: s.refreshTokenBinding(ctx, clientID),
+	}
+
+	store := func(tx Tx) error {
+		refreshToken.Expiration = now.Add(s.lifetimes.RefreshTokenIdle)
+		if refreshToken.Expiration.After(refreshToken.FamilyExpiration) {
+			refreshToken.Expiration = refreshToken.FamilyExpiration
+		}
+		if err := tx.Put(bucketAccessTokens, accessToken.ID, accessToken); err != nil {
+			return err
+		}
+		return tx.Put(bucketRefreshTokens, refreshToken.ID, refreshToken)
+	}
+
+	var err error
+	if currentRefreshToken == "" {
+		err = s.db.Update(store)
+	} else {
+		err = s.withRefreshToken(currentRefreshToken, func(tx Tx, current *RefreshToken) error {
+			current.RotatedAt = now
+			if err := tx.Put(bucketRefreshTokens, current.ID, current); err != nil {
+				return err
+			}
+			if err := tx.Delete(bucketAccessTokens, current.AccessTokenID); err != nil {
+				return err
+			}
+			refreshToken.FamilyID = current.family()
+			if !current.FamilyExpiration.IsZero() {
+				refreshToken.FamilyExpiration = current.FamilyExpiration
+			}
+			refreshToken.SessionID = current.SessionID
+			refreshToken.AuthTime = current.AuthTime
+			refreshToken.AMR = current.AMR
+			return store(tx)
+		})
+	}
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return accessToken.ID, refreshTokenID, accessToken.Expiration, nil
+}
+
+func (s *Storage) TokenRequestByRefreshToken(ctx context.Context, refreshToken string) (op.RefreshTokenRequest, error) {
+	var token RefreshToken
+	err := s.withRefreshToken(refreshToken, func(_ Tx, current *RefreshToken) error {
+		token = *current
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh_token: %w", err)
+	}
+	if token.DPoPKeyThumbprint != "" && DPoPKey(ctx) != token.DPoPKeyThumbprint {
+		return nil, errors.New("invalid refresh_token: bound to another DPoP key")
+	}
+	return &RefreshTokenRequest{&token}, nil
+}
+
+// TerminateSession ends the user's session at the client by revoking the
+// tokens issued to it. Without an id_token_hint the user is unknown and there
+// is nothing to revoke.
+func (s *Storage) TerminateSession(ctx context.Context, userID string, clientID string) error {
+	if userID == "" {
+		return nil
+	}
+	s.logger.Info("terminating session", "user_id", userID, "client_id", clientID)
+	return s.db.Update(func(tx Tx) error {
+		return revokeTokens(tx, userID, clientID)
+	})
+}
+
+func (s *Storage) GetRefreshTokenInfo(ctx context.Context, clientID string, token string) (string, string, error) {
+	var refreshToken RefreshToken
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketRefreshTokens, token, &refreshToken)
+	})
+	if err != nil {
+		return "", "", op.ErrInvalidRefreshToken
+	}
+	return refreshToken.UserID, refreshToken.ID, nil
+}
+
+func (s *Storage) RevokeToken(ctx context.Context, tokenOrTokenID string, userID string, clientID string) *oidc.Error {
+	var result *oidc.Error
+	err := s.db.Update(func(tx Tx) error {
+		var accessToken AccessToken
+		err := tx.Get(bucketAccessTokens, tokenOrTokenID, &accessToken)
+		if err == nil {
+			if accessToken.ClientID != clientID {
+				result = oidc.ErrInvalidClient().WithDescription("token was not issued for this client")
+				return nil
+			}
+			return tx.Delete(bucketAccessTokens, accessToken.ID)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		var refreshToken RefreshToken
+		err = tx.Get(bucketRefreshTokens, tokenOrTokenID, &refreshToken)
+		if errors.Is(err, ErrNotFound) {
+			// unknown tokens are already as revoked as they can be
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if refreshToken.ClientID != clientID {
+			result = oidc.ErrInvalidClient().WithDescription("token was not issued for this client")
+			return nil
+		}
+		return revokeFamily(tx, refreshToken.family())
+	})
+	if err != nil {
+		return oidc.ErrServerError().WithParent(err)
+	}
+	return result
+}
+
+func (s *Storage) SigningKey(ctx context.Context) (op.SigningKey, error) {
+	return s.keys.SigningKey(ctx)
+}
+
+func (s *Storage) SignatureAlgorithms(ctx context.Context) ([]jose.SignatureAlgorithm, error) {
+	return s.keys.SignatureAlgorithms(ctx)
+}
+
+func (s *Storage) KeySet(ctx context.Context) ([]op.Key, error) {
+	return s.keys.KeySet(ctx)
+}
+
+func (s *Storage) GetClientByClientID(ctx context.Context, clientID string) (op.Client, error) {
+	client, ok := s.client(clientID)
+	if !ok {
+		return nil, oidc.ErrInvalidClient().WithDescription("client not found")
+	}
+	return providerClient{Client: client, idTokenLifetime: s.lifetimes.IDToken}, nil
+}
+
+// providerClient applies provider wide settings to a client.
+type providerClient struct {
+	*data.Client
+	idTokenLifetime time.Duration
+}
+
+func (c providerClient) IDTokenLifetime() time.Duration {
+	return c.idTokenLifetime
+}
+
+// AuthorizeClientIDSecret also accepts a client that authenticated with a
+// client assertion or certificate; clients registered for one of those
+// cannot use their secret.
+func (s *Storage) AuthorizeClientIDSecret(ctx context.Context, clientID, clientSecret string) error {
+	client, ok := s.client(clientID)
+	if !ok {
+		return fmt.Errorf("client not found")
+	}
+	if authenticatedClient(ctx) == clientID {
+		return nil
+	}
+	if method := client.VerifiedAuthMethod(); method != "" {
+		return fmt.Errorf("client must authenticate with %s", method)
+	}
+	if subtle.ConstantTimeCompare([]byte(client.Secret()), []byte(clientSecret)) != 1 {
+		return fmt.Errorf("invalid secret")
+	}
+	return nil
+}
+
+// SetUserinfoFromScopes is deprecated in favour of SetUserinfoFromRequest.
+func (s *Storage) SetUserinfoFromScopes(ctx context.Context, userinfo *oidc.UserInfo, userID, clientID string, scopes []string) error {
+	return nil
+}
+
+// SetUserinfoFromRequest also adds the sid claim to ID tokens of requests
+// that belong to a browser session, for back-channel logout.
+func (s *Storage) SetUserinfoFromRequest(ctx context.Context, userinfo *oidc.UserInfo, token op.IDTokenRequest, scopes []string) error {
+	if err := s.setUserinfo(userinfo, token.GetSubject(), scopes); err != nil {
+		return err
+	}
+	if sid := sessionIDOf(token); sid != "" {
+		userinfo.AppendClaims("sid", sid)
+	}
+	return nil
+}
+
+// SetUserinfoFromToken rejects a sender-constrained token that is presented
+// without its certificate or DPoP proof.
+func (s *Storage) SetUserinfoFromToken(ctx context.Context, userinfo *oidc.UserInfo, tokenID, subject, origin string) error {
+	token, err := s.accessToken(tokenID)
+	if err != nil {
+		return err
+	}
+	if err := checkBinding(ctx, token); err != nil {
+		return err
+	}
+	return s.setUserinfo(userinfo, token.Subject, token.Scopes)
+}
+
+// UserFromToken returns the user an access token was issued to, or nil
+// for a token of a client acting on its own behalf.
+func (s *Storage) UserFromToken(ctx context.Context, tokenID string) (*data.User, error) {
+	token, err := s.accessToken(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBinding(ctx, token); err != nil {
+		return nil, err
+	}
+	return s.users().GetUserByID(token.Subject), nil
+}
+
+// SetIntrospectionFromToken describes an access token to a resource server,
+// or to a client the token was issued to or for. Anyone else learns only
+// that the token is inactive.
+func (s *Storage) SetIntrospectionFromToken(ctx context.Context, introspection *oidc.IntrospectionResponse, tokenID, subject, clientID string) error {
+	token, err := s.accessToken(tokenID)
+	if err != nil {
+		return err
+	}
+	if !s.mayIntrospect(clientID, token) {
+		return fmt.Errorf("client %s may not introspect this token", clientID)
+	}
+
+	if token.Subject == token.ClientID {
+		// issued with client_credentials, there is no user to describe
+		introspection.Subject = token.Subject
+	} else {
+		userInfo := new(oidc.UserInfo)
+		if err := s.setUserinfo(userInfo, subject, token.Scopes); err != nil {
+			return err
+		}
+		introspection.SetUserInfo(userInfo)
+	}
+	introspection.Scope = token.Scopes
+	introspection.ClientID = token.ClientID
+	introspection.TokenType = oidc.BearerToken
+	introspection.Audience = token.Audience
+	introspection.Expiration = oidc.FromTime(token.Expiration)
+	introspection.IssuedAt = oidc.FromTime(token.IssuedAt)
+	introspection.Actor = token.Actor
+	if token.DPoPKeyThumbprint != "" {
+		introspection.TokenType = DPoPTokenType
+	}
+	if cnf := confirmation(token.CertificateThumbprint, token.DPoPKeyThumbprint); cnf != nil {
+		if introspection.Claims == nil {
+			introspection.Claims = make(map[string]any)
+		}
+		introspection.Claims["cnf"] = cnf
+	}
+	return nil
+}
+
+func (s *Storage) mayIntrospect(clientID string, token *AccessToken) bool {
+	if client, ok := s.client(clientID); ok && client.ResourceServer() {
+		return true
+	}
+	return token.ClientID == clientID || slices.Contains(token.Audience, clientID)
+}
+
+// accessToken loads an access token and rejects it once it has expired.
+func (s *Storage) accessToken(tokenID string) (*AccessToken, error) {
+	var token AccessToken
+	err := s.db.View(func(tx Tx) error {
+		return tx.Get(bucketAccessTokens, tokenID, &token)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token is invalid or has expired: %w", err)
+	}
+	if token.Expiration.Before(time.Now()) {
+		return nil, fmt.Errorf("token is expired")
+	}
+	return &token, nil
+}
+
+func (s *Storage) GetPrivateClaimsFromScopes(ctx context.Context, userID, clientID string, scopes []string) (map[string]any, error) {
+	return nil, nil
+}
+
+// GetPrivateClaimsFromRequest adds the granted scopes and the certificate or
+// DPoP key binding to JWT access tokens, which the provider leaves out.
+func (s *Storage) GetPrivateClaimsFromRequest(ctx context.Context, request op.TokenRequest, restrictedScopes []string) (map[string]any, error) {
+	claims := make(map[string]any)
+	if len(request.GetScopes()) > 0 {
+		claims["scope"] = strings.Join(request.GetScopes(), " ")
+	}
+	if cnf := confirmation(s.certificateBinding(ctx, clientIDOf(request)), DPoPKey(ctx)); cnf != nil {
+		claims["cnf"] = cnf
+	}
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+func (s *Storage) ValidateJWTProfileScopes(ctx context.Context, userID string, scopes []string) ([]string, error) {
+	allowed := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope == oidc.ScopeOpenID {
+			allowed = append(allowed, scope)
+		}
+	}
+	return allowed, nil
+}
+
+func (s *Storage) Health(ctx context.Context) error {
+	return s.db.View(func(Tx) error { return nil })
+}
+
+func (s *Storage) setUserinfo(userInfo *oidc.UserInfo, userID string, scopes []string) error {
+	user := s.users().GetUserByID(userID)
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case oidc.ScopeOpenID:
+			userInfo.Subject = user.ID
+		case oidc.ScopeEmail:
+			userInfo.Email = user.Email
+			userInfo.EmailVerified = oidc.Bool(user.EmailVerified)
+		case oidc.ScopeProfile:
+			userInfo.PreferredUsername = user.Username
+			userInfo.Name = user.FirstName + " " + user.LastName
+			userInfo.FamilyName = user.LastName
+			userInfo.GivenName = user.FirstName
+			userInfo.Locale = oidc.NewLocale(user.PreferredLanguage)
+		case oidc.ScopePhone:
+			userInfo.PhoneNumber = user.Phone
+			userInfo.PhoneNumberVerified = user.PhoneVerified
+		}
+	}
+	return nil
+}
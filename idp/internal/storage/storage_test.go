@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"idp/internal/config"
+	"idp/internal/data"
+	"idp/internal/password"
+)
+
+const testClients = `[
+  {"id": "first-party", "type": "web", "secret": "secret", "redirect_uris": ["https://app.example/callback"], "first_party": true},
+  {"id": "third-party", "type": "web", "secret": "secret", "redirect_uris": ["https://rp.example/callback"]}
+]`
+
+// newTestStorage returns a storage on db with the testClients and no users.
+func newTestStorage(t *testing.T, db Backend) *Storage {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "clients.json"), []byte(testClients), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hasher, err := password.NewHasher(config.PasswordsConfig{Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := data.LoadUserStore(filepath.Join(dir, "users.json"), hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := data.LoadClients(filepath.Join(dir, "clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(db, clients, users, nil, config.Default().Provider.Lifetimes, logger)
+}
+
+func TestAuthorizeClientIDSecret(t *testing.T) {
+	s := newTestStorage(t, NewMemoryBackend())
+	tests := []struct {
+		clientID, secret string
+		ok               bool
+	}{
+		{"third-party", "secret", true},
+		{"third-party", "secreT", false},
+		{"third-party", "secret ", false},
+		{"third-party", "", false},
+		{"unknown", "secret", false},
+	}
+	for _, test := range tests {
+		err := s.AuthorizeClientIDSecret(context.Background(), test.clientID, test.secret)
+		if (err == nil) != test.ok {
+			t.Errorf("AuthorizeClientIDSecret(%s, %q) = %v, want ok %t", test.clientID, test.secret, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+var _ op.TokenExchangeStorage = (*Storage)(nil)
+
+// ValidateTokenExchangeRequest applies the client's token exchange policy:
+// the subject token must be one of our access tokens issued to the client,
+// and the audiences and scopes must be allowed by the policy, the scopes
+// also by the subject token. Denied exchanges are logged for audit.
+func (s *Storage) ValidateTokenExchangeRequest(ctx context.Context, request op.TokenExchangeRequest) error {
+	if err := s.validateTokenExchange(request); err != nil {
+		s.logger.Warn("token exchange denied", append(exchangeAttrs(request), "error", err)...)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) validateTokenExchange(request op.TokenExchangeRequest) error {
+	clientID := request.GetClientID()
+	client, ok := s.client(clientID)
+	if !ok {
+		return oidc.ErrInvalidClient()
+	}
+	policy := client.TokenExchangePolicy()
+	if policy == nil {
+		return oidc.ErrUnauthorizedClient().WithDescription("client %s may not exchange tokens", clientID)
+	}
+
+	switch request.GetRequestedTokenType() {
+	case "":
+		request.SetRequestedTokenType(oidc.AccessTokenType)
+	case oidc.AccessTokenType:
+	default:
+		return oidc.ErrInvalidRequest().WithDescription("requested_token_type %s is not supported", request.GetRequestedTokenType())
+	}
+
+	subjectToken, err := s.exchangedToken(request.GetExchangeSubjectTokenType(), request.GetExchangeSubjectTokenIDOrToken())
+	if err != nil {
+		return oidc.ErrInvalidGrant().WithDescription("subject_token is invalid").WithParent(err)
+	}
+	if subjectToken.ClientID != clientID && !slices.Contains(subjectToken.Audience, clientID) {
+		return oidc.ErrInvalidGrant().WithDescription("subject_token was not issued to client %s", clientID)
+	}
+	if request.GetExchangeActorTokenIDOrToken() != "" {
+		actorToken, err := s.exchangedToken(request.GetExchangeActorTokenType(), request.GetExchangeActorTokenIDOrToken())
+		if err != nil {
+			return oidc.ErrInvalidGrant().WithDescription("actor_token is invalid").WithParent(err)
+		}
+		if actorToken.ClientID != clientID {
+			return oidc.ErrInvalidGrant().WithDescription("actor_token was not issued to client %s", clientID)
+		}
+	}
+
+	if len(request.GetResourses()) > 0 {
+		return oidc.ErrInvalidTarget().WithDescription("resource is not supported, request an audience instead")
+	}
+	if len(request.GetAudience()) == 0 {
+		return oidc.ErrInvalidTarget().WithDescription("audience is required")
+	}
+	for _, aud := range request.GetAudience() {
+		if !slices.Contains(policy.Audiences, aud) {
+			return oidc.ErrInvalidTarget().WithDescription("audience %s is not allowed for client %s", aud, clientID)
+		}
+	}
+
+	scopes := request.GetScopes()
+	if len(scopes) == 0 {
+		scopes = slices.DeleteFunc(slices.Clone(subjectToken.Scopes), func(scope string) bool {
+			return !slices.Contains(policy.Scopes, scope)
+		})
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(policy.Scopes, scope) || !slices.Contains(subjectToken.Scopes, scope) {
+			return oidc.ErrInvalidScope().WithDescription("scope %s cannot be exchanged by client %s", scope, clientID)
+		}
+	}
+	request.SetCurrentScopes(scopes)
+	return nil
+}
+
+// exchangedToken loads a subject or actor token. Only access tokens issued
+// by us can be exchanged; ID tokens are accepted by the provider even after
+// they expired.
+func (s *Storage) exchangedToken(tokenType oidc.TokenType, tokenID string) (*AccessToken, error) {
+	if tokenType != oidc.AccessTokenType {
+		return nil, errors.New("only access tokens can be exchanged")
+	}
+	return s.accessToken(tokenID)
+}
+
+// CreateTokenExchangeRequest records every granted exchange in the log.
+func (s *Storage) CreateTokenExchangeRequest(ctx context.Context, request op.TokenExchangeRequest) error {
+	actor, err := s.exchangeActor(request)
+	if err != nil {
+		return err
+	}
+	attrs := exchangeAttrs(request)
+	if actor != nil {
+		attrs = append(attrs, "act", actor.Subject)
+	} else {
+		attrs = append(attrs, "impersonation", true)
+	}
+	s.logger.Info("token exchange granted", attrs...)
+	return nil
+}
+
+func (s *Storage) GetPrivateClaimsFromTokenExchangeRequest(ctx context.Context, request op.TokenExchangeRequest) (map[string]any, error) {
+	claims, err := s.GetPrivateClaimsFromRequest(ctx, request, nil)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := s.exchangeActor(request)
+	if err != nil {
+		return nil, err
+	}
+	if actor != nil {
+		if claims == nil {
+			claims = make(map[string]any)
+		}
+		claims["act"] = actor
+	}
+	return claims, nil
+}
+
+func (s *Storage) SetUserinfoFromTokenExchangeRequest(ctx context.Context, userinfo *oidc.UserInfo, request op.TokenExchangeRequest) error {
+	return s.setUserinfo(userinfo, request.GetSubject(), request.GetScopes())
+}
+
+// exchangeActor returns the act claim of a token issued by the exchange,
+// naming the subject of the actor token or else the client, and nesting
+// the act claim the subject token already had. Impersonation keeps the
+// subject token's act claim as it is.
+func (s *Storage) exchangeActor(request op.TokenExchangeRequest) (*oidc.ActorClaims, error) {
+	subjectToken, err := s.accessToken(request.GetExchangeSubjectTokenIDOrToken())
+	if err != nil {
+		return nil, err
+	}
+
+	actor := request.GetExchangeActor()
+	if actor == "" {
+		client, ok := s.client(request.GetClientID())
+		if ok && client.TokenExchangePolicy() != nil && client.TokenExchangePolicy().Impersonation {
+			return subjectToken.Actor, nil
+		}
+		actor = request.GetClientID()
+	}
+	return &oidc.ActorClaims{Subject: actor, Actor: subjectToken.Actor}, nil
+}
+
+func exchangeAttrs(request op.TokenExchangeRequest) []any {
+	return []any{
+		"client_id", request.GetClientID(),
+		"subject", request.GetExchangeSubject(),
+		"actor", request.GetExchangeActor(),
+		"audience", strings.Join(request.GetAudience(), " "),
+		"scopes", strings.Join(request.GetScopes(), " "),
+	}
+}
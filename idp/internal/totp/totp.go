@@ -0,0 +1,97 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 as
+// authenticator apps use them: HMAC-SHA1, six digits and a 30 second step,
+// with the secret shared as unpadded base32.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is how long a code is valid.
+	Period = 30 * time.Second
+	digits = 6
+	// skew accepts codes from one step before and after the current one, for
+	// clocks that drift and users who type slowly.
+	skew = 1
+	// MinSecretLength is the minimum key length of RFC 4226 4.
+	MinSecretLength = 16
+	secretLength    = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret in base32.
+func GenerateSecret() (string, error) {
+	key := make([]byte, secretLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	return encoding.EncodeToString(key), nil
+}
+
+// DecodeSecret decodes a base32 secret, ignoring case, spaces and padding as
+// they appear when secrets are copied around.
+func DecodeSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := encoding.DecodeString(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("totp secret is not base32: %w", err)
+	}
+	if len(key) < MinSecretLength {
+		return nil, fmt.Errorf("totp secret must be at least %d bytes", MinSecretLength)
+	}
+	return key, nil
+}
+
+// Verify checks code against the steps around now and returns the step it
+// matched, so that the caller can refuse the same step twice.
+func Verify(key []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+	current := now.Unix() / int64(Period/time.Second)
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(generate(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// StepTime is when a step ends, after which its code is no longer accepted.
+func StepTime(step int64) time.Time {
+	return time.Unix((step+1+skew)*int64(Period/time.Second), 0)
+}
+
+// URI returns the otpauth URI that authenticator apps import, usually from
+// a QR code.
+func URI(issuer, account, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func generate(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
@@ -0,0 +1,134 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA-1 seed of RFC 6238 appendix B.
+var rfcKey = []byte("12345678901234567890")
+
+func TestGenerateRFC6238(t *testing.T) {
+	// appendix B lists eight digits; six digit codes are their last six
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		step := test.unix / int64(Period/time.Second)
+		want := test.code[len(test.code)-digits:]
+		if got := generate(rfcKey, step); got != want {
+			t.Errorf("generate(T=%d) = %s, want %s", test.unix, got, want)
+		}
+		got, ok := Verify(rfcKey, want, time.Unix(test.unix, 0))
+		if !ok || got != step {
+			t.Errorf("Verify(%s at %d) = %d, %t, want step %d", want, test.unix, got, ok, step)
+		}
+	}
+}
+
+func TestVerifyWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / int64(Period/time.Second)
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		step, ok := Verify(rfcKey, generate(rfcKey, current+offset), now)
+		want := offset >= -skew && offset <= skew
+		if ok != want {
+			t.Errorf("code of step %+d: accepted %t, want %t", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code of step %+d: matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := generate(rfcKey, now.Unix()/int64(Period/time.Second))
+	tests := map[string]string{
+		"empty":          "",
+		"too short":      code[:digits-1],
+		"too long":       code + "0",
+		"eight digits":   "89005924",
+		"other key":      generate([]byte("another secret key!!"), now.Unix()/int64(Period/time.Second)),
+		"spaces":         " " + code[1:],
+		"not all digits": code[:digits-1] + "a",
+	}
+	for name, code := range tests {
+		if step, ok := Verify(rfcKey, code, now); ok {
+			t.Errorf("%s: Verify(%q) matched step %d", name, code, step)
+		}
+	}
+}
+
+func TestStepTime(t *testing.T) {
+	step := int64(1234567890) / int64(Period/time.Second)
+	code := generate(rfcKey, step)
+	expires := StepTime(step)
+
+	if _, ok := Verify(rfcKey, code, expires.Add(-time.Second)); !ok {
+		t.Errorf("code rejected a second before %v", expires)
+	}
+	if _, ok := Verify(rfcKey, code, expires); ok {
+		t.Errorf("code accepted at %v, when its step has ended", expires)
+	}
+	if want := time.Unix((step+2)*30, 0); !expires.Equal(want) {
+		t.Errorf("StepTime = %v, want %v", expires, want)
+	}
+}
+
+func TestDecodeSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := DecodeSecret(secret)
+	if err != nil || len(key) != secretLength {
+		t.Fatalf("DecodeSecret(GenerateSecret()) = %d bytes, %v, want %d", len(key), err, secretLength)
+	}
+
+	// the RFC seed as authenticator apps show it
+	for _, input := range []string{
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"gezdgnbvgy3tqojqgezdgnbvgy3tqojq",
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====",
+	} {
+		key, err := DecodeSecret(input)
+		if err != nil || string(key) != string(rfcKey) {
+			t.Errorf("DecodeSecret(%q) = %q, %v, want the RFC seed", input, key, err)
+		}
+	}
+
+	for _, input := range []string{"GEZDGNBVGY3TQOJQ", "not base32!", ""} {
+		if _, err := DecodeSecret(input); err == nil {
+			t.Errorf("DecodeSecret(%q) succeeded", input)
+		}
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("My IdP", "user 1", "GEZDGNBVGY3TQOJQ"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || !strings.HasPrefix(uri.EscapedPath(), "/My%20IdP:user%201") {
+		t.Errorf("URI = %s, want otpauth://totp/My%%20IdP:user%%201", uri)
+	}
+	query := uri.Query()
+	for param, want := range map[string]string{"secret": "GEZDGNBVGY3TQOJQ", "issuer": "My IdP", "algorithm": "SHA1", "digits": "6", "period": "30"} {
+		if got := query.Get(param); got != want {
+			t.Errorf("%s = %q, want %q", param, got, want)
+		}
+	}
+}
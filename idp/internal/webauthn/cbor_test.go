@@ -0,0 +1,176 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encodeCBOR encodes the values decodeCBOR returns, for building test
+// inputs. Map keys are written in iteration order.
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+		return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[any]any:
+		out := head(5, uint64(len(v)))
+		for key, value := range v {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(value)...)
+		}
+		return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// examples of RFC 8949 appendix A
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"18 18", int64(24)},
+		{"19 03e8", int64(1000)},
+		{"1a 000f4240", int64(1000000)},
+		{"1b 000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"38 63", int64(-100)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"44 01020304", []byte{1, 2, 3, 4}},
+		{"64 49455446", "IETF"},
+		{"80", []any{}},
+		{"83 01 82 02 03 82 04 05", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a2 01 02 03 04", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a2 61 61 01 61 62 82 02 03", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+	}
+	for _, test := range tests {
+		got, rest, err := decodeCBOR(decodeHex(t, test.in))
+		if err != nil {
+			t.Errorf("decodeCBOR(%s): %v", test.in, err)
+			continue
+		}
+		if len(rest) > 0 {
+			t.Errorf("decodeCBOR(%s) left %x", test.in, rest)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decodeCBOR(%s) = %#v, want %#v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestDecodeCBORReturnsRest(t *testing.T) {
+	got, rest, err := decodeCBOR(decodeHex(t, "43 010203 a0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.([]byte), []byte{1, 2, 3}) || !bytes.Equal(rest, []byte{0xa0}) {
+		t.Fatalf("decodeCBOR = %x, rest %x", got, rest)
+	}
+}
+
+func TestDecodeCBORTruncated(t *testing.T) {
+	// an attestation object with attestation "none"
+	full := decodeHex(t, "a3 63666d74 646e6f6e65 6761747453746d74 a0 6861757468446174 61 44 deadbeef")
+	if _, rest, err := decodeCBOR(full); err != nil || len(rest) > 0 {
+		t.Fatalf("decodeCBOR(full) = %v, rest %x", err, rest)
+	}
+	for n := range len(full) {
+		if _, _, err := decodeCBOR(full[:n]); !errors.Is(err, errTruncated) {
+			t.Errorf("decodeCBOR(first %d bytes) = %v, want %v", n, err, errTruncated)
+		}
+	}
+
+	// lengths far beyond the input must not be allocated
+	for _, in := range []string{
+		"5b ffffffffffffffff",
+		"7a 7fffffff",
+		"9b ffffffffffffffff",
+		"bb 0fffffffffffffff",
+		"19 01",
+	} {
+		if _, _, err := decodeCBOR(decodeHex(t, in)); !errors.Is(err, errTruncated) {
+			t.Errorf("decodeCBOR(%s) = %v, want %v", in, err, errTruncated)
+		}
+	}
+}
+
+func TestDecodeCBORNesting(t *testing.T) {
+	nested := func(depth int, open string) []byte {
+		return decodeHex(t, strings.Repeat(open, depth)+"00")
+	}
+	for _, open := range []string{"81", "a1 00"} {
+		if _, _, err := decodeCBOR(nested(maxCBORDepth, open)); err != nil {
+			t.Errorf("decodeCBOR(%d levels of %s): %v", maxCBORDepth, open, err)
+		}
+		_, _, err := decodeCBOR(nested(maxCBORDepth+1, open))
+		if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+			t.Errorf("decodeCBOR(%d levels of %s) = %v, want nesting error", maxCBORDepth+1, open, err)
+		}
+	}
+
+	// input nested far deeper fails at the limit instead of recursing
+	if _, _, err := decodeCBOR(nested(10000, "81")); err == nil {
+		t.Error("decodeCBOR accepted 10000 levels of arrays")
+	}
+}
+
+func TestDecodeCBORRejects(t *testing.T) {
+	tests := map[string]string{
+		"indefinite length":  "5f 41 00 ff",
+		"half float":         "f9 3c00",
+		"undefined":          "f7",
+		"tag":                "c0 00",
+		"uint overflow":      "1b ffffffffffffffff",
+		"negative overflow":  "3b ffffffffffffffff",
+		"duplicate map key":  "a2 01 01 01 02",
+		"byte string key":    "a1 41 00 00",
+		"array key":          "a1 80 00",
+		"reserved arguments": "1c",
+	}
+	for name, in := range tests {
+		if got, _, err := decodeCBOR(decodeHex(t, in)); err == nil {
+			t.Errorf("%s: decodeCBOR(%s) = %#v, want error", name, in, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) that credentials may use, in the order of
+// preference offered to authenticators.
+const (
+	AlgorithmES256 = -7
+	AlgorithmEdDSA = -8
+	AlgorithmRS256 = -257
+)
+
+var algorithms = []int64{AlgorithmES256, AlgorithmEdDSA, AlgorithmRS256}
+
+// COSE key parameters and values (RFC 9052 7, RFC 9053 7).
+const (
+	coseKeyType      = 1
+	coseAlgorithm    = 3
+	coseCurve        = -1
+	coseX            = -2
+	coseY            = -3
+	coseRSAModulus   = -1
+	coseRSAExponent  = -2
+	coseKeyTypeOKP   = 1
+	coseKeyTypeEC2   = 2
+	coseKeyTypeRSA   = 3
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+	minRSAKeyBits    = 2048
+)
+
+// publicKey is a credential public key parsed from its COSE encoding.
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+func parsePublicKey(raw []byte) (*publicKey, error) {
+	item, rest, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("invalid credential public key: trailing data")
+	}
+	params, ok := item.(map[any]any)
+	if !ok {
+		return nil, errors.New("invalid credential public key: not a COSE key")
+	}
+	kty, _ := params[int64(coseKeyType)].(int64)
+	alg, _ := params[int64(coseAlgorithm)].(int64)
+
+	switch {
+	case kty == coseKeyTypeEC2 && alg == AlgorithmES256:
+		crv, _ := params[int64(coseCurve)].(int64)
+		x, _ := params[int64(coseX)].([]byte)
+		y, _ := params[int64(coseY)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid credential public key: ES256 needs a P-256 point")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		return &publicKey{algorithm: alg, key: key}, nil
+	case kty == coseKeyTypeOKP && alg == AlgorithmEdDSA:
+		crv, _ := params[int64(coseCurve)].(int64)
+		x, _ := params[int64(coseX)].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid credential public key: EdDSA needs an Ed25519 key")
+		}
+		return &publicKey{algorithm: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == coseKeyTypeRSA && alg == AlgorithmRS256:
+		n, _ := params[int64(coseRSAModulus)].([]byte)
+		e, _ := params[int64(coseRSAExponent)].([]byte)
+		modulus := new(big.Int).SetBytes(n)
+		exponent := new(big.Int).SetBytes(e)
+		if modulus.BitLen() < minRSAKeyBits || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid credential public key: RS256 needs an RSA key of at least %d bits", minRSAKeyBits)
+		}
+		return &publicKey{algorithm: alg, key: &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}}, nil
+	}
+	return nil, fmt.Errorf("unsupported credential public key: kty %d, alg %d", kty, alg)
+}
+
+// verify checks the signature over the authenticator data and the hash of
+// the client data.
+func (k *publicKey) verify(signed, signature []byte) error {
+	var ok bool
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		ok = ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, signed, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !ok {
+		return errors.New("signature is invalid")
+	}
+	return nil
+}
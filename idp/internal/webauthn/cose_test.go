@@ -0,0 +1,160 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func ecdsaCOSEKey(key *ecdsa.PublicKey) map[any]any {
+	point, err := key.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return map[any]any{
+		coseKeyType:   coseKeyTypeEC2,
+		coseAlgorithm: AlgorithmES256,
+		coseCurve:     coseCurveP256,
+		coseX:         point[1:33],
+		coseY:         point[33:],
+	}
+}
+
+func ed25519COSEKey(key ed25519.PublicKey) map[any]any {
+	return map[any]any{
+		coseKeyType:   coseKeyTypeOKP,
+		coseAlgorithm: AlgorithmEdDSA,
+		coseCurve:     coseCurveEd25519,
+		coseX:         []byte(key),
+	}
+}
+
+func rsaCOSEKey(key *rsa.PublicKey) map[any]any {
+	return map[any]any{
+		coseKeyType:     coseKeyTypeRSA,
+		coseAlgorithm:   AlgorithmRS256,
+		coseRSAModulus:  key.N.Bytes(),
+		coseRSAExponent: big.NewInt(int64(key.E)).Bytes(),
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	message := []byte("authenticator data and client data hash")
+	digest := sha256.Sum256(message)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cose      map[any]any
+		algorithm int64
+		signature []byte
+	}{
+		{"ES256", ecdsaCOSEKey(&ecKey.PublicKey), AlgorithmES256, ecSignature},
+		{"EdDSA", ed25519COSEKey(edPublic), AlgorithmEdDSA, ed25519.Sign(edKey, message)},
+		{"RS256", rsaCOSEKey(&rsaKey.PublicKey), AlgorithmRS256, rsaSignature},
+	}
+	for _, test := range tests {
+		key, err := parsePublicKey(encodeCBOR(test.cose))
+		if err != nil {
+			t.Errorf("%s: parsePublicKey: %v", test.name, err)
+			continue
+		}
+		if key.algorithm != test.algorithm {
+			t.Errorf("%s: algorithm = %d, want %d", test.name, key.algorithm, test.algorithm)
+		}
+		if err := key.verify(message, test.signature); err != nil {
+			t.Errorf("%s: verify: %v", test.name, err)
+		}
+		if err := key.verify([]byte("other message"), test.signature); err == nil {
+			t.Errorf("%s: verify accepted the signature of another message", test.name)
+		}
+		tampered := append([]byte{}, test.signature...)
+		tampered[len(tampered)/2] ^= 1
+		if err := key.verify(message, tampered); err == nil {
+			t.Errorf("%s: verify accepted a tampered signature", test.name)
+		}
+	}
+}
+
+func TestParsePublicKeyRejects(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(key map[any]any, param int, value any) map[any]any {
+		changed := make(map[any]any, len(key))
+		for k, v := range key {
+			changed[k] = v
+		}
+		if value == nil {
+			delete(changed, param)
+		} else {
+			changed[param] = value
+		}
+		return changed
+	}
+	ec := ecdsaCOSEKey(&ecKey.PublicKey)
+	ed := ed25519COSEKey(edPublic)
+	offCurve := append([]byte{}, ec[coseY].([]byte)...)
+	offCurve[31] ^= 1
+
+	tests := map[string][]byte{
+		"not a map":             encodeCBOR([]any{coseKeyTypeEC2, AlgorithmES256}),
+		"trailing data":         append(encodeCBOR(ec), 0),
+		"truncated":             encodeCBOR(ec)[:40],
+		"unsupported algorithm": encodeCBOR(with(ec, coseAlgorithm, -35)),
+		"EC2 key with EdDSA":    encodeCBOR(with(ec, coseAlgorithm, AlgorithmEdDSA)),
+		"P-384 curve":           encodeCBOR(with(ec, coseCurve, 2)),
+		"short coordinate":      encodeCBOR(with(ec, coseX, make([]byte, 31))),
+		"missing coordinate":    encodeCBOR(with(ec, coseY, nil)),
+		"point not on curve":    encodeCBOR(with(ec, coseY, offCurve)),
+		"X25519 curve":          encodeCBOR(with(ed, coseCurve, 4)),
+		"short Ed25519 key":     encodeCBOR(with(ed, coseX, []byte(edPublic[:16]))),
+		"1024 bit RSA key":      encodeCBOR(rsaCOSEKey(&weakKey.PublicKey)),
+		"RSA exponent 1":        encodeCBOR(with(rsaCOSEKey(&rsaKey.PublicKey), coseRSAExponent, []byte{1})),
+	}
+	for name, raw := range tests {
+		if _, err := parsePublicKey(raw); err == nil {
+			t.Errorf("%s: parsePublicKey accepted the key", name)
+		}
+	}
+}
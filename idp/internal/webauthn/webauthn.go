@@ -0,0 +1,423 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies (W3C Web Authentication
+// Level 2, sections 7.1 and 7.2) for passkeys. Credentials are registered
+// with attestation "none": the public key the browser reports is trusted and
+// attestation statements are not verified.
+//
+// The ceremonies work on the raw bytes the authenticator produced, so they
+// can be driven by a software authenticator as well as by a browser.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Timeout is how long the browser lets the user complete a ceremony,
+	// and so how long its challenge is valid.
+	Timeout         = 5 * time.Minute
+	challengeLength = 32
+	// maxCredentialIDLength is the limit of WebAuthn 7.1 step 23.
+	maxCredentialIDLength = 1023
+)
+
+// Flags of the authenticator data (WebAuthn 6.1).
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagBackupEligible         = 0x08
+	flagAttestedCredentialData = 0x40
+	flagExtensionData          = 0x80
+)
+
+// RelyingParty is the IdP as the authenticator sees it: ID is the domain
+// credentials are scoped to, Origins are the origins of the pages that run
+// the ceremonies.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// User is the account a credential is created for. ID is the user handle
+// that discoverable credentials return when signing in.
+type User struct {
+	ID          string
+	Name        string
+	DisplayName string
+}
+
+// Credential is a public key credential that passed registration.
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte
+	SignCount      uint32
+	UserVerified   bool
+	BackupEligible bool
+	Transports     []string
+}
+
+// AssertionResult is what a verified assertion tells about the
+// authenticator.
+type AssertionResult struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// NewChallenge returns a random challenge in base64url, the form it takes in
+// options and in the client data.
+func NewChallenge() (string, error) {
+	challenge := make([]byte, challengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", fmt.Errorf("failed to generate webauthn challenge: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+// Bytes is binary data that is base64url encoded in JSON, as in the JSON
+// serialization of WebAuthn Level 3.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return fmt.Errorf("invalid base64url: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions passed to
+// navigator.credentials.create.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions passed to
+// navigator.credentials.get. They allow any discoverable credential, so the
+// user does not have to enter a username first.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+func userVerification(required bool) string {
+	if required {
+		return "required"
+	}
+	return "preferred"
+}
+
+// CreationOptions returns the options to register a passkey for the user.
+// The credentials in exclude are already registered and are not created
+// again on the same authenticator.
+func (rp *RelyingParty) CreationOptions(challenge string, user User, exclude [][]byte, requireUserVerification bool) *CreationOptions {
+	options := &CreationOptions{
+		Challenge: challenge,
+		RP:        rpEntity{ID: rp.ID, Name: rp.Name},
+		User:      userEntity{ID: Bytes(user.ID), Name: user.Name, DisplayName: user.DisplayName},
+		Timeout:   Timeout.Milliseconds(),
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   userVerification(requireUserVerification),
+		},
+		Attestation:        "none",
+		ExcludeCredentials: []credentialDescriptor{},
+	}
+	for _, alg := range algorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, credentialParameter{Type: "public-key", Alg: alg})
+	}
+	for _, id := range exclude {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{Type: "public-key", ID: id})
+	}
+	return options
+}
+
+// RequestOptions returns the options to sign in with a passkey.
+func (rp *RelyingParty) RequestOptions(challenge string, requireUserVerification bool) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          Timeout.Milliseconds(),
+		AllowCredentials: []credentialDescriptor{},
+		UserVerification: userVerification(requireUserVerification),
+	}
+}
+
+// RegistrationResponse is the JSON serialization of the PublicKeyCredential
+// returned by navigator.credentials.create.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON serialization of the PublicKeyCredential
+// returned by navigator.credentials.get.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Challenge returns the challenge the client data was created for, so that
+// the caller can look up the ceremony it belongs to before verifying it.
+func Challenge(clientDataJSON []byte) (string, error) {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return "", fmt.Errorf("invalid client data: %w", err)
+	}
+	if data.Challenge == "" {
+		return "", errors.New("client data has no challenge")
+	}
+	return data.Challenge, nil
+}
+
+// verifyClientData checks the client data of a ceremony (WebAuthn 7.1 steps
+// 7 to 10, 7.2 steps 11 to 14).
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("client data type must be %s", ceremony)
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return errors.New("client data challenge does not match")
+	}
+	if !slices.Contains(rp.Origins, data.Origin) {
+		return fmt.Errorf("origin %s is not allowed", data.Origin)
+	}
+	if data.CrossOrigin {
+		return errors.New("cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData splits the authenticator data (WebAuthn 6.1) and
+// the attested credential data it carries during registration.
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	data := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+	if data.flags&flagAttestedCredentialData != 0 {
+		// aaguid, credential id length, credential id, public key
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > maxCredentialIDLength || len(rest) < idLength {
+			return nil, errors.New("credential id is invalid")
+		}
+		data.credentialID, rest = rest[:idLength], rest[idLength:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		data.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if data.flags&flagExtensionData != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authenticator extensions: %w", err)
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("authenticator data has trailing bytes")
+	}
+	return data, nil
+}
+
+// verifyAuthenticatorData checks the RP ID hash and the user flags (WebAuthn
+// 7.1 steps 13 to 15, 7.2 steps 15 to 17).
+func (rp *RelyingParty) verifyAuthenticatorData(data *authenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return errors.New("authenticator data is for another relying party")
+	}
+	if data.flags&flagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+	if requireUserVerification && data.flags&flagUserVerified == 0 {
+		return errors.New("user was not verified")
+	}
+	return nil
+}
+
+// VerifyRegistration runs the registration ceremony checks on the response
+// to the options created with challenge and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(response *RegistrationResponse, challenge string, requireUserVerification bool) (*Credential, error) {
+	if response.Type != "public-key" {
+		return nil, errors.New("credential type must be public-key")
+	}
+	if err := rp.verifyClientData(response.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(response.Response.AttestationObject)
+	if err != nil || len(rest) > 0 {
+		return nil, errors.New("attestation object is invalid")
+	}
+	attestation, _ := item.(map[any]any)
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authenticator data")
+	}
+	if format, _ := attestation["fmt"].(string); format == "" {
+		return nil, errors.New("attestation object has no format")
+	}
+
+	data, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(data, requireUserVerification); err != nil {
+		return nil, err
+	}
+	if data.credentialID == nil {
+		return nil, errors.New("authenticator data has no attested credential")
+	}
+	if len(response.RawID) > 0 && !bytes.Equal(response.RawID, data.credentialID) {
+		return nil, errors.New("credential id does not match the authenticator data")
+	}
+	if _, err := parsePublicKey(data.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:             data.credentialID,
+		PublicKey:      data.publicKey,
+		SignCount:      data.signCount,
+		UserVerified:   data.flags&flagUserVerified != 0,
+		BackupEligible: data.flags&flagBackupEligible != 0,
+		Transports:     response.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion runs the authentication ceremony checks on the response
+// to the options created with challenge, for the credential whose COSE
+// public key is given. Comparing the signature counter with the stored one
+// is left to the caller.
+func (rp *RelyingParty) VerifyAssertion(response *AssertionResponse, challenge string, credentialPublicKey []byte, requireUserVerification bool) (*AssertionResult, error) {
+	if response.Type != "public-key" {
+		return nil, errors.New("credential type must be public-key")
+	}
+	if err := rp.verifyClientData(response.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	data, err := parseAuthenticatorData(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(data, requireUserVerification); err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(credentialPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := slices.Concat([]byte(response.Response.AuthenticatorData), clientDataHash[:])
+	if err := key.verify(signed, response.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	return &AssertionResult{
+		SignCount:    data.signCount,
+		UserVerified: data.flags&flagUserVerified != 0,
+	}, nil
+}
@@ -0,0 +1,251 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"idp/internal/webauthn/webauthntest"
+)
+
+const testOrigin = "https://idp.example"
+
+func testRelyingParty() *RelyingParty {
+	return &RelyingParty{ID: "idp.example", Name: "IdP", Origins: []string{testOrigin}}
+}
+
+func newChallenge(t *testing.T) string {
+	t.Helper()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+func registrationResponse(t *testing.T, raw []byte) *RegistrationResponse {
+	t.Helper()
+	var response RegistrationResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatal(err)
+	}
+	return &response
+}
+
+func assertionResponse(t *testing.T, raw []byte) *AssertionResponse {
+	t.Helper()
+	var response AssertionResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatal(err)
+	}
+	return &response
+}
+
+// register runs the registration ceremony for the authenticator as a
+// browser would answer the options.
+func register(t *testing.T, rp *RelyingParty, authenticator *webauthntest.Authenticator) *Credential {
+	t.Helper()
+	options := rp.CreationOptions(newChallenge(t), User{ID: "user-1", Name: "user1"}, nil, false)
+	response := registrationResponse(t, authenticator.Create(options.Challenge, options.User.ID))
+	credential, err := rp.VerifyRegistration(response, options.Challenge, false)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return credential
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := webauthntest.New(rp.ID, testOrigin)
+
+	credential := register(t, rp, authenticator)
+	if !bytes.Equal(credential.ID, authenticator.CredentialID) {
+		t.Errorf("credential id = %x, want %x", credential.ID, authenticator.CredentialID)
+	}
+	if !bytes.Equal(credential.PublicKey, authenticator.PublicKey()) {
+		t.Error("credential public key differs from the authenticator's")
+	}
+	if !credential.UserVerified || credential.SignCount != 0 {
+		t.Errorf("credential = %+v, want user verified with sign count 0", credential)
+	}
+	if !bytes.Equal(authenticator.UserHandle, []byte("user-1")) {
+		t.Errorf("user handle = %q, want user-1", authenticator.UserHandle)
+	}
+
+	for want := uint32(1); want <= 2; want++ {
+		options := rp.RequestOptions(newChallenge(t), true)
+		response := assertionResponse(t, authenticator.Get(options.Challenge))
+		result, err := rp.VerifyAssertion(response, options.Challenge, credential.PublicKey, true)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if result.SignCount != want || !result.UserVerified {
+			t.Errorf("assertion result = %+v, want sign count %d with user verified", result, want)
+		}
+	}
+}
+
+func TestAssertionWithoutUserVerification(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := webauthntest.New(rp.ID, testOrigin)
+	credential := register(t, rp, authenticator)
+
+	authenticator.UserVerified = false
+	challenge := newChallenge(t)
+	result, err := rp.VerifyAssertion(assertionResponse(t, authenticator.Get(challenge)), challenge, credential.PublicKey, false)
+	if err != nil {
+		t.Fatalf("VerifyAssertion: %v", err)
+	}
+	if result.UserVerified {
+		t.Error("result reports a verified user")
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		requireUV bool
+		// prepare changes the authenticator before it answers
+		prepare func(*webauthntest.Authenticator)
+		// tamper changes the response after the authenticator answered
+		tamper func(*RegistrationResponse)
+	}{
+		{name: "bad origin", prepare: func(a *webauthntest.Authenticator) { a.Origin = "https://evil.example" }},
+		{name: "origin of a subdomain", prepare: func(a *webauthntest.Authenticator) { a.Origin = "https://login.idp.example" }},
+		{name: "wrong rpIdHash", prepare: func(a *webauthntest.Authenticator) { a.RPID = "evil.example" }},
+		{name: "user verification required but missing", requireUV: true, prepare: func(a *webauthntest.Authenticator) { a.UserVerified = false }},
+		{name: "user not present", prepare: func(a *webauthntest.Authenticator) { a.UserPresent = false }},
+		{name: "assertion client data", prepare: func(a *webauthntest.Authenticator) { a.Type = "webauthn.get" }},
+		{name: "credential type", tamper: func(r *RegistrationResponse) { r.Type = "password" }},
+		{name: "raw id of another credential", tamper: func(r *RegistrationResponse) { r.RawID = []byte("other") }},
+		{name: "truncated attestation object", tamper: func(r *RegistrationResponse) {
+			r.Response.AttestationObject = r.Response.AttestationObject[:len(r.Response.AttestationObject)-1]
+		}},
+		{name: "trailing attestation data", tamper: func(r *RegistrationResponse) {
+			r.Response.AttestationObject = append(r.Response.AttestationObject, 0)
+		}},
+		{name: "invalid client data", tamper: func(r *RegistrationResponse) { r.Response.ClientDataJSON = []byte("{") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			authenticator := webauthntest.New(rp.ID, testOrigin)
+			if test.prepare != nil {
+				test.prepare(authenticator)
+			}
+			challenge := newChallenge(t)
+			response := registrationResponse(t, authenticator.Create(challenge, []byte("user-1")))
+			if test.tamper != nil {
+				test.tamper(response)
+			}
+			if credential, err := rp.VerifyRegistration(response, challenge, test.requireUV); err == nil {
+				t.Fatalf("VerifyRegistration accepted the response: %+v", credential)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationRejectsReplayedChallenge(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := webauthntest.New(rp.ID, testOrigin)
+	earlier := newChallenge(t)
+	response := registrationResponse(t, authenticator.Create(earlier, []byte("user-1")))
+
+	if _, err := rp.VerifyRegistration(response, newChallenge(t), false); err == nil {
+		t.Fatal("VerifyRegistration accepted a response to an earlier challenge")
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		requireUV bool
+		prepare   func(*webauthntest.Authenticator)
+		tamper    func(*AssertionResponse)
+	}{
+		{name: "bad origin", prepare: func(a *webauthntest.Authenticator) { a.Origin = "http://idp.example" }},
+		{name: "wrong rpIdHash", prepare: func(a *webauthntest.Authenticator) { a.RPID = "evil.example" }},
+		{name: "user verification required but missing", requireUV: true, prepare: func(a *webauthntest.Authenticator) { a.UserVerified = false }},
+		{name: "user not present", prepare: func(a *webauthntest.Authenticator) { a.UserPresent = false }},
+		{name: "registration client data", prepare: func(a *webauthntest.Authenticator) { a.Type = "webauthn.create" }},
+		{name: "credential type", tamper: func(r *AssertionResponse) { r.Type = "password" }},
+		{name: "bad signature", tamper: func(r *AssertionResponse) { r.Response.Signature[10] ^= 1 }},
+		{name: "signature over other client data", tamper: func(r *AssertionResponse) {
+			r.Response.ClientDataJSON = bytes.Replace(r.Response.ClientDataJSON, []byte(`"type"`), []byte(` "type"`), 1)
+		}},
+		{name: "truncated authenticator data", tamper: func(r *AssertionResponse) {
+			r.Response.AuthenticatorData = r.Response.AuthenticatorData[:36]
+		}},
+		{name: "trailing authenticator data", tamper: func(r *AssertionResponse) {
+			r.Response.AuthenticatorData = append(r.Response.AuthenticatorData, 0)
+		}},
+		{name: "truncated extensions", tamper: func(r *AssertionResponse) {
+			r.Response.AuthenticatorData[32] |= flagExtensionData
+			r.Response.AuthenticatorData = append(r.Response.AuthenticatorData, 0xa1, 0x61)
+		}},
+		{name: "attested credential data without a key", tamper: func(r *AssertionResponse) {
+			r.Response.AuthenticatorData[32] |= flagAttestedCredentialData
+			r.Response.AuthenticatorData = append(r.Response.AuthenticatorData, make([]byte, 18)...)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			authenticator := webauthntest.New(rp.ID, testOrigin)
+			credential := register(t, rp, authenticator)
+			if test.prepare != nil {
+				test.prepare(authenticator)
+			}
+			challenge := newChallenge(t)
+			response := assertionResponse(t, authenticator.Get(challenge))
+			if test.tamper != nil {
+				test.tamper(response)
+			}
+			if result, err := rp.VerifyAssertion(response, challenge, credential.PublicKey, test.requireUV); err == nil {
+				t.Fatalf("VerifyAssertion accepted the response: %+v", result)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejectsReplayedChallenge(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := webauthntest.New(rp.ID, testOrigin)
+	credential := register(t, rp, authenticator)
+
+	earlier := newChallenge(t)
+	response := assertionResponse(t, authenticator.Get(earlier))
+	if _, err := rp.VerifyAssertion(response, earlier, credential.PublicKey, false); err != nil {
+		t.Fatalf("VerifyAssertion: %v", err)
+	}
+	// the challenge of the ceremony the relying party runs now
+	if _, err := rp.VerifyAssertion(response, newChallenge(t), credential.PublicKey, false); err == nil {
+		t.Fatal("VerifyAssertion accepted a response to an earlier challenge")
+	}
+}
+
+func TestVerifyAssertionRejectsOtherCredential(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := webauthntest.New(rp.ID, testOrigin)
+	register(t, rp, authenticator)
+	other := register(t, rp, webauthntest.New(rp.ID, testOrigin))
+
+	challenge := newChallenge(t)
+	response := assertionResponse(t, authenticator.Get(challenge))
+	if _, err := rp.VerifyAssertion(response, challenge, other.PublicKey, false); err == nil {
+		t.Fatal("VerifyAssertion accepted a signature by another credential")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	challenge := newChallenge(t)
+	response := assertionResponse(t, webauthntest.New("idp.example", testOrigin).Get(challenge))
+	if got, err := Challenge(response.Response.ClientDataJSON); err != nil || got != challenge {
+		t.Fatalf("Challenge = %q, %v, want %q", got, err, challenge)
+	}
+	for _, raw := range []string{`{"type":"webauthn.get"}`, `[]`, ``} {
+		if _, err := Challenge([]byte(raw)); err == nil {
+			t.Errorf("Challenge(%s) succeeded", raw)
+		}
+	}
+}
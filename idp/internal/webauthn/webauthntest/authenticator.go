@@ -0,0 +1,193 @@
+// Package webauthntest provides a software authenticator that answers the
+// options of the webauthn package the way a browser and a platform
+// authenticator would, for tests of the registration and authentication
+// ceremonies.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+)
+
+// Flags of the authenticator data (WebAuthn 6.1).
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+// Authenticator holds one ES256 credential. Its fields can be changed
+// between ceremonies to produce responses a relying party has to reject.
+type Authenticator struct {
+	// RPID is hashed into the authenticator data.
+	RPID string
+	// Origin and Type go into the client data. An empty Type means
+	// webauthn.create or webauthn.get as the ceremony requires.
+	Origin string
+	Type   string
+	// UserPresent and UserVerified set the flags of the authenticator data.
+	UserPresent  bool
+	UserVerified bool
+	// SignCount is the counter of the last signature. Get increments it
+	// before signing.
+	SignCount uint32
+	// CredentialID identifies the credential, UserHandle is the user id it
+	// was created for.
+	CredentialID []byte
+	UserHandle   []byte
+
+	key *ecdsa.PrivateKey
+}
+
+// New returns an authenticator with a fresh credential for the relying
+// party, answering as a page on origin with a present and verified user.
+func New(rpID, origin string) *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &Authenticator{
+		RPID:         rpID,
+		Origin:       origin,
+		UserPresent:  true,
+		UserVerified: true,
+		CredentialID: []byte(rand.Text()),
+		key:          key,
+	}
+}
+
+// PublicKey returns the COSE encoding of the credential public key.
+func (a *Authenticator) PublicKey() []byte {
+	x := a.key.X.FillBytes(make([]byte, 32))
+	y := a.key.Y.FillBytes(make([]byte, 32))
+	return slices.Concat(
+		cborHead(5, 5),
+		cborInt(1), cborInt(2), // kty: EC2
+		cborInt(3), cborInt(-7), // alg: ES256
+		cborInt(-1), cborInt(1), // crv: P-256
+		cborInt(-2), cborBytes(x),
+		cborInt(-3), cborBytes(y),
+	)
+}
+
+// Create answers creation options with the JSON of a registration response
+// with attestation "none". userHandle is the user.id of the options.
+func (a *Authenticator) Create(challenge string, userHandle []byte) []byte {
+	a.UserHandle = userHandle
+	clientData := a.clientData("webauthn.create", challenge)
+
+	authData := a.authenticatorData(flagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // aaguid
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.CredentialID)))
+	authData = append(authData, a.CredentialID...)
+	authData = append(authData, a.PublicKey()...)
+
+	attestation := slices.Concat(
+		cborHead(5, 3),
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborHead(5, 0),
+		cborText("authData"), cborBytes(authData),
+	)
+	return a.marshal(map[string]any{
+		"clientDataJSON":    encode(clientData),
+		"attestationObject": encode(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// Get answers request options with the JSON of an assertion response.
+func (a *Authenticator) Get(challenge string) []byte {
+	a.SignCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authenticatorData(0)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(slices.Concat(authData, clientDataHash[:]))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return a.marshal(map[string]any{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(a.UserHandle),
+	})
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) []byte {
+	if a.Type != "" {
+		ceremony = a.Type
+	}
+	raw, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.Origin,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func (a *Authenticator) authenticatorData(flags byte) []byte {
+	if a.UserPresent {
+		flags |= flagUserPresent
+	}
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.SignCount)
+}
+
+func (a *Authenticator) marshal(response map[string]any) []byte {
+	raw, err := json.Marshal(map[string]any{
+		"id":       encode(a.CredentialID),
+		"rawId":    encode(a.CredentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// cborHead encodes the initial bytes of a CBOR data item (RFC 8949 3).
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+}
+
+func cborInt(v int) []byte {
+	if v < 0 {
+		return cborHead(1, -1-v)
+	}
+	return cborHead(0, v)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}